@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -9,25 +11,116 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Minesto23/peerwire/internal/engine"
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/ratelimit"
+	"github.com/Minesto23/peerwire/internal/storage"
 	"github.com/Minesto23/peerwire/internal/torrent"
 )
 
 //go:embed web/*
 var webFS embed.FS
 
-type Status struct {
-	Running bool
+// TorrentStatus is one torrent as shown in the list.
+type TorrentStatus struct {
+	Hash    string
+	Name    string
+	State   engine.TorrentState
 	Percent float64
-	Message string
+	Error   string
+
+	// From the torrent's events.
+	DownRate, UpRate float64 // bytes per second
+	Peers            int
+	LastEvent        string // latest hash failure, tracker or storage error
+
+	Files []FileStatus
+}
+
+// FileStatus is one file of a torrent, with whether it is downloaded.
+type FileStatus struct {
+	Path   string
+	Length int64
+	Wanted bool
+}
+
+type Status struct {
+	Message  string
+	Torrents []TorrentStatus
+}
+
+var message = "Waiting for torrent..."
+var session *engine.Session
+
+// live holds what each torrent's event stream told us, by info hash.
+var (
+	liveMu sync.Mutex
+	live   = map[[20]byte]*liveStatus{}
+)
+
+type liveStatus struct {
+	rates       engine.Rates
+	lastEvent   string
+	unsubscribe func()
+}
+
+// follow records c's events for the status page until unfollow.
+func follow(c *engine.Client) {
+	events, unsubscribe := c.Subscribe()
+	ls := &liveStatus{unsubscribe: unsubscribe}
+	liveMu.Lock()
+	live[c.InfoHash] = ls
+	liveMu.Unlock()
+
+	go func() {
+		for ev := range events {
+			liveMu.Lock()
+			switch ev := ev.(type) {
+			case engine.Rates:
+				ls.rates = ev
+			case engine.StateChanged:
+				if ev.State != engine.StateRunning {
+					ls.rates = engine.Rates{}
+				}
+			case engine.HashFailed:
+				ls.lastEvent = fmt.Sprintf("Piece %d from %s failed its hash check", ev.Index, ev.Peer)
+			case engine.PeerBanned:
+				ls.lastEvent = fmt.Sprintf("Banned %s: %s", ev.IP, ev.Reason)
+			case engine.TrackerAnnounced:
+				if ev.Err != nil {
+					ls.lastEvent = fmt.Sprintf("Tracker %s failed: %v", ev.URL, ev.Err)
+				}
+			case engine.StorageError:
+				ls.lastEvent = fmt.Sprintf("Storage error (%s): %v", ev.Op, ev.Err)
+			}
+			liveMu.Unlock()
+		}
+	}()
 }
 
-var currentStatus = Status{Message: "Waiting for torrent..."}
-var client *engine.Client
+func unfollow(infoHash [20]byte) {
+	liveMu.Lock()
+	ls := live[infoHash]
+	delete(live, infoHash)
+	liveMu.Unlock()
+	if ls != nil {
+		ls.unsubscribe()
+	}
+}
 
 func main() {
+	var err error
+	session, err = engine.NewSession(engine.SessionParams{})
+	if err != nil {
+		panic(err)
+	}
+
 	// Serve static files from embedded FS
 	root, _ := fs.Sub(webFS, "web")
 	fs := http.FileServer(http.FS(root))
@@ -43,6 +136,14 @@ func main() {
 	http.HandleFunc("/upload", handleUpload)
 	http.HandleFunc("/status", handleStatus)
 	http.HandleFunc("/browse", handleBrowse)
+	http.HandleFunc("/pause", handleControl)
+	http.HandleFunc("/resume", handleControl)
+	http.HandleFunc("/remove", handleControl)
+	http.HandleFunc("/recheck", handleControl)
+	http.HandleFunc("/settings", handleSettings)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/stream", handleStream)
+	http.HandleFunc("/files", handleFiles)
 
 	fmt.Println("Starting GUI at http://localhost:8080")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -117,7 +218,7 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	file, _, err := r.FormFile("torrent")
 	if err != nil {
-		currentStatus.Message = "Error: " + err.Error()
+		message = "Error: " + err.Error()
 		http.Redirect(w, r, "/", 303)
 		return
 	}
@@ -130,7 +231,7 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	// Validate destination
 	if info, err := os.Stat(destPath); err != nil || !info.IsDir() {
-		currentStatus.Message = "Invalid Destination: " + destPath
+		message = "Invalid Destination: " + destPath
 		http.Redirect(w, r, "/", 303)
 		return
 	}
@@ -147,43 +248,280 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	f.Close()
 
 	if err != nil {
-		currentStatus.Message = "Invalid Torrent: " + err.Error()
+		message = "Invalid Torrent: " + err.Error()
 		http.Redirect(w, r, "/", 303)
 		return
 	}
 
-	// Start Engine
-	currentStatus.Running = true
-	currentStatus.Percent = 0
-	currentStatus.Message = "Initialize: " + spec.Info.Name
-
-	fullOutputPath := filepath.Join(destPath, spec.Info.Name)
+	// The name comes from the torrent: keep it from escaping destPath.
+	name, err := storage.SanitizeName(spec.Info.Name)
+	if err != nil {
+		message = "Invalid Torrent: " + err.Error()
+		http.Redirect(w, r, "/", 303)
+		return
+	}
+	fullOutputPath := filepath.Join(destPath, name)
 
 	params := engine.ClientParams{OutputPath: fullOutputPath}
-	c, err := engine.NewClient(spec, params)
+	client, err := session.Add(spec, params)
 	if err != nil {
-		currentStatus.Message = "Engine Error: " + err.Error()
+		message = "Engine Error: " + err.Error()
 		http.Redirect(w, r, "/", 303)
 		return
 	}
-	client = c
-	go func() {
-		err := client.Download(func(done, total int) {
-			currentStatus.Percent = float64(done) / float64(total) * 100
-			currentStatus.Message = fmt.Sprintf("Downloading to %s... %.1f%%", destPath, currentStatus.Percent)
-		})
-		if err != nil {
-			currentStatus.Message = "Failed: " + err.Error()
-		} else {
-			currentStatus.Message = "Download Complete!"
-			currentStatus.Percent = 100
-		}
-	}()
+	follow(client)
+	message = "Added: " + spec.Info.Name
 
 	http.Redirect(w, r, "/", 303)
 }
 
+// handleStats returns the statistics of the torrent given by the hash
+// query parameter, peers included.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := parseHash(w, r)
+	if !ok {
+		return
+	}
+	info, ok := session.Get(infoHash)
+	if !ok {
+		http.Error(w, "Unknown torrent", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info.Client.Stats())
+}
+
+// handleStream serves a file of the torrent given by the hash query
+// parameter, file picking one by index (default 0). Range requests work
+// while the torrent downloads: they wait for the pieces they need.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := parseHash(w, r)
+	if !ok {
+		return
+	}
+	info, ok := session.Get(infoHash)
+	if !ok {
+		http.Error(w, "Unknown torrent", http.StatusNotFound)
+		return
+	}
+	files := info.Client.Spec.Info.FileList()
+	index := 0
+	if v := r.URL.Query().Get("file"); v != "" {
+		var err error
+		if index, err = strconv.Atoi(v); err != nil || index < 0 || index >= len(files) {
+			http.Error(w, "Invalid file index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	reader := info.Client.NewReader(files[index])
+	defer reader.Close()
+	// Stop waiting for pieces when the browser goes away.
+	stop := context.AfterFunc(r.Context(), func() { reader.Close() })
+	defer stop()
+	http.ServeContent(w, r, path.Base(files[index].Path), time.Time{}, reader)
+}
+
+// handleFiles changes the priority of a file of the torrent given by the
+// hash query parameter: file is its index, priority one of skip, low,
+// normal and high.
+func handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	infoHash, ok := parseHash(w, r)
+	if !ok {
+		return
+	}
+	info, ok := session.Get(infoHash)
+	if !ok {
+		http.Error(w, "Unknown torrent", http.StatusNotFound)
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("file"))
+	if err != nil {
+		http.Error(w, "Invalid file index", http.StatusBadRequest)
+		return
+	}
+	prio, err := piece.ParsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := info.Client.SetFilePriority(index, prio); err != nil {
+		message = "Error: " + err.Error()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseHash reads the hex info hash in the hash query parameter,
+// answering with an error if it is invalid.
+func parseHash(w http.ResponseWriter, r *http.Request) ([20]byte, bool) {
+	var infoHash [20]byte
+	raw, err := hex.DecodeString(r.URL.Query().Get("hash"))
+	if err != nil || len(raw) != len(infoHash) {
+		http.Error(w, "Invalid torrent hash", http.StatusBadRequest)
+		return infoHash, false
+	}
+	copy(infoHash[:], raw)
+	return infoHash, true
+}
+
+// handleControl pauses, resumes, rechecks or removes the torrent given by
+// the hash query parameter.
+func handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infoHash, ok := parseHash(w, r)
+	if !ok {
+		return
+	}
+	info, ok := session.Get(infoHash)
+	if !ok {
+		http.Error(w, "Unknown torrent", http.StatusNotFound)
+		return
+	}
+	name := info.Client.Spec.Info.Name
+
+	var err error
+	switch r.URL.Path {
+	case "/pause":
+		err = session.Pause(infoHash)
+	case "/resume":
+		err = session.Resume(infoHash)
+	case "/remove":
+		err = session.Remove(infoHash)
+		unfollow(infoHash)
+		message = "Removed: " + name
+	case "/recheck":
+		// Checking takes a while; progress shows up in the list.
+		go func() {
+			if err := info.Client.Recheck(); err != nil {
+				message = "Recheck failed: " + err.Error()
+			} else {
+				message = "Recheck complete: " + name
+			}
+		}()
+	}
+	if err != nil {
+		message = "Error: " + err.Error()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{Message: message, Torrents: []TorrentStatus{}}
+	for _, info := range session.List() {
+		done, total := info.Client.Progress()
+		ts := TorrentStatus{
+			Hash:  hex.EncodeToString(info.Client.InfoHash[:]),
+			Name:  info.Client.Spec.Info.Name,
+			State: info.State,
+		}
+		if total > 0 {
+			ts.Percent = float64(done) / float64(total) * 100
+		}
+		prios := info.Client.FilePriorities()
+		for i, f := range info.Client.Spec.Info.FileList() {
+			ts.Files = append(ts.Files, FileStatus{
+				Path:   f.Path,
+				Length: f.Length,
+				Wanted: prios[i] != piece.PrioritySkip,
+			})
+		}
+		if info.Err != nil {
+			ts.Error = info.Err.Error()
+		}
+		liveMu.Lock()
+		if ls := live[info.Client.InfoHash]; ls != nil {
+			ts.DownRate, ts.UpRate, ts.Peers = ls.rates.Download, ls.rates.Upload, ls.rates.Peers
+			ts.LastEvent = ls.lastEvent
+		}
+		liveMu.Unlock()
+		status.Torrents = append(status.Torrents, ts)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Settings are the session-wide rate limits, in KiB/s.
+type Settings struct {
+	Down, Up       int64
+	AltEnabled     bool
+	AltDown, AltUp int64
+	AltFrom, AltTo string
+}
+
+// handleSettings returns the rate limits on GET and changes them on POST.
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if err := applySettings(r); err != nil {
+			message = "Invalid Settings: " + err.Error()
+		} else {
+			message = "Settings saved"
+		}
+		http.Redirect(w, r, "/", 303)
+		return
+	}
+
+	rates, sched := session.RateLimits()
+	settings := Settings{
+		Down:       rates.Download / 1024,
+		Up:         rates.Upload / 1024,
+		AltEnabled: sched.Enabled,
+		AltDown:    sched.Alt.Download / 1024,
+		AltUp:      sched.Alt.Upload / 1024,
+		AltFrom:    ratelimit.FormatClock(sched.From),
+		AltTo:      ratelimit.FormatClock(sched.To),
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(currentStatus)
+	json.NewEncoder(w).Encode(settings)
+}
+
+func applySettings(r *http.Request) error {
+	kib := func(name string) (int64, error) {
+		v := r.FormValue(name)
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s must be a positive number", name)
+		}
+		return n * 1024, nil
+	}
+
+	var rates, alt ratelimit.Rates
+	var err error
+	if rates.Download, err = kib("down"); err != nil {
+		return err
+	}
+	if rates.Upload, err = kib("up"); err != nil {
+		return err
+	}
+	if alt.Download, err = kib("alt_down"); err != nil {
+		return err
+	}
+	if alt.Upload, err = kib("alt_up"); err != nil {
+		return err
+	}
+
+	sched := ratelimit.Schedule{Enabled: r.FormValue("alt_enabled") != "", Alt: alt}
+	if sched.Enabled {
+		if sched.From, err = ratelimit.ParseClock(r.FormValue("alt_from")); err != nil {
+			return err
+		}
+		if sched.To, err = ratelimit.ParseClock(r.FormValue("alt_to")); err != nil {
+			return err
+		}
+	}
+
+	session.SetRateLimits(rates)
+	session.SetRateSchedule(sched)
+	return nil
 }
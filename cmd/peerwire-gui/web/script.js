@@ -96,28 +96,122 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    // Speed limit settings
+    const settingsForm = document.getElementById('settingsForm');
+    fetch('/settings')
+        .then(r => r.json())
+        .then(s => {
+            const set = (name, v) => { settingsForm.elements[name].value = v ? v : ''; };
+            set('down', s.Down);
+            set('up', s.Up);
+            set('alt_down', s.AltDown);
+            set('alt_up', s.AltUp);
+            set('alt_from', s.AltFrom);
+            set('alt_to', s.AltTo);
+            settingsForm.elements['alt_enabled'].checked = s.AltEnabled;
+        })
+        .catch(err => console.error("Settings Error:", err));
+
+    // Per-torrent controls (buttons are re-rendered, so delegate)
+    const torrentList = document.getElementById('torrentList');
+    torrentList.addEventListener('click', (e) => {
+        const btn = e.target.closest('button[data-action]');
+        if (!btn) return;
+        fetch(`/${btn.dataset.action}?hash=${btn.dataset.hash}`, { method: 'POST' })
+            .catch(err => console.error("Control Error:", err));
+    });
+
+    // File checkboxes: unchecked files are skipped
+    torrentList.addEventListener('change', (e) => {
+        const box = e.target.closest('input[data-file]');
+        if (!box) return;
+        const priority = box.checked ? 'normal' : 'skip';
+        fetch(`/files?hash=${box.dataset.hash}&file=${box.dataset.file}&priority=${priority}`, { method: 'POST' })
+            .catch(err => console.error("Files Error:", err));
+    });
+
+    function formatSize(bytes) {
+        if (bytes >= 1024 * 1024 * 1024) return `${(bytes / 1024 / 1024 / 1024).toFixed(1)} GiB`;
+        if (bytes >= 1024 * 1024) return `${(bytes / 1024 / 1024).toFixed(1)} MiB`;
+        return `${(bytes / 1024).toFixed(1)} KiB`;
+    }
+
+    function renderFiles(t) {
+        const list = document.createElement('div');
+        list.className = 'torrent-files';
+        t.Files.forEach((f, i) => {
+            const row = document.createElement('label');
+            row.className = 'torrent-file';
+            row.innerHTML = `
+                <input type="checkbox" data-hash="${t.Hash}" data-file="${i}" ${f.Wanted ? 'checked' : ''}>
+                <span class="file-name"></span>
+                <span class="file-size">${formatSize(f.Length)}</span>`;
+            row.querySelector('.file-name').innerText = f.Path;
+            list.appendChild(row);
+        });
+        return list;
+    }
+
+    function formatRate(bytes) {
+        if (bytes >= 1024 * 1024) return `${(bytes / 1024 / 1024).toFixed(1)} MiB/s`;
+        return `${(bytes / 1024).toFixed(1)} KiB/s`;
+    }
+
+    function renderTorrent(t) {
+        const item = document.createElement('div');
+        item.className = 'status-card glass-inner torrent-item';
+
+        const paused = t.State === 'paused' || t.State === 'error';
+        const toggle = paused ? 'resume' : 'pause';
+        const toggleLabel = paused ? 'Resume' : 'Pause';
+
+        item.innerHTML = `
+            <div class="status-header">
+                <span class="status-message"></span>
+                <span class="percentage">${Math.floor(t.Percent)}%</span>
+            </div>
+            <div class="progress-track">
+                <div class="progress-bar" style="width: ${t.Percent}%"></div>
+            </div>
+            <div class="torrent-rates">
+                <span>↓ ${formatRate(t.DownRate)}</span>
+                <span>↑ ${formatRate(t.UpRate)}</span>
+                <span>${t.Peers} peers</span>
+            </div>
+            <div class="torrent-event"></div>
+            <div class="torrent-footer">
+                <span class="torrent-state state-${t.State}"></span>
+                <div class="controls">
+                    <button type="button" class="btn-secondary" data-action="${toggle}" data-hash="${t.Hash}">${toggleLabel}</button>
+                    <button type="button" class="btn-secondary" data-action="recheck" data-hash="${t.Hash}">Recheck</button>
+                    <button type="button" class="btn-secondary" data-action="remove" data-hash="${t.Hash}">Remove</button>
+                    <a class="btn-secondary" href="/stream?hash=${t.Hash}" target="_blank" rel="noopener">Open</a>
+                </div>
+            </div>`;
+        // Names and errors come from the torrent file: never treat them as HTML.
+        item.querySelector('.status-message').innerText = t.Name;
+        item.querySelector('.torrent-state').innerText = t.Error ? `${t.State}: ${t.Error}` : t.State;
+        item.querySelector('.torrent-event').innerText = t.LastEvent || '';
+        if (t.Percent >= 100) {
+            item.querySelector('.progress-bar').style.background = 'var(--success-color)';
+        }
+        if (t.Files.length > 1) {
+            item.querySelector('.torrent-event').after(renderFiles(t));
+        }
+        return item;
+    }
+
     // Poll Status
     setInterval(() => {
         fetch('/status')
             .then(r => r.json())
             .then(data => {
-                const msgEl = document.getElementById('msg');
-                const percentEl = document.getElementById('percent');
-                const barEl = document.getElementById('bar');
                 const statusBadge = document.getElementById('connectionStatus');
+                statusBadge.innerText = 'Connected';
+                statusBadge.style.color = 'var(--success-color)';
 
-                msgEl.innerText = data.Message;
-                percentEl.innerText = Math.round(data.Percent) + '%';
-                barEl.style.width = data.Percent + '%';
-
-                if (data.Percent >= 100) {
-                    barEl.style.background = 'var(--success-color)';
-                    statusBadge.style.color = 'var(--success-color)';
-                    statusBadge.innerText = 'Completed';
-                } else if (data.Running) {
-                    statusBadge.style.color = 'var(--accent-color)';
-                    statusBadge.innerText = 'Downloading';
-                }
+                document.getElementById('msg').innerText = data.Message;
+                torrentList.replaceChildren(...data.Torrents.map(renderTorrent));
             })
             .catch(err => {
                 console.error("Status Poll Error:", err);
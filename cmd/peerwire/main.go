@@ -1,55 +1,95 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/Minesto23/peerwire/internal/engine"
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/ratelimit"
+	"github.com/Minesto23/peerwire/internal/storage"
 	"github.com/Minesto23/peerwire/internal/torrent"
+	"github.com/Minesto23/peerwire/internal/tracker"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: peerwire download <file.torrent> [output_path]")
+		printUsage()
 		return
 	}
 
 	command := os.Args[1]
 
-	if command == "download" {
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: peerwire download <file.torrent> [output_path]")
+	if command == "download" || command == "recheck" {
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		flags.Usage = printUsage
+		limits := addLimitFlags(flags)
+		sequential := flags.Bool("sequential", false, "download pieces in order")
+		var only globList
+		flags.Var(&only, "only", "download only files matching `glob` (repeatable)")
+		allocate := flags.String("allocate", "sparse", "how to reserve disk space: sparse, full or zero")
+		partSuffix := flags.Bool("part", true, "keep incomplete files under a .part name")
+		incomplete := flags.String("incomplete", "", "download to `dir`, moving the data to output_path when complete")
+		syncMode := flags.String("sync", "periodic", "when to sync data to disk: periodic, on-piece, on-complete or never")
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() < 1 {
+			printUsage()
 			return
 		}
 
-		torrentPath := os.Args[2]
+		torrentPath := flags.Arg(0)
 		outputPath := "."
-		if len(os.Args) > 3 {
-			outputPath = os.Args[3]
+		if flags.NArg() > 1 {
+			outputPath = flags.Arg(1)
 		}
 
 		// 1. Parse Torrent
-		f, err := os.Open(torrentPath)
+		spec, targetFile, err := loadTorrent(torrentPath, outputPath)
 		if err != nil {
-			fmt.Printf("Error opening torrent file: %v\n", err)
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
-		defer f.Close()
 
-		spec, err := torrent.Parse(f)
+		allocation, err := storage.ParseAllocation(*allocate)
 		if err != nil {
-			fmt.Printf("Error parsing torrent: %v\n", err)
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
 
-		fmt.Printf("File: %s\nLength: %d bytes\n", spec.Info.Name, spec.Info.Length)
-
-		targetFile := filepath.Join(outputPath, spec.Info.Name)
+		durability, err := engine.ParseDurability(*syncMode)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
 
 		// 2. Start Engine
 		params := engine.ClientParams{
-			OutputPath: targetFile,
+			OutputPath:    targetFile,
+			IncompleteDir: *incomplete,
+			Sequential:    *sequential,
+			Storage:       storage.FileBackend{Allocation: allocation, PartSuffix: *partSuffix},
+			Durability:    durability,
+		}
+
+		if len(only) > 0 {
+			prios, err := only.priorities(spec.Info.FileList())
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			params.FilePriorities = prios
+		}
+
+		if err := limits.apply(&params); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
 		}
 
 		client, err := engine.NewClient(spec, params)
@@ -58,16 +98,277 @@ func main() {
 			return
 		}
 
-		if err := client.Download(func(done, total int) {
-			percent := float64(done) / float64(total) * 100
-			fmt.Printf("\rDownloaded: %0.2f%% (%d/%d pieces)", percent, done, total)
-		}); err != nil {
+		events, unsubscribe := client.Subscribe()
+		printed := make(chan struct{})
+		go func() {
+			defer close(printed)
+			printEvents(client, events)
+		}()
+		defer func() {
+			unsubscribe()
+			<-printed
+		}()
+
+		if command == "recheck" {
+			if err := client.Recheck(); err != nil {
+				fmt.Printf("Recheck error: %v\n", err)
+			}
+			return
+		}
+
+		// Ctrl+C stops the download cleanly: peers are disconnected, the
+		// file is flushed and the trackers are told we left.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		if err := client.Download(ctx); err != nil {
 			fmt.Printf("\nDownload error: %v\n", err)
 		} else {
 			fmt.Println("\nDownload Complete!")
+			client.Stop()
 		}
 
+	} else if command == "locate" {
+		locate(os.Args[2:])
 	} else {
 		fmt.Printf("Unknown command: %s\n", command)
 	}
 }
+
+// loadTorrent parses a .torrent file and returns it with the path its
+// data goes to in outputPath.
+func loadTorrent(torrentPath, outputPath string) (*torrent.TorrentSpec, string, error) {
+	f, err := os.Open(torrentPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("opening torrent file: %w", err)
+	}
+	defer f.Close()
+
+	spec, err := torrent.Parse(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing torrent: %w", err)
+	}
+
+	fmt.Printf("File: %s\nLength: %d bytes\n", spec.Info.Name, spec.Info.Length)
+	if spec.Info.IsMultiFile() {
+		fmt.Printf("Files: %d\n", len(spec.Info.Files))
+	}
+
+	// The name comes from the torrent: keep it from escaping outputPath.
+	name, err := storage.SanitizeName(spec.Info.Name)
+	if err != nil {
+		return nil, "", err
+	}
+	return spec, filepath.Join(outputPath, name), nil
+}
+
+// locate finds the files of a torrent in other directories and puts them
+// in place, so downloading it later only fetches what is missing.
+func locate(args []string) {
+	flags := flag.NewFlagSet("locate", flag.ExitOnError)
+	flags.Usage = printUsage
+	link := flags.String("link", "hard", "how to put found files in place: hard, reflink or copy")
+	flags.Parse(args)
+	if flags.NArg() < 3 {
+		printUsage()
+		return
+	}
+	mode, err := storage.ParseLinkMode(*link)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	spec, targetFile, err := loadTorrent(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	client, err := engine.NewClient(spec, engine.ClientParams{OutputPath: targetFile})
+	if err != nil {
+		fmt.Printf("Error creating client: %v\n", err)
+		return
+	}
+
+	events, unsubscribe := client.Subscribe()
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		printEvents(client, events)
+	}()
+	found, err := client.Locate(flags.Args()[2:], mode)
+	unsubscribe()
+	<-printed
+
+	files := spec.Info.FileList()
+	for _, lf := range found {
+		fmt.Printf("  %s <- %s (%s)\n", files[lf.Index].Path, lf.Source, lf.Mode)
+	}
+	if err != nil {
+		fmt.Printf("Locate error: %v\n", err)
+		return
+	}
+	done, total := client.Progress()
+	fmt.Printf("Found %d of %d files; %d of %d pieces complete\n", len(found), len(files), done, total)
+}
+
+// printEvents shows a client's events until the channel is closed: a
+// progress line that is rewritten in place, and a line of its own for
+// anything worth keeping on screen.
+func printEvents(client *engine.Client, events <-chan engine.Event) {
+	var peers int
+	var down, up float64
+	status := func() {
+		done, total := client.Progress()
+		percent := 100.0
+		if total > 0 {
+			percent = float64(done) / float64(total) * 100
+		}
+		fmt.Printf("\rDownloaded: %0.2f%% (%d/%d pieces)  %.1f KiB/s down, %.1f KiB/s up, %d peers   ",
+			percent, done, total, down/1024, up/1024, peers)
+	}
+	// line prints a message of its own without clobbering the status line.
+	line := func(format string, args ...interface{}) {
+		fmt.Printf("\r\033[K"+format+"\n", args...)
+		status()
+	}
+
+	for ev := range events {
+		switch ev := ev.(type) {
+		case engine.CheckProgress:
+			fmt.Printf("\rChecking: %d/%d pieces", ev.Checked, ev.Total)
+			if ev.Checked == ev.Total {
+				fmt.Println()
+			}
+		case engine.PieceVerified:
+			status()
+		case engine.Rates:
+			down, up, peers = ev.Download, ev.Upload, ev.Peers
+			status()
+		case engine.TrackerAnnounced:
+			switch {
+			case ev.Err != nil:
+				line("Tracker %s failed: %v", ev.URL, ev.Err)
+			case ev.Event != tracker.EventStopped:
+				line("Found %d peers from %s", ev.Peers, ev.URL)
+			}
+			if ev.Warning != "" {
+				line("Tracker warning: %s", ev.Warning)
+			}
+		case engine.HashFailed:
+			line("Piece %d from %s failed its hash check", ev.Index, ev.Peer)
+		case engine.PeerBanned:
+			line("Banned %s: %s", ev.IP, ev.Reason)
+		case engine.StorageError:
+			line("Storage error (%s): %v", ev.Op, ev.Err)
+		case engine.StorageMoved:
+			line("Moved data to %s", ev.Path)
+		}
+	}
+}
+
+func printUsage() {
+	fmt.Println("Usage: peerwire download [flags] <file.torrent> [output_path]")
+	fmt.Println("       peerwire recheck <file.torrent> [output_path]")
+	fmt.Println("       peerwire locate [-link hard|reflink|copy] <file.torrent> <output_path> <dir>...")
+	fmt.Println()
+	fmt.Println("  -sequential           download pieces in order, e.g. to preview media")
+	fmt.Println("  -only GLOB            download only the files whose path or name matches;")
+	fmt.Println("                        may be repeated")
+	fmt.Println("  -allocate MODE        reserve disk space as sparse files (default), in full")
+	fmt.Println("                        up front, or by writing zeros")
+	fmt.Println("  -part=false           write files under their own names from the start")
+	fmt.Println("                        instead of NAME.part until complete")
+	fmt.Println("  -incomplete DIR       download into DIR and move the data to output_path")
+	fmt.Println("                        once complete")
+	fmt.Println("  -sync WHEN            sync data to disk every minute (periodic, default),")
+	fmt.Println("                        after every piece (on-piece), once complete")
+	fmt.Println("                        (on-complete) or never, leaving it to the system")
+	fmt.Println()
+	fmt.Println("Rate limits are in KiB/s, 0 meaning unlimited:")
+	fmt.Println("  -down, -up            limits for the torrent")
+	fmt.Println("  -peer-down, -peer-up  limits for each peer connection")
+	fmt.Println("  -alt-down, -alt-up    alternative limits, used from -alt-from to -alt-to (HH:MM)")
+}
+
+// globList collects the patterns of repeated -only flags.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(glob string) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("bad pattern %q", glob)
+	}
+	*g = append(*g, glob)
+	return nil
+}
+
+// priorities skips the files no pattern matches, either the whole path or
+// just the file name, and lists the files kept.
+func (g globList) priorities(files []torrent.File) ([]piece.Priority, error) {
+	prios := make([]piece.Priority, len(files))
+	kept := 0
+	for i, f := range files {
+		prios[i] = piece.PrioritySkip
+		for _, glob := range g {
+			whole, _ := path.Match(glob, f.Path)
+			name, _ := path.Match(glob, path.Base(f.Path))
+			if whole || name {
+				prios[i] = piece.PriorityNormal
+				fmt.Printf("  %s (%d bytes)\n", f.Path, f.Length)
+				kept++
+				break
+			}
+		}
+	}
+	if kept == 0 {
+		return nil, fmt.Errorf("no file matches %s", g.String())
+	}
+	fmt.Printf("Downloading %d of %d files\n", kept, len(files))
+	return prios, nil
+}
+
+// limitFlags are the rate limit options of the download command.
+type limitFlags struct {
+	down, up, peerDown, peerUp, altDown, altUp int64
+	altFrom, altTo                             string
+}
+
+func addLimitFlags(flags *flag.FlagSet) *limitFlags {
+	l := &limitFlags{}
+	flags.Int64Var(&l.down, "down", 0, "download limit in KiB/s")
+	flags.Int64Var(&l.up, "up", 0, "upload limit in KiB/s")
+	flags.Int64Var(&l.peerDown, "peer-down", 0, "download limit per peer in KiB/s")
+	flags.Int64Var(&l.peerUp, "peer-up", 0, "upload limit per peer in KiB/s")
+	flags.Int64Var(&l.altDown, "alt-down", 0, "alternative download limit in KiB/s")
+	flags.Int64Var(&l.altUp, "alt-up", 0, "alternative upload limit in KiB/s")
+	flags.StringVar(&l.altFrom, "alt-from", "", "start of the alternative limits (HH:MM)")
+	flags.StringVar(&l.altTo, "alt-to", "", "end of the alternative limits (HH:MM)")
+	return l
+}
+
+// apply copies the limits into params.
+func (l *limitFlags) apply(params *engine.ClientParams) error {
+	params.RateLimits = ratelimit.Rates{Download: l.down * 1024, Upload: l.up * 1024}
+	params.PeerRateLimits = ratelimit.Rates{Download: l.peerDown * 1024, Upload: l.peerUp * 1024}
+
+	if l.altFrom == "" && l.altTo == "" {
+		return nil
+	}
+	from, err := ratelimit.ParseClock(l.altFrom)
+	if err != nil {
+		return err
+	}
+	to, err := ratelimit.ParseClock(l.altTo)
+	if err != nil {
+		return err
+	}
+	params.RateSchedule = ratelimit.Schedule{
+		Enabled: true,
+		Alt:     ratelimit.Rates{Download: l.altDown * 1024, Upload: l.altUp * 1024},
+		From:    from,
+		To:      to,
+	}
+	return nil
+}
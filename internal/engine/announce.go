@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/tracker"
+)
+
+const (
+	// Used when a tracker doesn't tell us how often to come back.
+	defaultAnnounceInterval = 30 * time.Minute
+	// Never announce more often than this, whatever the tracker says.
+	minAnnounceInterval = time.Minute
+	// How many peers we ask for per announce.
+	announceNumWant = 50
+)
+
+func (c *Client) trackerClient() *tracker.Client {
+	if c.Params.Tracker != nil {
+		return c.Params.Tracker
+	}
+	return tracker.DefaultClient
+}
+
+// trackerURLs lists every tracker to try, main announce first.
+func (c *Client) trackerURLs() []string {
+	// Start with main announce, then flatten announce-list
+	trackers := []string{c.Spec.Announce}
+	for _, tier := range c.Spec.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+
+	// Remove duplicates
+	uniqueTrackers := make([]string, 0, len(trackers))
+	seen := make(map[string]bool)
+	for _, tr := range trackers {
+		if tr != "" && !seen[tr] {
+			uniqueTrackers = append(uniqueTrackers, tr)
+			seen[tr] = true
+		}
+	}
+	return uniqueTrackers
+}
+
+func (c *Client) announceRequest(event tracker.Event) tracker.AnnounceRequest {
+	numWant := announceNumWant
+	if event == tracker.EventStopped {
+		numWant = 0
+	}
+	return tracker.AnnounceRequest{
+		InfoHash:   c.InfoHash,
+		PeerID:     c.PeerID,
+		Port:       c.port,
+		Uploaded:   c.uploaded.Load(),
+		Downloaded: c.downloaded.Load(),
+		Left:       c.bytesLeft(),
+		Event:      event,
+		NumWant:    numWant,
+	}
+}
+
+// announce contacts the trackers in order until one returns peers.
+// It returns the peers and when to announce again.
+func (c *Client) announce(event tracker.Event) ([]tracker.Peer, time.Duration) {
+	trackers := c.trackerURLs()
+	interval := defaultAnnounceInterval
+
+	for _, tr := range trackers {
+		resp, err := c.trackerClient().Announce(tr, c.announceRequest(event))
+		if err != nil {
+			c.events.publish(TrackerAnnounced{URL: tr, Event: event, Err: err})
+			continue
+		}
+		c.events.publish(TrackerAnnounced{
+			URL:     tr,
+			Event:   event,
+			Peers:   len(resp.Peers),
+			Warning: resp.Warning,
+		})
+
+		c.mu.Lock()
+		c.announcedTo[tr] = true
+		c.mu.Unlock()
+
+		if resp.Interval > 0 {
+			interval = resp.Interval
+		}
+		if resp.MinInterval > interval {
+			interval = resp.MinInterval
+		}
+
+		if len(resp.Peers) > 0 {
+			return resp.Peers, interval // Found peers!
+		}
+	}
+
+	return nil, interval
+}
+
+// announceLoop re-announces every interval, and once on completion,
+// dialing any new peers the trackers return.
+func (c *Client) announceLoop(ctx context.Context, interval time.Duration) {
+	done := c.Done()
+	if c.isComplete() {
+		done = nil // Nothing to complete; we started as a seed
+	}
+	for {
+		if interval < minAnnounceInterval {
+			interval = minAnnounceInterval
+		}
+		timer := time.NewTimer(interval)
+
+		event := tracker.EventNone
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-done:
+			timer.Stop()
+			done = nil // Only once
+			event = tracker.EventCompleted
+		case <-timer.C:
+		}
+
+		var peers []tracker.Peer
+		peers, interval = c.announce(event)
+		c.addPeers(peers)
+	}
+}
+
+// announceStopped tells every tracker that accepted an announce that we
+// are leaving the swarm.
+func (c *Client) announceStopped() {
+	c.mu.Lock()
+	trackers := make([]string, 0, len(c.announcedTo))
+	for tr := range c.announcedTo {
+		trackers = append(trackers, tr)
+	}
+	c.announcedTo = make(map[string]bool)
+	c.mu.Unlock()
+
+	req := c.announceRequest(tracker.EventStopped)
+	for _, tr := range trackers {
+		_, err := c.trackerClient().Announce(tr, req)
+		c.events.publish(TrackerAnnounced{URL: tr, Event: tracker.EventStopped, Err: err})
+	}
+}
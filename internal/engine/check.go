@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/Minesto23/peerwire/internal/tracker"
+)
+
+// checkResult is the verdict on one piece of existing data.
+type checkResult struct {
+	index int
+	ok    bool
+	err   error
+}
+
+// checkPieces hashes every piece on disk, one worker per CPU, and updates
+// what we have: matching pieces are marked done, the others forgotten.
+// Progress is published as CheckProgress events.
+func (c *Client) checkPieces() error {
+	total := c.numPieces()
+	workers := runtime.GOMAXPROCS(0)
+	if workers > total {
+		workers = total
+	}
+
+	indexes := make(chan int)
+	results := make(chan checkResult)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		defer close(indexes)
+		for i := 0; i < total; i++ {
+			select {
+			case indexes <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				work := c.newWork(i)
+				buf := make([]byte, work.Length)
+				_, err := c.store.ReadAt(buf, int64(i)*c.Spec.Info.PieceLength)
+				res := checkResult{index: i, err: err}
+				if err == nil {
+					res.ok = checkIntegrity(work, buf)
+				}
+				select {
+				case results <- res:
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	checked := 0
+	c.reportCheck(checked, total)
+	for res := range results {
+		if res.err != nil {
+			return fmt.Errorf("checking piece %d: %w", res.index, res.err)
+		}
+		if res.ok {
+			c.markHave(res.index)
+		} else {
+			c.clearHave(res.index)
+		}
+		checked++
+		c.reportCheck(checked, total)
+	}
+	return nil
+}
+
+func (c *Client) reportCheck(checked, total int) {
+	c.events.publish(CheckProgress{Checked: checked, Total: total})
+}
+
+// Recheck verifies all data on disk again and forgets pieces that no
+// longer match. A running torrent is disconnected while checking and
+// reconnects afterwards.
+func (c *Client) Recheck() error {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+
+	switch c.state {
+	case StateStopped:
+		return c.checkStopped()
+
+	case StateRunning:
+		c.stopNetwork()
+		defer c.startNetwork(tracker.EventNone)
+	}
+	// Check what is on disk, not what is on its way there or cached.
+	c.disk.drain()
+	defer c.disk.clearCache()
+
+	if err := c.checkPieces(); err != nil {
+		return err
+	}
+	return c.saveResume()
+}
+
+// checkStopped checks the data of a stopped torrent, opening storage for
+// the time being, and saves what it found as resume data. c.lifeMu must
+// be held.
+func (c *Client) checkStopped() error {
+	store, err := c.openStorage()
+	if err != nil {
+		return err
+	}
+	c.store = store
+	err = c.checkPieces()
+	if err == nil {
+		err = c.markStoredComplete()
+	}
+	if serr := c.saveResume(); err == nil {
+		err = serr
+	}
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"os"
+	"testing"
+)
+
+func corruptByte(t *testing.T, path string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, off)
+	b[0] = ^b[0]
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+}
+
+func TestRecheckFindsCorruption(t *testing.T) {
+	data := testData(9*blockSize + 10)
+	spec := newTestSpec(data, blockSize)
+	c, _ := newSeeder(t, spec, data)
+
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	corruptByte(t, c.Params.OutputPath, 3*blockSize+5)
+	if err := c.Recheck(); err != nil {
+		t.Fatalf("Recheck() error = %v", err)
+	}
+
+	waitEvent(t, events, func(ev Event) bool {
+		p, ok := ev.(CheckProgress)
+		return ok && p.Checked == c.numPieces() && p.Total == c.numPieces()
+	})
+	for i := 0; i < c.numPieces(); i++ {
+		if c.hasPiece(i) != (i != 3) {
+			t.Errorf("hasPiece(%d) = %v after recheck", i, c.hasPiece(i))
+		}
+	}
+	select {
+	case <-c.Done():
+		t.Error("Done() still closed with a piece missing")
+	default:
+	}
+
+	// Recheck works on a stopped torrent too, and remembers the result.
+	c.Stop()
+	corruptByte(t, c.Params.OutputPath, 3*blockSize+5) // Repair
+	if err := c.Recheck(); err != nil {
+		t.Fatalf("Recheck() error = %v", err)
+	}
+	if !c.isComplete() {
+		t.Error("repaired data is not complete after recheck")
+	}
+	if rd := c.loadResume(); rd == nil || !c.isSeed(rd.Have) {
+		t.Error("recheck did not record its result in the resume data")
+	}
+}
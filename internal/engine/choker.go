@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// chokeInterval is how often the unchoke set is re-evaluated.
+	chokeInterval = 10 * time.Second
+	// optimisticRounds is how many choke rounds an optimistic unchoke lasts (30s).
+	optimisticRounds = 3
+)
+
+// chokeCandidate is a connection as seen by one choke round.
+type chokeCandidate struct {
+	pc         *peerConn
+	rate       int64 // bytes per second over the last round
+	interested bool
+}
+
+// choker implements tit-for-tat: the fastest interested peers get the
+// regular upload slots, plus one rotating optimistic unchoke so new
+// peers get a chance to prove themselves.
+type choker struct {
+	c     *Client
+	rng   *rand.Rand
+	round int
+
+	optimistic *peerConn
+	// Totals at the previous round, to turn counters into rates.
+	lastDown map[*peerConn]int64
+	lastUp   map[*peerConn]int64
+}
+
+func newChoker(c *Client) *choker {
+	return &choker{
+		c:        c,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		lastDown: make(map[*peerConn]int64),
+		lastUp:   make(map[*peerConn]int64),
+	}
+}
+
+func (ch *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ch.rechoke()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rechoke runs one choke round.
+func (ch *choker) rechoke() {
+	// While leeching we reward peers that upload to us; once we are a seed
+	// there is nothing to get back, so favour peers we can upload to fastest.
+	seeding := ch.c.isComplete()
+	conns := ch.c.connList()
+
+	lastDown := make(map[*peerConn]int64, len(conns))
+	lastUp := make(map[*peerConn]int64, len(conns))
+	cands := make([]chokeCandidate, 0, len(conns))
+	optimisticAlive := false
+	for _, pc := range conns {
+		down, up := pc.downloaded.Load(), pc.uploaded.Load()
+		lastDown[pc], lastUp[pc] = down, up
+
+		rate := down - ch.lastDown[pc]
+		if seeding {
+			rate = up - ch.lastUp[pc]
+		}
+
+		pc.mu.Lock()
+		interested := pc.peerInterested
+		pc.mu.Unlock()
+
+		cands = append(cands, chokeCandidate{
+			pc:         pc,
+			rate:       rate / int64(chokeInterval/time.Second),
+			interested: interested,
+		})
+		if pc == ch.optimistic {
+			optimisticAlive = true
+		}
+	}
+	ch.lastDown, ch.lastUp = lastDown, lastUp
+
+	if !optimisticAlive || ch.round%optimisticRounds == 0 {
+		ch.optimistic = pickOptimistic(cands, ch.c.Params.UploadSlots, ch.rng)
+	}
+	ch.round++
+
+	unchoke := selectUnchoked(cands, ch.c.Params.UploadSlots, ch.optimistic)
+	for _, cand := range cands {
+		cand.pc.mu.Lock()
+		cand.pc.optimistic = cand.pc == ch.optimistic
+		cand.pc.mu.Unlock()
+
+		var err error
+		if unchoke[cand.pc] {
+			err = cand.pc.unchoke()
+		} else {
+			err = cand.pc.choke()
+		}
+		if err != nil {
+			cand.pc.close()
+		}
+	}
+}
+
+// rankInterested returns the interested candidates, fastest first.
+func rankInterested(cands []chokeCandidate) []chokeCandidate {
+	ranked := make([]chokeCandidate, 0, len(cands))
+	for _, cand := range cands {
+		if cand.interested {
+			ranked = append(ranked, cand)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].rate > ranked[j].rate
+	})
+	return ranked
+}
+
+// selectUnchoked returns the peers to unchoke: the slots-1 fastest
+// interested peers plus the optimistic unchoke, if any. The optimistic
+// peer may have become one of the fastest since it was picked; it then
+// doesn't take a regular slot too, and the next fastest gets it.
+func selectUnchoked(cands []chokeCandidate, slots int, optimistic *peerConn) map[*peerConn]bool {
+	unchoke := make(map[*peerConn]bool)
+	regular := slots - 1
+	if optimistic == nil {
+		regular = slots
+	}
+	for _, cand := range rankInterested(cands) {
+		if regular == 0 {
+			break
+		}
+		if cand.pc == optimistic {
+			continue
+		}
+		unchoke[cand.pc] = true
+		regular--
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+	return unchoke
+}
+
+// pickOptimistic chooses a random interested peer that would not get a
+// regular slot anyway. It returns nil if there is none.
+func pickOptimistic(cands []chokeCandidate, slots int, rng *rand.Rand) *peerConn {
+	ranked := rankInterested(cands)
+	if len(ranked) < slots {
+		return nil // Everyone interested fits in a regular slot
+	}
+	rest := ranked[slots-1:]
+	return rest[rng.Intn(len(rest))].pc
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSelectUnchoked(t *testing.T) {
+	fast, medium, slow, idle := &peerConn{}, &peerConn{}, &peerConn{}, &peerConn{}
+	bored := &peerConn{}
+
+	cands := []chokeCandidate{
+		{pc: slow, rate: 10, interested: true},
+		{pc: bored, rate: 1000, interested: false},
+		{pc: fast, rate: 500, interested: true},
+		{pc: idle, rate: 0, interested: true},
+		{pc: medium, rate: 100, interested: true},
+	}
+
+	// Three slots: two regular plus the optimistic one.
+	got := selectUnchoked(cands, 3, idle)
+	for _, pc := range []*peerConn{fast, medium, idle} {
+		if !got[pc] {
+			t.Errorf("expected peer with rate %d to be unchoked", rateOf(cands, pc))
+		}
+	}
+	if got[slow] {
+		t.Error("slow peer should stay choked")
+	}
+	if got[bored] {
+		t.Error("uninterested peer should stay choked")
+	}
+
+	// Without an optimistic unchoke every slot is a regular one.
+	got = selectUnchoked(cands, 3, nil)
+	if !got[slow] || got[idle] {
+		t.Error("expected the three fastest interested peers")
+	}
+
+	// An optimistic peer that turned out fast leaves its regular slot to
+	// the next one.
+	got = selectUnchoked(cands, 3, fast)
+	if len(got) != 3 || !got[fast] || !got[medium] || !got[slow] {
+		t.Errorf("unchoked %d peers, want the optimistic one and the two fastest others", len(got))
+	}
+}
+
+func TestPickOptimistic(t *testing.T) {
+	fast, slow := &peerConn{}, &peerConn{}
+	cands := []chokeCandidate{
+		{pc: fast, rate: 500, interested: true},
+		{pc: slow, rate: 1, interested: true},
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	// Both fit in the regular slots, so no optimistic unchoke is needed.
+	if pc := pickOptimistic(cands, 4, rng); pc != nil {
+		t.Error("expected no optimistic unchoke")
+	}
+
+	// With two slots the fast peer gets the regular one.
+	for i := 0; i < 10; i++ {
+		if pc := pickOptimistic(cands, 2, rng); pc != slow {
+			t.Fatal("optimistic unchoke must not be a peer with a regular slot")
+		}
+	}
+}
+
+func rateOf(cands []chokeCandidate, pc *peerConn) int64 {
+	for _, c := range cands {
+		if c.pc == pc {
+			return c.rate
+		}
+	}
+	return -1
+}
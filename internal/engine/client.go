@@ -1,11 +1,16 @@
 package engine
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/ratelimit"
 	"github.com/Minesto23/peerwire/internal/storage"
 	"github.com/Minesto23/peerwire/internal/torrent"
 	"github.com/Minesto23/peerwire/internal/tracker"
@@ -18,147 +23,887 @@ type Client struct {
 	InfoHash [20]byte
 
 	Params ClientParams
+
+	store    storage.Torrent
+	disk     *diskIO // while started; set under mu, see diskIO
+	picker   *piece.Picker
+	listener *Listener // while the network runs; set under mu
+	port     int
+
+	events eventBus
+
+	// Rate limiting: this torrent's limits and, within a Session, the
+	// session's. Each connection adds its own per-peer limiters.
+	limits       *rateLimits
+	sessionLimit *rateLimits
+
+	// Banned peers, shared with the other torrents of a Session.
+	bans *banList
+	// The disk I/O pool of the Session, if any; see newDiskIO.
+	sharedDisk *diskPool
+
+	// Lifecycle. lifeMu serializes Start/Stop/Pause/Resume.
+	lifeMu  sync.Mutex
+	state   ClientState
+	stopped chan struct{}  // closed by Stop
+	wg      sync.WaitGroup // network goroutines and connections
+
+	// Payload totals reported to trackers.
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// Totals of previous runs, from the resume file.
+	baseDownloaded atomic.Int64
+	baseUploaded   atomic.Int64
+	// Sampled by publishRates for Stats and the Rates event.
+	downMeter, upMeter rateMeter
+	// Bytes received in vain; see Stats.
+	wasted       atomic.Int64
+	hashFailed   atomic.Int64
+	hashFailures atomic.Int64
+
+	resumeMu       sync.Mutex // serializes saveResume
+	lastResumeSave time.Time  // guarded by mu
+
+	files []torrent.File
+	paths []string // of the files in the torrent's directory, sanitized
+
+	mu   sync.Mutex
+	path string         // where the data is stored; see StoragePath
+	have piece.Bitfield // verified pieces
+	// synced holds the verified pieces known to be on stable storage;
+	// only those go in resume data. See Durability.
+	synced piece.Bitfield
+	// filePrio is the priority of each file; wanted holds the pieces of
+	// the files that aren't skipped. See applyPriorities.
+	filePrio []piece.Priority
+	wanted   piece.Bitfield
+	// done is closed when all wanted pieces are verified, and replaced if
+	// a recheck finds some of them corrupt after all, or more are wanted.
+	// undone is closed when that happens; see completion.
+	done     chan struct{}
+	undone   chan struct{}
+	conns    map[*peerConn]struct{}
+	partials map[int]*partialPiece // pieces being downloaded
+	// failedPieces holds, per piece, the failed attempts smart ban has yet
+	// to settle.
+	failedPieces map[int][][]blockRecord
+
+	// Network lifetime, guarded by mu. netCtx is nil while stopped or paused.
+	netCtx      context.Context
+	netCancel   context.CancelFunc
+	knownPeers  map[string]bool
+	announcedTo map[string]bool
+	resumePeers []tracker.Peer // peers of the previous run
+	peerRates   ratelimit.Rates
+}
+
+// ClientState is whether a client is running.
+type ClientState int
+
+const (
+	StateStopped ClientState = iota
+	StateRunning
+	StatePaused
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	}
+	return fmt.Sprintf("ClientState(%d)", int(s))
 }
 
 type ClientParams struct {
+	// OutputPath is the file of a single-file torrent, or the directory
+	// of a multi-file one. Resume data is kept next to it; without an
+	// OutputPath, only possible with a Storage that needs none, there is
+	// no resume data.
 	OutputPath string
+	// IncompleteDir, if set, is where the torrent is downloaded to: it is
+	// stored under the name of OutputPath in IncompleteDir, and moved to
+	// OutputPath once complete. Data found at OutputPath stays there.
+	// The Storage must be a storage.Mover.
+	IncompleteDir string
+	// Storage keeps the torrent's data. Nil means a storage.FileBackend,
+	// writing to OutputPath.
+	Storage storage.Backend
+
+	// Tracker is used for announces. Nil means tracker.DefaultClient.
+	Tracker *tracker.Client
+
+	// Listener accepts incoming connections for this torrent. When nil the
+	// client opens its own listener on Port (default 6881).
+	Listener *Listener
+	Port     int
+	// MaxConns caps this torrent's connections, inbound and outbound.
+	// 0 means 50.
+	MaxConns int
+	// UploadSlots is how many peers we unchoke at once, including the
+	// optimistic unchoke. 0 means 4.
+	UploadSlots int
+
+	// RateLimits caps this torrent's payload and protocol traffic in bytes
+	// per second, 0 meaning unlimited. RateSchedule optionally switches to
+	// other limits by time of day. PeerRateLimits caps each connection.
+	RateLimits     ratelimit.Rates
+	RateSchedule   ratelimit.Schedule
+	PeerRateLimits ratelimit.Rates
+
+	// Sequential downloads pieces in order instead of rarest first, for
+	// previewing media while it downloads. Readahead is how far past the
+	// read cursor (see SetReadCursor) pieces are fetched in order; 0
+	// means 8 MiB.
+	Sequential bool
+	Readahead  int64
+
+	// DiskWorkers is how many storage reads and writes run at once; 0
+	// means 4. Verified pieces wait for them in a queue of up to
+	// WriteQueue bytes, 0 meaning 32 MiB; while it is full no more blocks
+	// are requested. ReadCache caps the memory used to keep whole pieces
+	// for uploads; 0 means 16 MiB, and a negative value disables it.
+	// Within a Session, the session's settings apply instead.
+	DiskWorkers int
+	WriteQueue  int64
+	ReadCache   int64
+
+	// Durability is when storage is synced; resume data only records
+	// pieces that were. SyncInterval is how often DurabilityPeriodic
+	// syncs, and how often resume data is saved while pieces arrive; 0
+	// means a minute.
+	Durability   Durability
+	SyncInterval time.Duration
+
+	// FilePriorities holds the priority of each file of
+	// Spec.Info.FileList(), in order; nil means all normal. Skipped files
+	// are not downloaded, and not even created unless they share a piece
+	// with a wanted file; see SetFilePriority.
+	FilePriorities []piece.Priority
 }
 
-func NewClient(spec *torrent.TorrentSpec, params ClientParams) (*Client, error) {
+// newPeerID returns a random Azureus-style peer ID.
+func newPeerID() ([20]byte, error) {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	if err != nil {
-		return nil, err
+		return peerID, err
 	}
 	// Prefix strict azureus style or just random? Random is fine for now,
 	// but typically -PC0001- prefix.
 	copy(peerID[0:8], "-PW0001-")
+	return peerID, nil
+}
 
-	return &Client{
+func NewClient(spec *torrent.TorrentSpec, params ClientParams) (*Client, error) {
+	peerID, err := newPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Port == 0 {
+		params.Port = 6881
+	}
+	if params.MaxConns == 0 {
+		params.MaxConns = 50
+	}
+	if params.UploadSlots <= 0 {
+		params.UploadSlots = 4
+	}
+	if params.Readahead <= 0 {
+		params.Readahead = defaultReadahead
+	}
+	if params.Storage == nil {
+		params.Storage = storage.FileBackend{}
+	}
+	if params.DiskWorkers <= 0 {
+		params.DiskWorkers = defaultDiskWorkers
+	}
+	if params.WriteQueue <= 0 {
+		params.WriteQueue = defaultWriteQueue
+	}
+	if params.ReadCache == 0 {
+		params.ReadCache = defaultReadCache
+	}
+	if params.SyncInterval <= 0 {
+		params.SyncInterval = defaultSyncInterval
+	}
+
+	// Parse validates too, but a spec can be put together by hand.
+	if err := spec.Info.Validate(); err != nil {
+		return nil, err
+	}
+	files := spec.Info.FileList()
+	var paths []string
+	if spec.Info.IsMultiFile() {
+		elems := make([][]string, len(spec.Info.Files))
+		for i, f := range spec.Info.Files {
+			elems[i] = f.Path
+		}
+		if paths, err = storage.SanitizePaths(elems); err != nil {
+			return nil, err
+		}
+	}
+	filePrio := make([]piece.Priority, len(files))
+	if params.FilePriorities != nil {
+		if len(params.FilePriorities) != len(files) {
+			return nil, fmt.Errorf("engine: %d file priorities for %d files", len(params.FilePriorities), len(files))
+		}
+		copy(filePrio, params.FilePriorities)
+	}
+
+	picker := piece.NewPicker(spec.Info.NumPieces())
+	picker.SetSequential(params.Sequential)
+
+	c := &Client{
 		Spec:     spec,
 		PeerID:   peerID,
 		InfoHash: spec.InfoHash,
 		Params:   params,
-	}, nil
+		port:     params.Port,
+		picker:   picker,
+		files:    files,
+		paths:    paths,
+		filePrio: filePrio,
+		have:     make(piece.Bitfield, (spec.Info.NumPieces()+7)/8),
+		synced:   make(piece.Bitfield, (spec.Info.NumPieces()+7)/8),
+		conns:    make(map[*peerConn]struct{}),
+		partials: make(map[int]*partialPiece),
+		bans:     newBanList(),
+		done:     make(chan struct{}),
+		limits:   newRateLimits(params.RateLimits, params.RateSchedule),
+
+		failedPieces: make(map[int][][]blockRecord),
+		announcedTo:  make(map[string]bool),
+		peerRates:    params.PeerRateLimits,
+	}
+	c.path = params.OutputPath
+	if params.IncompleteDir != "" && !c.hasStoredData() {
+		c.path = c.incompletePath()
+	}
+	c.applyPriorities()
+	return c, nil
 }
 
-// Download starts the download process.
-func (c *Client) Download(progressCb func(int, int)) error {
-	// 1. Setup Storage
-	store, err := storage.NewStorage(c.Params.OutputPath, c.Spec.Info.Length)
-	if err != nil {
+// Default for ClientParams.Readahead.
+const defaultReadahead = 8 << 20
+
+var (
+	// ErrStopped is returned by Download when Stop is called before the
+	// download completes.
+	ErrStopped = errors.New("client stopped")
+	// ErrNoPeers is returned by Start when no tracker knows any peer and
+	// there is still something to download.
+	ErrNoPeers = errors.New("failed to find peers from any tracker")
+)
+
+// Download starts the client and blocks until every wanted piece is downloaded or
+// ctx is cancelled. On completion the client keeps seeding until Stop is
+// called; on cancellation it is stopped before returning ctx.Err().
+// Use Subscribe to follow progress.
+func (c *Client) Download(ctx context.Context) error {
+	if err := c.Start(); err != nil {
 		return err
 	}
-	defer store.Close()
+	c.lifeMu.Lock()
+	stopped := c.stopped
+	c.lifeMu.Unlock()
+
+	select {
+	case <-c.Done():
+		return nil
+	case <-stopped:
+		return ErrStopped
+	case <-ctx.Done():
+		c.Stop()
+		return ctx.Err()
+	}
+}
+
+// Start opens storage, contacts the trackers and starts connecting to peers.
+// It returns once the torrent is running; use Done to wait for completion.
+func (c *Client) Start() error {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if c.state != StateStopped {
+		return errors.New("client already started")
+	}
 
-	// 2. Get Peers from Tracker
-	var peers []tracker.Peer
+	// 1. Setup Storage, picking up what a previous run left on disk. The
+	// resume data has to be checked before opening storage touches the file.
+	stored := c.hasStoredData()
+	resume := c.loadResume()
 
-	// Build list of all tracker URLs to try
-	// Start with main announce, then flatten announce-list
-	trackers := []string{c.Spec.Announce}
-	for _, tier := range c.Spec.AnnounceList {
-		trackers = append(trackers, tier...)
+	store, err := c.openStorage()
+	if err != nil {
+		return err
 	}
+	c.store = store
 
-	// Remove duplicates (simple O(N^2) fine for small N)
-	uniqueTrackers := make([]string, 0, len(trackers))
-	seen := make(map[string]bool)
-	for _, tr := range trackers {
-		if !seen[tr] {
-			uniqueTrackers = append(uniqueTrackers, tr)
-			seen[tr] = true
+	switch {
+	case resume != nil:
+		c.restoreResume(resume)
+	case stored:
+		// Data without (usable) resume data: find out what it's worth.
+		if err := c.checkPieces(); err != nil {
+			store.Close()
+			return err
 		}
 	}
+	if err := c.markStoredComplete(); err != nil {
+		store.Close()
+		return err
+	}
 
-	fmt.Printf("Attempting to connect to %d trackers...\n", len(uniqueTrackers))
+	// 2. Writers for the pieces the peers finish
+	c.stopped = make(chan struct{})
+	c.mu.Lock()
+	c.disk = newDiskIO(c, store)
+	c.lastResumeSave = time.Now()
+	c.mu.Unlock()
 
-	for _, tr := range uniqueTrackers {
-		fmt.Printf("Contacting tracker: %s\n", tr)
-		foundPeers, err := tracker.RequestPeers(tr, c.InfoHash, c.PeerID, 6881, c.Spec.Info.Length)
-		if err != nil {
-			fmt.Printf("Tracker failed: %v\n", err)
+	// 3. Accept connections, announce and dial the peers we got
+	if found := c.startNetwork(tracker.EventStarted); found == 0 && !c.isComplete() {
+		c.stopNetwork()
+		c.disk.close()
+		store.Close()
+		return ErrNoPeers
+	}
+
+	c.setState(StateRunning)
+	return nil
+}
+
+// Stop disconnects every peer, waits for all goroutines to exit, flushes
+// and closes storage and tells the trackers we are gone.
+func (c *Client) Stop() error {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if c.state == StateStopped {
+		return nil
+	}
+
+	if c.state == StateRunning {
+		c.stopNetwork()
+	}
+	c.disk.close()
+	close(c.stopped)
+	c.setState(StateStopped)
+
+	err := c.saveResume()
+	if cerr := c.store.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && c.moveDue() {
+		// Don't leave it to moveWhenComplete, which may not get to run.
+		err = c.moveStorage(c.Params.OutputPath)
+	}
+
+	c.announceStopped()
+	return err
+}
+
+// Pause disconnects every peer and stops announcing. Storage stays open.
+func (c *Client) Pause() {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if c.state != StateRunning {
+		return
+	}
+	c.stopNetwork()
+	c.setState(StatePaused)
+	c.saveResumeOrReport()
+}
+
+// Resume reconnects after Pause.
+func (c *Client) Resume() {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if c.state != StatePaused {
+		return
+	}
+	c.startNetwork(tracker.EventNone)
+	c.setState(StateRunning)
+}
+
+// State returns whether the client is running, paused or stopped.
+func (c *Client) State() ClientState {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	return c.state
+}
+
+// setState changes the state and tells subscribers. c.lifeMu must be held.
+func (c *Client) setState(s ClientState) {
+	c.state = s
+	c.events.publish(StateChanged{State: s})
+}
+
+// Done is closed once every wanted piece has been downloaded and verified.
+func (c *Client) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// SetRateLimits changes this torrent's normal rate limits.
+func (c *Client) SetRateLimits(r ratelimit.Rates) {
+	c.limits.set(r)
+}
+
+// SetRateSchedule changes when alternative rate limits apply.
+func (c *Client) SetRateSchedule(s ratelimit.Schedule) {
+	c.limits.setSchedule(s)
+}
+
+// RateLimits returns this torrent's normal limits and schedule.
+func (c *Client) RateLimits() (ratelimit.Rates, ratelimit.Schedule) {
+	return c.limits.get()
+}
+
+// SetPeerRateLimits changes the limits of every connection, current and
+// future.
+func (c *Client) SetPeerRateLimits(r ratelimit.Rates) {
+	c.mu.Lock()
+	c.peerRates = r
+	c.mu.Unlock()
+	for _, pc := range c.connList() {
+		pc.downLimit.SetRate(r.Download)
+		pc.upLimit.SetRate(r.Upload)
+	}
+}
+
+// SetSequential switches between downloading in order and rarest first.
+func (c *Client) SetSequential(on bool) {
+	c.picker.SetSequential(on)
+}
+
+// SetPieceDeadline asks for piece index to be downloaded before t; pieces
+// with deadlines are requested before any other. A zero t removes the
+// deadline.
+func (c *Client) SetPieceDeadline(index int, t time.Time) {
+	c.picker.SetDeadline(index, t)
+}
+
+// SetReadCursor tells the client a reader is at piece index, so the
+// pieces of the next Params.Readahead bytes are fetched in order. The
+// rest is still downloaded rarest first. A negative index means nobody
+// is reading.
+func (c *Client) SetReadCursor(index int) {
+	pieces := int((c.Params.Readahead + c.Spec.Info.PieceLength - 1) / c.Spec.Info.PieceLength)
+	c.picker.SetCursor(index, pieces)
+}
+
+// Progress returns how many wanted pieces are verified, out of how many.
+func (c *Client) Progress() (done, total int) {
+	return c.numDone(), c.numWanted()
+}
+
+// pieceWritten finishes a verified piece once the disk writers are done
+// with it. synced says whether they synced it, too.
+func (c *Client) pieceWritten(index int, synced bool, err error) {
+	if err != nil {
+		c.events.publish(StorageError{Op: "write", Index: index, Err: err})
+		c.picker.Release(index)
+		return
+	}
+	done, total := c.Progress()
+	if c.isWanted(index) {
+		done++ // Not marked yet, so subscribers hear of it before Completed
+	}
+	c.events.publish(PieceVerified{Index: index, Done: done, Total: total})
+	c.markHave(index)
+	if synced {
+		c.markSynced(index)
+	}
+
+	complete := done == total
+	c.mu.Lock()
+	due := complete || time.Since(c.lastResumeSave) > c.Params.SyncInterval
+	if due {
+		c.lastResumeSave = time.Now()
+	}
+	c.mu.Unlock()
+	if !due {
+		return
+	}
+	// On-complete durability leaves the saves before the last unsynced.
+	syncNow := c.Params.Durability != DurabilityNever &&
+		(complete || c.Params.Durability != DurabilityOnComplete)
+	if err := c.writeResume(syncNow); err != nil {
+		c.events.publish(StorageError{Op: "resume", Index: -1, Err: err})
+	}
+}
+
+// startNetwork starts listening, choking and announcing, and dials the
+// peers of the first announce. It returns how many peers were found.
+func (c *Client) startNetwork(event tracker.Event) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.netCtx, c.netCancel = ctx, cancel
+	c.knownPeers = make(map[string]bool)
+	c.mu.Unlock()
+
+	c.startListening()
+
+	ch := newChoker(c)
+	c.goNetwork(func() { ch.run(ctx) })
+	c.goNetwork(func() { c.limits.run(ctx.Done()) })
+	c.goNetwork(func() { c.publishRates(ctx.Done()) })
+
+	peers, interval := c.announce(event)
+	c.mu.Lock()
+	peers = append(peers, c.resumePeers...)
+	c.mu.Unlock()
+	c.addPeers(peers)
+	c.goNetwork(func() { c.announceLoop(ctx, interval) })
+	return len(peers)
+}
+
+// stopNetwork closes every connection and waits for all network goroutines.
+// The listener goes last: hasCapacity consults it until everything that
+// might connect has returned.
+func (c *Client) stopNetwork() {
+	c.mu.Lock()
+	cancel := c.netCancel
+	c.netCtx, c.netCancel = nil, nil
+	c.mu.Unlock()
+
+	cancel()
+	for _, pc := range c.connList() {
+		pc.close()
+	}
+	c.wg.Wait()
+
+	c.stopListening()
+}
+
+// track registers one more network goroutine. It fails once the network
+// is being stopped, so nothing new starts behind stopNetwork's back.
+func (c *Client) track() (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.netCtx == nil {
+		return nil, false
+	}
+	c.wg.Add(1)
+	return c.netCtx, true
+}
+
+// goNetwork runs fn as a tracked network goroutine.
+func (c *Client) goNetwork(fn func()) {
+	if _, ok := c.track(); !ok {
+		return
+	}
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+}
+
+// addPeers starts a supervisor for every peer we don't know yet.
+func (c *Client) addPeers(peers []tracker.Peer) {
+	for _, p := range peers {
+		c.mu.Lock()
+		known := c.knownPeers[p.String()]
+		if c.knownPeers != nil {
+			c.knownPeers[p.String()] = true
+		}
+		c.mu.Unlock()
+		if known {
 			continue
 		}
-		peers = foundPeers
-		fmt.Printf("Found %d peers from %s\n", len(peers), tr)
-		if len(peers) > 0 {
-			break // Found peers!
+
+		// Supervisor Loop: Keep reconnecting to this peer
+		peer := p
+		ctx, ok := c.track()
+		if !ok {
+			return
 		}
+		go func() {
+			defer c.wg.Done()
+			for {
+				c.startDownloadWorker(ctx, peer)
+				// If returns, connection died. Wait and retry.
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(10 * time.Second):
+				}
+			}
+		}()
+	}
+}
+
+func (c *Client) numPieces() int {
+	return len(c.Spec.Info.Pieces) / 20
+}
+
+// newWork describes piece index for download.
+func (c *Client) newWork(index int) *piece.Work {
+	hashStart := index * 20
+	hashEnd := hashStart + 20
+	return &piece.Work{
+		Index:  index,
+		Hash:   []byte(c.Spec.Info.Pieces[hashStart:hashEnd]), // Copy it
+		Length: c.pieceLength(index),
 	}
+}
 
-	if len(peers) == 0 {
-		return fmt.Errorf("failed to find peers from any tracker")
+// pieceLength returns the size of piece index. The last piece might be shorter.
+func (c *Client) pieceLength(index int) int {
+	if index == c.numPieces()-1 {
+		if rem := c.Spec.Info.Length % c.Spec.Info.PieceLength; rem != 0 {
+			return int(rem)
+		}
 	}
+	return int(c.Spec.Info.PieceLength)
+}
 
-	// 3. Setup Work Queue
-	workQueue := make(chan *piece.Work, len(c.Spec.Info.Pieces)/20)
-	results := make(chan *piece.Result)
+// bitfield returns a copy of our verified pieces and whether we have any.
+func (c *Client) bitfield() (piece.Bitfield, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bf := make(piece.Bitfield, len(c.have))
+	hasAny := false
+	for i, b := range c.have {
+		bf[i] = b
+		hasAny = hasAny || b != 0
+	}
+	return bf, hasAny
+}
 
-	// Split pieces into work items
-	for index := 0; index < len(c.Spec.Info.Pieces)/20; index++ {
-		hashStart := index * 20
-		hashEnd := hashStart + 20
-		hash := c.Spec.Info.Pieces[hashStart:hashEnd]
+func (c *Client) hasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.have.HasPiece(index)
+}
 
-		length := c.Spec.Info.PieceLength
-		// Last piece might be shorter
-		if index == (len(c.Spec.Info.Pieces)/20)-1 {
-			length = c.Spec.Info.Length % c.Spec.Info.PieceLength
-			if length == 0 {
-				length = c.Spec.Info.PieceLength
-			}
+// needsFrom reports whether bf has any wanted piece we are still missing.
+func (c *Client) needsFrom(bf piece.Bitfield) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < c.numPieces(); i++ {
+		if bf.HasPiece(i) && c.wanted.HasPiece(i) && !c.have.HasPiece(i) {
+			return true
 		}
+	}
+	return false
+}
 
-		workQueue <- &piece.Work{
-			Index:  index,
-			Hash:   []byte(hash), // Copy it
-			Length: int(length),
+// isSeed reports whether bf holds every piece of the torrent.
+func (c *Client) isSeed(bf piece.Bitfield) bool {
+	for i := 0; i < c.numPieces(); i++ {
+		if !bf.HasPiece(i) {
+			return false
 		}
 	}
+	return true
+}
 
-	// 4. Start Workers
-	// For this implementation, let's spawn a goroutine for each peer that was found
-	for _, p := range peers {
-		// Supervisor Loop: Keep reconnecting to this peer
-		go func(peer tracker.Peer) {
-			for {
-				c.startDownloadWorker(peer, workQueue, results)
-				// If returns, connection died. Wait and retry.
-				// We check if download is complete to stop retrying?
-				// The results channel loop checks for totalPieces.
-				// But this goroutine doesn't know when to stop easily unless we close workQueue or use a context.
-				// For now, simpler: retry forever. If download completes, getting work from queue will fail/block?
-				// Actually, if download completes, main loop exits, program exits. So infinite retry is fine for CLI/GUI lifecycle.
-				time.Sleep(10 * time.Second)
+// isComplete reports whether every wanted piece is verified.
+func (c *Client) isComplete() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.complete()
+}
+
+// complete is isComplete with c.mu held.
+func (c *Client) complete() bool {
+	for i := 0; i < c.numPieces(); i++ {
+		if c.wanted.HasPiece(i) && !c.have.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// numDone counts the verified wanted pieces.
+func (c *Client) numDone() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for i := 0; i < c.numPieces(); i++ {
+		if c.wanted.HasPiece(i) && c.have.HasPiece(i) {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Client) numWanted() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for i := 0; i < c.numPieces(); i++ {
+		if c.wanted.HasPiece(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// bytesLeft is what we still have to download, for tracker announces.
+// Skipped pieces don't count.
+func (c *Client) bytesLeft() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var left int64
+	for i := 0; i < c.numPieces(); i++ {
+		if c.wanted.HasPiece(i) && !c.have.HasPiece(i) {
+			left += int64(c.pieceLength(i))
+		}
+	}
+	return left
+}
+
+// markHave records a verified piece and announces it to every peer.
+func (c *Client) markHave(index int) {
+	c.picker.MarkDone(index)
+	c.mu.Lock()
+	c.have.SetPiece(index)
+	completed := c.updateDone()
+	c.mu.Unlock()
+	if completed {
+		c.completed()
+	}
+
+	for _, pc := range c.connList() {
+		// Don't let one slow peer hold up the disk writers.
+		c.goNetwork(func() {
+			if err := pc.sendHave(index); err != nil {
+				pc.close()
 			}
-		}(p)
+		})
+	}
+}
+
+// clearHave forgets a piece that turned out to be corrupt on disk.
+func (c *Client) clearHave(index int) {
+	c.mu.Lock()
+	c.have.ClearPiece(index)
+	c.synced.ClearPiece(index)
+	c.updateDone()
+	c.mu.Unlock()
+	c.picker.MarkMissing(index)
+}
+
+// startListening registers with the configured listener, or opens our own.
+// Failing to listen is not fatal: we can still download over outbound connections.
+func (c *Client) startListening() {
+	l := c.Params.Listener
+	if l == nil {
+		var err error
+		l, err = NewListener(ListenerParams{Port: c.Params.Port})
+		if err != nil {
+			fmt.Printf("Not accepting incoming connections: %v\n", err)
+			return
+		}
+		go l.Serve()
 	}
 
-	// 5. Collect Results
-	donePieces := 0
-	totalPieces := len(c.Spec.Info.Pieces) / 20
+	if err := l.Register(c); err != nil {
+		fmt.Printf("Not accepting incoming connections: %v\n", err)
+		return
+	}
+	c.mu.Lock()
+	c.listener = l
+	c.mu.Unlock()
+	c.port = l.Port()
+}
 
-	// Initial progress report
-	if progressCb != nil {
-		progressCb(donePieces, totalPieces)
+func (c *Client) stopListening() {
+	c.mu.Lock()
+	l := c.listener
+	c.listener = nil
+	c.mu.Unlock()
+	if l == nil {
+		return
+	}
+	l.Unregister(c)
+	if c.Params.Listener == nil {
+		l.Close()
 	}
+}
 
-	for donePieces < totalPieces {
-		res := <-results
-		// Write to storage
-		offset := int64(res.Index) * c.Spec.Info.PieceLength
-		if err := store.Write(offset, res.Buf); err != nil {
-			fmt.Printf("Error writing piece %d: %v\n", res.Index, err)
-			// Should put back in queue?
-			continue
+// connList returns a snapshot of the live connections.
+func (c *Client) connList() []*peerConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := make([]*peerConn, 0, len(c.conns))
+	for pc := range c.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+// numUnchoked counts the peers we are currently uploading to.
+func (c *Client) numUnchoked() int {
+	n := 0
+	for _, pc := range c.connList() {
+		pc.mu.Lock()
+		if !pc.amChoking {
+			n++
 		}
-		donePieces++
+		pc.mu.Unlock()
+	}
+	return n
+}
+
+func (c *Client) numConns() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
 
-		if progressCb != nil {
-			progressCb(donePieces, totalPieces)
+// hasCapacity reports whether the torrent and global limits allow another connection.
+func (c *Client) hasCapacity() bool {
+	if c.numConns() >= c.Params.MaxConns {
+		return false
+	}
+	// The listener takes its own lock and then ours, so ask it unlocked.
+	c.mu.Lock()
+	l := c.listener
+	c.mu.Unlock()
+	return l == nil || l.hasCapacity()
+}
+
+// acceptsPeer reports whether a connection to peerID should be kept.
+// It rejects ourselves (trackers happily return our own address) and
+// peers we are already connected to.
+func (c *Client) acceptsPeer(peerID [20]byte) bool {
+	if peerID == c.PeerID || !c.hasCapacity() {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pc := range c.conns {
+		if pc.peerID == peerID {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// addConn registers pc, enforcing the per-torrent limit.
+func (c *Client) addConn(pc *peerConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.conns) >= c.Params.MaxConns {
+		return false
+	}
+	c.conns[pc] = struct{}{}
+	return true
+}
+
+func (c *Client) removeConn(pc *peerConn) {
+	c.mu.Lock()
+	delete(c.conns, pc)
+	c.mu.Unlock()
+
+	// The peer's pieces no longer count towards availability.
+	c.picker.RemoveBitfield(pc.peerBitfield())
 }
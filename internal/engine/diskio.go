@@ -0,0 +1,412 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// Defaults for the disk settings of ClientParams and SessionParams.
+const (
+	defaultDiskWorkers = 4
+	defaultWriteQueue  = 32 << 20
+	defaultReadCache   = 16 << 20
+
+	// Adjacent pieces waiting in the queue are written together, up to
+	// this much at a time. Coalescing is by whole pieces only: blocks are
+	// kept in memory until their piece is verified, and only then queued.
+	maxCoalescedWrite = 4 << 20
+)
+
+// diskPool keeps storage off the network's back. Verified pieces queue up
+// for a pool of writers instead of being written by the peer that
+// finished them, so a slow disk holds up no one until the queue is full;
+// then peers stop requesting blocks (see congested) and hand-offs block.
+// Uploads are served from a cache of whole pieces. At most one storage
+// operation per worker runs at a time, reads included.
+//
+// The torrents of a Session share one pool, so its limits hold for all of
+// them together; a Client on its own has a pool of its own. Each torrent
+// reaches the pool through a diskIO.
+type diskPool struct {
+	sem   chan struct{} // a token per running storage operation
+	cache *readCache
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled whenever queue or queued change
+	queue  []diskWrite
+	queued int64 // bytes queued or being written
+	limit  int64
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// diskWrite is a verified piece of a torrent waiting to be written.
+type diskWrite struct {
+	d   *diskIO
+	res *piece.Result
+}
+
+func newDiskPool(workers int, writeQueue, readCache int64) *diskPool {
+	p := &diskPool{
+		sem:   make(chan struct{}, workers),
+		cache: newReadCache(readCache),
+		limit: writeQueue,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.writer()
+	}
+	return p
+}
+
+// close stops the writers once every queued piece is written.
+func (p *diskPool) close() {
+	p.mu.Lock()
+	for p.queued > 0 {
+		p.cond.Wait()
+	}
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *diskPool) writer() {
+	defer p.wg.Done()
+	for {
+		d, batch, ok := p.next()
+		if !ok {
+			return
+		}
+		d.writeMu.RLock()
+		synced, err := d.writeBatch(batch)
+		d.writeMu.RUnlock()
+
+		// Reported before the bytes leave the queue, so drain waits for
+		// the reports too.
+		var n int64
+		for _, res := range batch {
+			d.c.pieceWritten(res.Index, synced, err)
+			n += int64(len(res.Buf))
+		}
+		p.mu.Lock()
+		p.queued -= n
+		d.queued -= n
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// next takes the oldest queued piece of a torrent whose writes aren't
+// held, and any of its pieces that directly follow it, waiting for one if
+// there is none. It returns false once closed.
+func (p *diskPool) next() (*diskIO, []*piece.Result, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	first := -1
+	for {
+		for i, w := range p.queue {
+			if !w.d.held {
+				first = i
+				break
+			}
+		}
+		if first >= 0 {
+			break
+		}
+		if p.closed && len(p.queue) == 0 {
+			return nil, nil, false
+		}
+		p.cond.Wait()
+	}
+	d := p.queue[first].d
+	batch := []*piece.Result{p.queue[first].res}
+	p.queue = append(p.queue[:first], p.queue[first+1:]...)
+	size := len(batch[0].Buf)
+
+	for found := true; found; {
+		found = false
+		last := batch[len(batch)-1].Index
+		for i, w := range p.queue {
+			if w.d == d && w.res.Index == last+1 && size+len(w.res.Buf) <= maxCoalescedWrite {
+				batch = append(batch, w.res)
+				size += len(w.res.Buf)
+				p.queue = append(p.queue[:i], p.queue[i+1:]...)
+				found = true
+				break
+			}
+		}
+	}
+	return d, batch, true
+}
+
+// diskIO is a torrent's use of a diskPool, for one run of the client.
+type diskIO struct {
+	c     *Client
+	pool  *diskPool
+	owned bool            // the pool is the client's own, closed along
+	store storage.Torrent // changed with every token held; nil once closed
+
+	// writeMu is held for reading by writers while they write a batch,
+	// and for writing while storage must not change.
+	writeMu sync.RWMutex
+
+	// Guarded by pool.mu.
+	queued int64 // bytes of this torrent queued or being written
+	held   bool  // see holdWrites
+}
+
+// newDiskIO has the client use the pool of its Session, or a pool of its
+// own made to its ClientParams.
+func newDiskIO(c *Client, store storage.Torrent) *diskIO {
+	d := &diskIO{c: c, pool: c.sharedDisk, store: store}
+	if d.pool == nil {
+		d.pool = newDiskPool(c.Params.DiskWorkers, c.Params.WriteQueue, c.Params.ReadCache)
+		d.owned = true
+	}
+	return d
+}
+
+// diskIO returns the disk I/O of the last Start, closed once the client
+// stopped, or nil if it never started. For use without lifeMu.
+func (c *Client) diskIO() *diskIO {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.disk
+}
+
+// write queues a verified piece. It blocks while the queue is full; one
+// piece is always let in, however large. It fails with ErrStopped once
+// the pool is closed.
+func (d *diskIO) write(res *piece.Result) error {
+	p := d.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.queued > 0 && p.queued >= p.limit && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return ErrStopped
+	}
+	p.queue = append(p.queue, diskWrite{d, res})
+	p.queued += int64(len(res.Buf))
+	d.queued += int64(len(res.Buf))
+	p.cond.Broadcast()
+	return nil
+}
+
+// congested reports whether the write queue is full.
+func (d *diskIO) congested() bool {
+	d.pool.mu.Lock()
+	defer d.pool.mu.Unlock()
+	return d.pool.queued >= d.pool.limit
+}
+
+// drain waits until every queued piece of the torrent is written.
+func (d *diskIO) drain() {
+	d.pool.mu.Lock()
+	defer d.pool.mu.Unlock()
+	for d.queued > 0 {
+		d.pool.cond.Wait()
+	}
+}
+
+// close writes what is queued and forgets the torrent's cached pieces. It
+// waits for reads under way, and later ones fail with ErrStopped, so
+// storage can be closed afterwards. A pool of the client's own is closed.
+func (d *diskIO) close() {
+	d.drain()
+	d.swap(nil)
+	d.pool.cache.drop(d)
+	if d.owned {
+		d.pool.close()
+	}
+}
+
+// writeBatch writes consecutive pieces in one go. synced says whether
+// they were synced, too.
+func (d *diskIO) writeBatch(batch []*piece.Result) (synced bool, err error) {
+	buf := batch[0].Buf
+	if len(batch) > 1 {
+		buf = nil
+		for _, res := range batch {
+			buf = append(buf, res.Buf...)
+		}
+	}
+
+	d.pool.sem <- struct{}{}
+	_, err = d.store.WriteAt(buf, int64(batch[0].Index)*d.c.Spec.Info.PieceLength)
+	synced = d.c.Params.Durability == DurabilityOnPiece
+	if err == nil && synced {
+		err = d.store.Flush()
+	}
+	for _, res := range batch {
+		if err == nil {
+			err = d.store.MarkComplete(res.Index)
+		}
+	}
+	<-d.pool.sem
+	return synced, err
+}
+
+// holdWrites waits for the writes under way and keeps new ones from
+// starting until releaseWrites. Reads carry on, and so do the writes of
+// other torrents in the pool.
+func (d *diskIO) holdWrites() {
+	d.pool.mu.Lock()
+	d.held = true
+	d.pool.mu.Unlock()
+	d.writeMu.Lock()
+}
+
+func (d *diskIO) releaseWrites() {
+	d.writeMu.Unlock()
+	d.pool.mu.Lock()
+	d.held = false
+	d.pool.cond.Broadcast()
+	d.pool.mu.Unlock()
+}
+
+// swap makes store the storage read from and written to, waiting for
+// every storage operation of the pool to finish first. It returns the old
+// storage.
+func (d *diskIO) swap(store storage.Torrent) storage.Torrent {
+	sem := d.pool.sem
+	for i := 0; i < cap(sem); i++ {
+		sem <- struct{}{}
+	}
+	old := d.store
+	d.store = store
+	for i := 0; i < cap(sem); i++ {
+		<-sem
+	}
+	return old
+}
+
+// clearCache forgets the torrent's cached pieces, e.g. when the data on
+// disk may have changed.
+func (d *diskIO) clearCache() {
+	d.pool.cache.drop(d)
+}
+
+// readBlock reads part of a verified piece for an upload.
+func (d *diskIO) readBlock(index, begin, length int) ([]byte, error) {
+	cache := d.pool.cache
+	key := cacheKey{d, index}
+	if buf, ok := cache.get(key); ok {
+		return buf[begin : begin+length], nil
+	}
+	if !cache.fits(d.c.pieceLength(index)) {
+		buf := make([]byte, length)
+		err := d.readAt(buf, int64(index)*d.c.Spec.Info.PieceLength+int64(begin))
+		return buf, err
+	}
+
+	// Peers tend to ask for all of a piece, so read all of it.
+	buf := make([]byte, d.c.pieceLength(index))
+	if err := d.readAt(buf, int64(index)*d.c.Spec.Info.PieceLength); err != nil {
+		return nil, err
+	}
+	cache.add(key, buf)
+	return buf[begin : begin+length], nil
+}
+
+// flush syncs storage, taking a turn with the writers. It reports false,
+// doing nothing, once the diskIO is closed.
+func (d *diskIO) flush() (bool, error) {
+	d.pool.sem <- struct{}{}
+	defer func() { <-d.pool.sem }()
+	if d.store == nil {
+		return false, nil
+	}
+	return true, d.store.Flush()
+}
+
+// readAt reads from storage, taking a turn with the writers.
+func (d *diskIO) readAt(p []byte, off int64) error {
+	d.pool.sem <- struct{}{}
+	defer func() { <-d.pool.sem }()
+	if d.store == nil {
+		return ErrStopped
+	}
+	_, err := d.store.ReadAt(p, off)
+	return err
+}
+
+// readCache holds whole pieces, dropping the least recently used ones
+// beyond its size limit. A limit of zero or less disables it.
+type readCache struct {
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	lru   *list.List // of *cachedPiece, most recently used first
+	items map[cacheKey]*list.Element
+}
+
+// cacheKey is a piece of the torrent of a diskIO.
+type cacheKey struct {
+	d     *diskIO
+	index int
+}
+
+type cachedPiece struct {
+	key cacheKey
+	buf []byte
+}
+
+func newReadCache(limit int64) *readCache {
+	return &readCache{limit: limit, lru: list.New(), items: make(map[cacheKey]*list.Element)}
+}
+
+// fits reports whether a piece of n bytes can be cached at all.
+func (rc *readCache) fits(n int) bool {
+	return int64(n) <= rc.limit
+}
+
+func (rc *readCache) get(key cacheKey) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.items[key]
+	if !ok {
+		return nil, false
+	}
+	rc.lru.MoveToFront(e)
+	return e.Value.(*cachedPiece).buf, true
+}
+
+func (rc *readCache) add(key cacheKey, buf []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.items[key]; ok || !rc.fits(len(buf)) {
+		return
+	}
+	rc.items[key] = rc.lru.PushFront(&cachedPiece{key, buf})
+	rc.size += int64(len(buf))
+	for rc.size > rc.limit {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// drop removes the pieces of d's torrent.
+func (rc *readCache) drop(d *diskIO) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for e := rc.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedPiece).key.d == d {
+			rc.remove(e)
+		}
+		e = next
+	}
+}
+
+// remove takes e out of the cache. rc.mu must be held.
+func (rc *readCache) remove(e *list.Element) {
+	cp := rc.lru.Remove(e).(*cachedPiece)
+	delete(rc.items, cp.key)
+	rc.size -= int64(len(cp.buf))
+}
@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// gatedStore is storage that holds every write until let through, and
+// records the writes it gets.
+type gatedStore struct {
+	storage.Torrent
+	gate chan struct{}
+
+	mu     sync.Mutex
+	writes []int // lengths, in order
+}
+
+func (s *gatedStore) WriteAt(p []byte, off int64) (int, error) {
+	<-s.gate
+	s.mu.Lock()
+	s.writes = append(s.writes, len(p))
+	s.mu.Unlock()
+	return s.Torrent.WriteAt(p, off)
+}
+
+func newGatedDisk(t *testing.T, data []byte, pieceLength int, params ClientParams) (*Client, *gatedStore) {
+	t.Helper()
+	c, err := NewClient(newTestSpec(data, pieceLength), params)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	inner, _ := storage.NewMemoryBackend().Open(c.layout())
+	store := &gatedStore{Torrent: inner, gate: make(chan struct{})}
+	c.store = store
+	c.disk = newDiskIO(c, store)
+	t.Cleanup(func() {
+		close(store.gate)
+		c.disk.close()
+	})
+	return c, store
+}
+
+// waitTaken waits until the writers have taken every queued piece.
+func waitTaken(t *testing.T, d *diskIO) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		d.pool.mu.Lock()
+		n := len(d.pool.queue)
+		d.pool.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("queued pieces not taken by a writer")
+}
+
+func TestDiskWritesCoalesce(t *testing.T) {
+	data := testData(4 * blockSize)
+	c, store := newGatedDisk(t, data, blockSize, ClientParams{DiskWorkers: 1})
+
+	c.disk.write(&piece.Result{Index: 0, Buf: data[:blockSize]})
+	waitTaken(t, c.disk)
+	// Piece 0 is being written; the rest wait for it and go together.
+	for i := 1; i < 4; i++ {
+		c.disk.write(&piece.Result{Index: i, Buf: data[i*blockSize : (i+1)*blockSize]})
+	}
+	store.gate <- struct{}{}
+	store.gate <- struct{}{}
+	c.disk.drain()
+
+	store.mu.Lock()
+	writes := store.writes
+	store.mu.Unlock()
+	if len(writes) != 2 || writes[0] != blockSize || writes[1] != 3*blockSize {
+		t.Errorf("writes = %v, want [%d %d]", writes, blockSize, 3*blockSize)
+	}
+	if !c.isComplete() {
+		t.Error("pieces not marked done after writing")
+	}
+}
+
+func TestDiskBackpressure(t *testing.T) {
+	data := testData(4 * blockSize)
+	c, store := newGatedDisk(t, data, blockSize, ClientParams{DiskWorkers: 1, WriteQueue: 2 * blockSize})
+
+	c.disk.write(&piece.Result{Index: 0, Buf: data[:blockSize]})
+	c.disk.write(&piece.Result{Index: 1, Buf: data[blockSize : 2*blockSize]})
+	if !c.disk.congested() {
+		t.Fatal("full queue not congested")
+	}
+
+	queued := make(chan struct{})
+	go func() {
+		c.disk.write(&piece.Result{Index: 2, Buf: data[2*blockSize : 3*blockSize]})
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("write into a full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	store.gate <- struct{}{} // piece 0 done, room for piece 2
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write stayed blocked after the queue drained")
+	}
+}
+
+func TestDiskWriteAfterClose(t *testing.T) {
+	pool := newDiskPool(1, blockSize, 0)
+	d := &diskIO{pool: pool}
+	pool.close()
+	if err := d.write(&piece.Result{Index: 0, Buf: make([]byte, blockSize)}); err != ErrStopped {
+		t.Errorf("write() error = %v, want ErrStopped", err)
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.queue) != 0 || pool.queued != 0 {
+		t.Error("piece queued after close")
+	}
+}
+
+func TestReadCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	rc := newReadCache(3 * blockSize)
+	for i := 0; i < 3; i++ {
+		rc.add(cacheKey{nil, i}, make([]byte, blockSize))
+	}
+	rc.get(cacheKey{nil, 0}) // piece 1 is now the least recently used
+	rc.add(cacheKey{nil, 3}, make([]byte, blockSize))
+
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := rc.get(cacheKey{nil, i}); ok != want {
+			t.Errorf("piece %d cached = %v, want %v", i, ok, want)
+		}
+	}
+	if rc.fits(4 * blockSize) {
+		t.Error("piece larger than the cache fits")
+	}
+
+	// Torrents share the cache, and leave it on their own.
+	other := &diskIO{}
+	rc.add(cacheKey{other, 0}, make([]byte, blockSize))
+	rc.drop(other)
+	if _, ok := rc.get(cacheKey{other, 0}); ok || rc.size != 2*blockSize {
+		t.Errorf("drop() left a piece, or took others: size %d", rc.size)
+	}
+
+	disabled := newReadCache(-1)
+	disabled.add(cacheKey{nil, 0}, make([]byte, 1))
+	if _, ok := disabled.get(cacheKey{nil, 0}); ok {
+		t.Error("disabled cache kept a piece")
+	}
+}
+
+func TestUploadsServedFromCache(t *testing.T) {
+	data := testData(2 * blockSize)
+	c, store := newGatedDisk(t, data, 2*blockSize, ClientParams{})
+	close(store.gate)
+	store.gate = make(chan struct{}) // for Cleanup
+	store.Torrent.WriteAt(data, 0)
+
+	block, err := c.disk.readBlock(0, blockSize, blockSize)
+	if err != nil || string(block) != string(data[blockSize:]) {
+		t.Fatalf("readBlock() = %v; data mismatch", err)
+	}
+	if _, ok := c.disk.pool.cache.get(cacheKey{c.disk, 0}); !ok {
+		t.Error("piece not cached after a read")
+	}
+}
+
+func TestDiskPoolShared(t *testing.T) {
+	pool := newDiskPool(1, 1<<20, 1<<20)
+	defer pool.close()
+	data := testData(2 * blockSize)
+	var disks []*diskIO
+	for i := 0; i < 2; i++ {
+		spec := newTestSpec(data, blockSize)
+		spec.InfoHash[0] = byte(i) // Two different torrents
+		c, err := NewClient(spec, ClientParams{})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		c.sharedDisk = pool
+		store, _ := storage.NewMemoryBackend().Open(c.layout())
+		c.store = store
+		c.disk = newDiskIO(c, store)
+		disks = append(disks, c.disk)
+	}
+
+	// A torrent whose writes are held, say while it moves, doesn't keep
+	// the only writer from the other one.
+	disks[0].holdWrites()
+	disks[0].write(&piece.Result{Index: 0, Buf: data[:blockSize]})
+	disks[1].write(&piece.Result{Index: 0, Buf: data[:blockSize]})
+	drained := make(chan struct{})
+	go func() {
+		disks[1].drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes of one torrent held up by another")
+	}
+	disks[0].releaseWrites()
+	disks[0].drain()
+
+	for _, d := range disks {
+		if !d.c.hasPiece(0) {
+			t.Error("piece not written")
+		}
+		if _, err := d.readBlock(0, 0, blockSize); err != nil {
+			t.Errorf("readBlock() error = %v", err)
+		}
+	}
+	if len(pool.cache.items) != 2 {
+		t.Errorf("%d pieces cached, want one of each torrent", len(pool.cache.items))
+	}
+	for _, d := range disks {
+		d.close()
+	}
+	if len(pool.cache.items) != 0 {
+		t.Error("closed torrents left pieces in the cache")
+	}
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+)
+
+// Durability is when storage is synced, making what was written survive
+// a crash or power loss. Resume data only ever records pieces that were
+// synced, so pieces written since the last sync are downloaded again
+// after a crash.
+type Durability int
+
+const (
+	// DurabilityPeriodic syncs every SyncInterval while pieces arrive, on
+	// completion, and when the torrent is paused, stopped or checked.
+	DurabilityPeriodic Durability = iota
+	// DurabilityOnPiece also syncs after writing every piece: the
+	// slowest, but hardly anything is lost in a crash.
+	DurabilityOnPiece
+	// DurabilityOnComplete only syncs on completion, and when paused,
+	// stopped or checked. A crash before then loses the resume data of
+	// the whole download, though not necessarily its data.
+	DurabilityOnComplete
+	// DurabilityNever leaves syncing to the operating system. No resume
+	// data is kept, so every Start checks the data on disk by its hashes.
+	DurabilityNever
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityPeriodic:
+		return "periodic"
+	case DurabilityOnPiece:
+		return "on-piece"
+	case DurabilityOnComplete:
+		return "on-complete"
+	case DurabilityNever:
+		return "never"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// ParseDurability parses the name of a durability setting, as returned
+// by String.
+func ParseDurability(s string) (Durability, error) {
+	for _, d := range []Durability{DurabilityPeriodic, DurabilityOnPiece, DurabilityOnComplete, DurabilityNever} {
+		if s == d.String() {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability %q", s)
+}
+
+// Default for ClientParams.SyncInterval.
+const defaultSyncInterval = time.Minute
+
+// syncStorage flushes storage and records every piece verified before as
+// synced.
+func (c *Client) syncStorage() error {
+	// Snapshot first: every piece in it has been written before the sync.
+	have, _ := c.bitfield()
+	// Writers report pieces without lifeMu, and MoveStorage may swap
+	// c.store meanwhile: go through the disk I/O while it's open.
+	var err error
+	flushed := false
+	if d := c.diskIO(); d != nil {
+		flushed, err = d.flush()
+	}
+	if !flushed {
+		err = c.store.Flush() // Stopped: c.lifeMu is held
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < c.numPieces(); i++ {
+		if have.HasPiece(i) && c.have.HasPiece(i) {
+			c.synced.SetPiece(i)
+		}
+	}
+	return nil
+}
+
+// markSynced records that piece index, just written, was synced with it.
+func (c *Client) markSynced(index int) {
+	c.mu.Lock()
+	c.synced.SetPiece(index)
+	c.mu.Unlock()
+}
+
+// syncedPieces returns a copy of the pieces that are known to be synced.
+func (c *Client) syncedPieces() piece.Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(piece.Bitfield(nil), c.synced...)
+}
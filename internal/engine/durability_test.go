@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// crashDownload writes all pieces of data but the last, with resume data
+// saved after every piece, then crashes the storage. It returns a new
+// client for the same torrent, and the storage as the crash left it.
+func crashDownload(t *testing.T, data []byte, durability Durability) (*Client, storage.Torrent) {
+	t.Helper()
+	backend := storage.NewMemoryBackend()
+	backend.Crashable = true
+	spec := newTestSpec(data, blockSize)
+	params := ClientParams{
+		OutputPath:   filepath.Join(t.TempDir(), "test.bin"),
+		Storage:      backend,
+		Durability:   durability,
+		SyncInterval: time.Nanosecond,
+	}
+	c, err := NewClient(spec, params)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	store, _ := backend.Open(c.layout())
+	c.store = store
+	c.disk = newDiskIO(c, store)
+	for i := 0; i < c.numPieces()-1; i++ {
+		c.disk.write(&piece.Result{Index: i, Buf: data[i*blockSize : (i+1)*blockSize]})
+		c.disk.drain()
+	}
+	c.disk.close()
+	backend.Crash()
+
+	restarted, err := NewClient(spec, params)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return restarted, store
+}
+
+func TestResumeDataSurvivesCrash(t *testing.T) {
+	data := testData(8 * blockSize)
+	for _, tt := range []struct {
+		durability Durability
+		recorded   bool // whether pieces are recorded before completion
+	}{
+		{DurabilityPeriodic, true},
+		{DurabilityOnPiece, true},
+		{DurabilityOnComplete, false},
+	} {
+		t.Run(tt.durability.String(), func(t *testing.T) {
+			c, store := crashDownload(t, data, tt.durability)
+			rd := c.loadResume()
+			if rd == nil {
+				t.Fatal("loadResume() found no resume data")
+			}
+
+			// Every piece the resume data claims must have survived.
+			recorded := 0
+			buf := make([]byte, blockSize)
+			for i := 0; i < c.numPieces(); i++ {
+				if !rd.Have.HasPiece(i) {
+					continue
+				}
+				recorded++
+				store.ReadAt(buf, int64(i*blockSize))
+				sum := sha1.Sum(buf)
+				if string(sum[:]) != c.Spec.Info.Pieces[i*20:(i+1)*20] {
+					t.Errorf("resume data records piece %d, lost in the crash", i)
+				}
+			}
+			if got := recorded > 0; got != tt.recorded {
+				t.Errorf("resume data records %d pieces, want some = %v", recorded, tt.recorded)
+			}
+		})
+	}
+}
+
+func TestNeverDurabilityKeepsNoResumeData(t *testing.T) {
+	c, _ := crashDownload(t, testData(8*blockSize), DurabilityNever)
+	if _, err := os.Stat(c.resumePath()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("resume file left behind, Stat() error = %v", err)
+	}
+
+	// Without resume data, a restart checks the data and finds it all.
+	data := testData(4 * blockSize)
+	spec := newTestSpec(data, blockSize)
+	out := filepath.Join(t.TempDir(), "test.bin")
+	writeContent(t, spec, out, data)
+	for run := 0; run < 2; run++ {
+		c, err := NewClient(spec, ClientParams{OutputPath: out, Durability: DurabilityNever})
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		if !c.isComplete() {
+			done, total := c.Progress()
+			t.Errorf("run %d: %d/%d pieces after Start, want all", run, done, total)
+		}
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error = %v", err)
+		}
+	}
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, d := range []Durability{DurabilityPeriodic, DurabilityOnPiece, DurabilityOnComplete, DurabilityNever} {
+		if got, err := ParseDurability(d.String()); err != nil || got != d {
+			t.Errorf("ParseDurability(%q) = %v, %v", d.String(), got, err)
+		}
+	}
+	if _, err := ParseDurability("always"); err == nil {
+		t.Error("ParseDurability() accepted an unknown setting")
+	}
+}
@@ -1,16 +1,34 @@
 package engine
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Minesto23/peerwire/internal/bencode"
+
+	"github.com/Minesto23/peerwire/internal/peer"
 	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/ratelimit"
+	"github.com/Minesto23/peerwire/internal/storage"
+	"github.com/Minesto23/peerwire/internal/torrent"
 )
 
 func TestIntegrityCheck(t *testing.T) {
 	// Hash of "hello" (sha1)
-	// f572d396fae9206628714fb2ce00f72e94f2258f
+	// aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d
 
-	hash := []byte{0xf5, 0x72, 0xd3, 0x96, 0xfa, 0xe9, 0x20, 0x66, 0x28, 0x71, 0x4f, 0xb2, 0xce, 0x00, 0xf7, 0x2e, 0x94, 0xf2, 0x25, 0x8f}
+	hash := []byte{0xaa, 0xf4, 0xc6, 0x1d, 0xdc, 0xc5, 0xe8, 0xa2, 0xda, 0xbe, 0xde, 0x0f, 0x3b, 0x48, 0x2c, 0xd9, 0xae, 0xa9, 0x43, 0x4d}
 
 	work := &piece.Work{Hash: hash}
 	buf := []byte("hello")
@@ -24,3 +42,578 @@ func TestIntegrityCheck(t *testing.T) {
 		t.Error("Integrity check passed for invalid data")
 	}
 }
+
+// newTestSpec builds a single-file torrent over data.
+func newTestSpec(data []byte, pieceLength int) *torrent.TorrentSpec {
+	var pieces []byte
+	for off := 0; off < len(data); off += pieceLength {
+		end := off + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[off:end])
+		pieces = append(pieces, h[:]...)
+	}
+	spec := &torrent.TorrentSpec{
+		Announce: "http://tracker.invalid/announce",
+		Info: torrent.InfoDictionary{
+			Name:        "test.bin",
+			Length:      int64(len(data)),
+			PieceLength: int64(pieceLength),
+			Pieces:      string(pieces),
+		},
+	}
+	spec.InfoHash = sha1.Sum(pieces)
+	return spec
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func expectMessage(t *testing.T, conn net.Conn, id peer.MessageID) *peer.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := peer.ReadMessage(conn, 1<<20)
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if msg != nil && msg.ID == id {
+			return msg
+		}
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, 2*blockSize)
+	c, _ := newSeeder(t, spec, data)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go c.runConn(local, "pipe", [20]byte{}, false)
+
+	// We are a seed, so our bitfield comes first.
+	bf := piece.Bitfield(expectMessage(t, remote, peer.MsgBitfield).Payload)
+	if !bf.HasPiece(0) || !bf.HasPiece(1) {
+		t.Fatalf("bitfield = %08b, want both pieces", bf)
+	}
+
+	(&peer.Message{ID: peer.MsgInterested}).Write(remote)
+	expectMessage(t, remote, peer.MsgUnchoke)
+
+	req := peer.FormatRequest(1, 0, blockSize)
+	(&peer.Message{ID: peer.MsgRequest, Payload: req}).Write(remote)
+
+	index, begin, block, err := peer.ParsePiece(expectMessage(t, remote, peer.MsgPiece))
+	if err != nil {
+		t.Fatalf("ParsePiece() error = %v", err)
+	}
+	if index != 1 || begin != 0 || !bytes.Equal(block, data[2*blockSize:3*blockSize]) {
+		t.Errorf("served wrong block: index %d begin %d", index, begin)
+	}
+}
+
+// slowReads is storage whose reads wait until released. It notes a Close
+// during a read.
+type slowReads struct {
+	storage.Torrent
+	reading, release chan struct{}
+	inRead           atomic.Bool
+	closedInRead     atomic.Bool
+}
+
+func (s *slowReads) ReadAt(p []byte, off int64) (int, error) {
+	s.inRead.Store(true)
+	defer s.inRead.Store(false)
+	s.reading <- struct{}{}
+	<-s.release
+	return s.Torrent.ReadAt(p, off)
+}
+
+func (s *slowReads) Close() error {
+	s.closedInRead.Store(s.inRead.Load())
+	return s.Torrent.Close()
+}
+
+func TestStopWaitsForUploads(t *testing.T) {
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, 2*blockSize)
+	c, _ := newSeeder(t, spec, data)
+
+	store := &slowReads{Torrent: c.store, reading: make(chan struct{}), release: make(chan struct{})}
+	c.lifeMu.Lock()
+	c.store = store
+	c.disk.swap(store)
+	c.lifeMu.Unlock()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go c.runConn(local, "pipe", [20]byte{}, false)
+	go io.Copy(io.Discard, remote) // Whatever is sent, until closed
+
+	(&peer.Message{ID: peer.MsgInterested}).Write(remote)
+	(&peer.Message{ID: peer.MsgRequest, Payload: peer.FormatRequest(1, 0, blockSize)}).Write(remote)
+	select {
+	case <-store.reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not served")
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Stop() }()
+	select {
+	case <-stopped:
+		t.Fatal("Stop() returned during an upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if store.closedInRead.Load() {
+		t.Error("storage closed during an upload")
+	}
+}
+
+// newSeeder starts a client that has all of data and accepts connections
+// on a fresh listener. It announces to its own tracker, which knows no peers.
+func newSeeder(t *testing.T, spec *torrent.TorrentSpec, data []byte) (*Client, *Listener) {
+	t.Helper()
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go l.Serve()
+
+	out := filepath.Join(t.TempDir(), "seed.bin")
+	writeContent(t, spec, out, data)
+
+	seedSpec := *spec
+	seedSpec.Announce = newTracker(t).URL
+	c, err := NewClient(&seedSpec, ClientParams{OutputPath: out, Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	// Start finds the data by hash check, since there's no resume file.
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { c.Stop() })
+	return c, l
+}
+
+// newTracker serves a compact peer list pointing at the given ports on localhost.
+func newTracker(t *testing.T, ports ...int) *httptest.Server {
+	t.Helper()
+	var peers []byte
+	for _, p := range ports {
+		peers = append(peers, 127, 0, 0, 1, byte(p>>8), byte(p))
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := bencode.Marshal(map[string]interface{}{
+			"interval": 900,
+			"peers":    string(peers),
+		})
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadFromSeeder(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	out := filepath.Join(t.TempDir(), "leech.bin")
+	c, err := NewClient(spec, ClientParams{OutputPath: out, Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	defer c.Stop()
+
+	done := make(chan error, 1)
+	go func() { done <- c.Download(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download() error = %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match")
+	}
+}
+
+func TestDownloadToMemoryBackend(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	backend := storage.NewMemoryBackend()
+	c, err := NewClient(spec, ClientParams{Storage: backend, Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c.Download(ctx); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	// The backend keeps the data after the client lets go of it.
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	store, _ := backend.Open(c.layout())
+	got := make([]byte, len(data))
+	if _, err := store.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("stored data does not match (err %v)", err)
+	}
+	for i := 0; i < c.numPieces(); i++ {
+		if !store.(*storage.MemoryStorage).Completed(i) {
+			t.Errorf("piece %d not marked complete", i)
+		}
+	}
+}
+
+func TestListenerRejectsUnknownTorrent(t *testing.T) {
+	data := testData(blockSize)
+	_, l := newSeeder(t, newTestSpec(data, blockSize), data)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(l.Port())))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	var unknown [20]byte
+	copy(unknown[:], "not-a-known-torrent!")
+	peer.NewHandshake(unknown, [20]byte{1}).Write(conn)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.ReadHandshake(conn); err == nil {
+		t.Error("listener answered a handshake for an unknown torrent")
+	}
+}
+
+func TestListenerCloseDropsHandshakes(t *testing.T) {
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	go l.Serve()
+
+	// A peer that connects and never says anything.
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(l.Port())))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		n := len(l.pending)
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection never accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		l.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() waited for the handshake timeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after Close()")
+	}
+}
+
+func TestEndgameSharesPieceAndCancels(t *testing.T) {
+	data := testData(2 * blockSize)
+	spec := newTestSpec(data, 2*blockSize) // one piece, two blocks
+
+	c, err := NewClient(spec, ClientParams{})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	has, _ := c.bitfield()
+	has.SetPiece(0)
+
+	a, b := &peerConn{c: c}, &peerConn{c: c}
+
+	pa := c.acquirePiece(a, has)
+	if pa == nil {
+		t.Fatal("first peer got no piece")
+	}
+	if !c.picker.InEndgame() {
+		t.Fatal("expected endgame once the only piece is handed out")
+	}
+	pb := c.acquirePiece(b, has)
+	if pb != pa {
+		t.Fatal("endgame should hand the same piece to the second peer")
+	}
+
+	if n := len(c.claimBlocks(a, pa, 10)); n != 2 {
+		t.Fatalf("peer a requested %d blocks, want 2", n)
+	}
+	if n := len(c.claimBlocks(b, pb, 10)); n != 2 {
+		t.Fatalf("peer b requested %d blocks, want 2", n)
+	}
+
+	// First block arrives from a: b's request for it must be cancelled.
+	cancel, complete := c.blockReceived(a, pa, 0, data[:blockSize])
+	if complete || len(cancel) != 1 || cancel[0] != b {
+		t.Fatalf("blockReceived() = %v, %v, want cancel for b", cancel, complete)
+	}
+
+	// The same block again from b is a duplicate and changes nothing.
+	if cancel, complete := c.blockReceived(b, pb, 0, data[:blockSize]); cancel != nil || complete {
+		t.Fatal("duplicate block was not ignored")
+	}
+	if got := b.downloaded.Load(); got != 0 || b.wasted.Load() != blockSize {
+		t.Errorf("duplicate counted as %d bytes downloaded, want wasted", got)
+	}
+	if got := c.downloaded.Load(); got != blockSize {
+		t.Errorf("client downloaded %d bytes, want %d", got, blockSize)
+	}
+
+	// Second block from b completes the piece and cancels a's request.
+	cancel, complete = c.blockReceived(b, pb, blockSize, data[blockSize:])
+	if !complete || len(cancel) != 1 || cancel[0] != a {
+		t.Fatalf("blockReceived() = %v, %v, want completion and cancel for a", cancel, complete)
+	}
+	if !bytes.Equal(pa.buf, data) || !c.pieceFinished(pa) {
+		t.Error("piece not assembled correctly")
+	}
+}
+
+func TestPipelineDepthAdapts(t *testing.T) {
+	pc := &peerConn{}
+	if d := pc.pipelineDepth(); d != initialPipeline {
+		t.Errorf("depth without samples = %d, want %d", d, initialPipeline)
+	}
+
+	// A slow peer gets the minimum.
+	pc.rate = 1000
+	if d := pc.pipelineDepth(); d != minPipeline {
+		t.Errorf("slow peer depth = %d, want %d", d, minPipeline)
+	}
+
+	// 1 MB/s over a 1s window plus 200ms latency is ~77 blocks.
+	pc.rate = 1 << 20
+	pc.minRTT = 200 * time.Millisecond
+	fast := pc.pipelineDepth()
+	if fast < 70 || fast > 80 {
+		t.Errorf("fast peer depth = %d, want ~77", fast)
+	}
+
+	// More latency needs more requests in flight for the same rate.
+	pc.minRTT = 800 * time.Millisecond
+	if d := pc.pipelineDepth(); d <= fast {
+		t.Errorf("depth with higher latency = %d, want more than %d", d, fast)
+	}
+
+	pc.rate = 100 << 20
+	if d := pc.pipelineDepth(); d != maxPipeline {
+		t.Errorf("very fast peer depth = %d, want %d", d, maxPipeline)
+	}
+}
+
+func TestReleasedPieceKeepsBlocks(t *testing.T) {
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, 3*blockSize)
+
+	c, err := NewClient(spec, ClientParams{})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	has, _ := c.bitfield()
+	has.SetPiece(0)
+
+	a := &peerConn{c: c}
+	p := c.acquirePiece(a, has)
+	if reqs := c.claimBlocks(a, p, 10); len(reqs) != 3 {
+		t.Fatalf("claimed %d blocks, want 3", len(reqs))
+	}
+	c.blockReceived(a, p, 0, data[:blockSize])
+
+	// a disconnects: the piece goes back to the picker with its block.
+	c.releasePiece(a, p)
+
+	b := &peerConn{c: c}
+	if c.acquirePiece(b, has) != p {
+		t.Fatal("expected the released partial piece to be reused")
+	}
+	reqs := c.claimBlocks(b, p, 10)
+	if len(reqs) != 2 || reqs[0].begin != blockSize {
+		t.Errorf("claimBlocks() = %v, want only the two missing blocks", reqs)
+	}
+}
+
+func TestStopDisconnectsAndAnnouncesStopped(t *testing.T) {
+	data := testData(2 * blockSize)
+	spec := newTestSpec(data, blockSize)
+
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		data, _ := bencode.Marshal(map[string]interface{}{"interval": 900, "peers": ""})
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	// Pausing and resuming reconnects without a started event.
+	c, _ := newSeeder(t, spec, data)
+	c.Pause()
+	c.Spec.Announce = srv.URL
+	c.Resume()
+	if ev := <-events; ev != "" {
+		t.Errorf("resume announced event %q, want none", ev)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	runDone := make(chan error, 1)
+	go func() { runDone <- c.runConn(local, "pipe", [20]byte{}, false) }()
+	expectMessage(t, remote, peer.MsgBitfield)
+
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// Stop waits for connections, so the run loop has already returned.
+	select {
+	case <-runDone:
+	default:
+		t.Error("connection still running after Stop")
+	}
+	if n := c.numConns(); n != 0 {
+		t.Errorf("%d connections left after Stop", n)
+	}
+	if ev := <-events; ev != "stopped" {
+		t.Errorf("tracker got event %q, want stopped", ev)
+	}
+
+	// Nothing may start once stopped.
+	if err := c.runConn(local, "pipe", [20]byte{}, false); err != errNotRunning {
+		t.Errorf("runConn() after Stop = %v, want %v", err, errNotRunning)
+	}
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	data := testData(2 * blockSize)
+	spec := newTestSpec(data, blockSize)
+
+	// A peer that accepts connections but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	spec.Announce = newTracker(t, ln.Addr().(*net.TCPAddr).Port).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	c, err := NewClient(spec, ClientParams{OutputPath: filepath.Join(t.TempDir(), "out.bin"), Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := c.Download(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Download() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Download() took %v to return after cancellation", elapsed)
+	}
+	if _, ok := c.track(); ok {
+		t.Error("client still running after cancellation")
+	}
+}
+
+func TestDownloadRespectsRateLimit(t *testing.T) {
+	data := testData(8 * blockSize)
+	spec := newTestSpec(data, 2*blockSize)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	c, err := NewClient(spec, ClientParams{
+		OutputPath: filepath.Join(t.TempDir(), "leech.bin"),
+		Listener:   l,
+		RateLimits: ratelimit.Rates{Download: 128 * 1024},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	// 128KB at 128KB/s: the limiter starts empty, so about a second.
+	start := time.Now()
+	if err := c.Download(context.Background()); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("download took %v, faster than the limit allows", elapsed)
+	}
+}
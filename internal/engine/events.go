@@ -0,0 +1,266 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/tracker"
+)
+
+// How often a running torrent publishes its transfer rates.
+const ratesInterval = time.Second
+
+// Event is something that happened to a torrent. Subscribers receive one
+// of the concrete types below and tell them apart with a type switch.
+type Event interface {
+	event()
+}
+
+// PieceVerified: a piece passed its hash check and was written to storage.
+type PieceVerified struct {
+	Index       int
+	Done, Total int // pieces verified so far, out of how many
+}
+
+// HashFailed: a downloaded piece didn't match its hash and was discarded.
+type HashFailed struct {
+	Index int
+	Peer  string // address of the peer that completed it
+}
+
+// PeerConnected: a handshaken connection was established.
+type PeerConnected struct {
+	Peer   string
+	PeerID [20]byte
+}
+
+// PeerDisconnected: a connection ended. Err says why, nil on a clean close.
+type PeerDisconnected struct {
+	Peer   string
+	PeerID [20]byte
+	Err    error
+}
+
+// PeerBanned: smart ban found a peer sending corrupt data. Its
+// connections are closed and it won't be talked to again this session.
+type PeerBanned struct {
+	IP     string
+	Reason string
+}
+
+// TrackerAnnounced reports the outcome of one announce.
+type TrackerAnnounced struct {
+	URL     string
+	Event   tracker.Event
+	Peers   int    // peers returned
+	Warning string // from the tracker, if any
+	Err     error  // nil on success
+}
+
+// StateChanged: the torrent was started, stopped, paused or resumed.
+type StateChanged struct {
+	State ClientState
+}
+
+// Rates are the current transfer rates, published every second while running.
+type Rates struct {
+	Download, Upload float64 // payload bytes per second, as in Stats
+	Peers            int     // connected peers
+}
+
+// StorageError: reading or writing data, or saving resume data, failed.
+type StorageError struct {
+	Op    string // "write", "read", "resume" or "move"
+	Index int    // piece, or -1
+	Err   error
+}
+
+// CheckProgress reports progress of a hash check of existing data.
+type CheckProgress struct {
+	Checked, Total int
+}
+
+// Completed: every piece has been downloaded and verified.
+type Completed struct{}
+
+// StorageMoved: the torrent's data was moved to Path, see MoveStorage.
+type StorageMoved struct {
+	Path string
+}
+
+func (PieceVerified) event()    {}
+func (HashFailed) event()       {}
+func (PeerConnected) event()    {}
+func (PeerDisconnected) event() {}
+func (PeerBanned) event()       {}
+func (TrackerAnnounced) event() {}
+func (StateChanged) event()     {}
+func (Rates) event()            {}
+func (StorageError) event()     {}
+func (CheckProgress) event()    {}
+func (Completed) event()        {}
+func (StorageMoved) event()     {}
+
+// eventBus fans events out to subscribers. Publishing never blocks: each
+// subscriber has its own queue, drained into its channel by a goroutine,
+// so a slow reader can't hold up the engine.
+//
+// The queues are bounded all the same. Rates and CheckProgress only say
+// where things stand, so a new one replaces one still queued: a reader
+// that is behind gets the latest, once. Every other event is delivered,
+// unless a subscriber falls maxQueuedEvents behind; then it is dropped and
+// its channel closed, as if it had unsubscribed.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+// How many undelivered events a subscriber may have before it is dropped.
+const maxQueuedEvents = 1 << 16
+
+type subscriber struct {
+	mu     sync.Mutex
+	queue  []Event
+	notify chan struct{}
+	quit   chan struct{}
+	once   sync.Once // closes quit
+	out    chan Event
+}
+
+// Subscribe returns a channel receiving every event of this torrent from
+// now on, and a function to cancel the subscription, which closes the
+// channel. A reader that falls far behind gets only the latest Rates and
+// CheckProgress, and is eventually dropped; see eventBus.
+func (c *Client) Subscribe() (<-chan Event, func()) {
+	return c.events.subscribe()
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	s := &subscriber{
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		out:    make(chan Event),
+	}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*subscriber]struct{})
+	}
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	go s.pump()
+
+	return s.out, func() {
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+		s.stop()
+	}
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if !s.push(ev) {
+			delete(b.subs, s)
+			s.stop()
+			continue
+		}
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// push queues ev, replacing a queued event it supersedes. It reports false
+// if the subscriber is too far behind to take it.
+func (s *subscriber) push(ev Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch ev.(type) {
+	case Rates, CheckProgress:
+		for i := len(s.queue) - 1; i >= 0; i-- {
+			if sameType(s.queue[i], ev) {
+				copy(s.queue[i:], s.queue[i+1:])
+				s.queue[len(s.queue)-1] = ev
+				return true
+			}
+		}
+	}
+	if len(s.queue) >= maxQueuedEvents {
+		return false
+	}
+	s.queue = append(s.queue, ev)
+	return true
+}
+
+func sameType(a, b Event) bool {
+	switch a.(type) {
+	case Rates:
+		_, ok := b.(Rates)
+		return ok
+	case CheckProgress:
+		_, ok := b.(CheckProgress)
+		return ok
+	}
+	return false
+}
+
+// stop ends the subscription; pump then closes the channel.
+func (s *subscriber) stop() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+// pump delivers queued events in order until the subscription is cancelled.
+func (s *subscriber) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+		ev := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- ev:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// publishRates sends a Rates event every second until quit is closed.
+func (c *Client) publishRates(quit <-chan struct{}) {
+	ticker := time.NewTicker(ratesInterval)
+	defer ticker.Stop()
+
+	sample := func(now time.Time) {
+		c.downMeter.sample(now, c.downloaded.Load())
+		c.upMeter.sample(now, c.uploaded.Load())
+	}
+	sample(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			sample(now)
+			c.events.publish(Rates{
+				Download: c.downMeter.rate(now),
+				Upload:   c.upMeter.rate(now),
+				Peers:    c.numConns(),
+			})
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitEvent reads events until match accepts one.
+func waitEvent(t *testing.T, events <-chan Event, match func(Event) bool) Event {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatal("event channel closed")
+			}
+			if match(ev) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
+
+func TestEventBusNeverBlocks(t *testing.T) {
+	var b eventBus
+	events, unsubscribe := b.subscribe()
+
+	// Nobody reads yet: publishing must not wait for the subscriber.
+	for i := 0; i < 1000; i++ {
+		b.publish(PieceVerified{Index: i})
+	}
+	for i := 0; i < 1000; i++ {
+		if ev := <-events; ev.(PieceVerified).Index != i {
+			t.Fatalf("event %d is %v", i, ev)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe() // Harmless
+	if _, ok := <-events; ok {
+		t.Error("channel still open after unsubscribe")
+	}
+	b.publish(Completed{}) // No subscribers left
+}
+
+func TestEventQueueMergesRates(t *testing.T) {
+	var s subscriber
+	for i := 0; i < 10; i++ {
+		s.push(PieceVerified{Index: i})
+		s.push(Rates{Peers: i})
+		s.push(CheckProgress{Checked: i, Total: 10})
+	}
+	if len(s.queue) != 12 {
+		t.Fatalf("%d events queued, want 12: %v", len(s.queue), s.queue)
+	}
+	for i := 0; i < 10; i++ {
+		if ev, ok := s.queue[i].(PieceVerified); !ok || ev.Index != i {
+			t.Fatalf("event %d is %v, want PieceVerified %d", i, s.queue[i], i)
+		}
+	}
+	if ev, ok := s.queue[10].(Rates); !ok || ev.Peers != 9 {
+		t.Errorf("event 10 is %v, want the last Rates", s.queue[10])
+	}
+	if ev, ok := s.queue[11].(CheckProgress); !ok || ev.Checked != 9 {
+		t.Errorf("event 11 is %v, want the last CheckProgress", s.queue[11])
+	}
+}
+
+func TestEventBusDropsLaggingSubscriber(t *testing.T) {
+	var b eventBus
+	events, unsubscribe := b.subscribe()
+	defer unsubscribe()
+
+	// One more than the queue holds, plus the one pump is holding.
+	for i := 0; i < maxQueuedEvents+2; i++ {
+		b.publish(PieceVerified{Index: i})
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	if n > maxQueuedEvents+1 {
+		t.Errorf("received %d events, want at most %d", n, maxQueuedEvents+1)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) != 0 {
+		t.Error("lagging subscriber still registered")
+	}
+}
+
+func TestDownloadEvents(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	out := filepath.Join(t.TempDir(), "leech.bin")
+	c, err := NewClient(spec, ClientParams{OutputPath: out, Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	if err := c.Download(context.Background()); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	c.Stop()
+
+	var (
+		announced, connected bool
+		verified             []int
+		states               []ClientState
+	)
+	waitEvent(t, events, func(ev Event) bool {
+		switch ev := ev.(type) {
+		case TrackerAnnounced:
+			if ev.Err == nil && ev.Peers == 1 {
+				announced = true
+			}
+		case PeerConnected:
+			connected = true
+		case PieceVerified:
+			verified = append(verified, ev.Index)
+			if ev.Done != len(verified) || ev.Total != c.numPieces() {
+				t.Errorf("PieceVerified progress %d/%d after %d pieces", ev.Done, ev.Total, len(verified))
+			}
+		case Completed:
+			if len(verified) != c.numPieces() {
+				t.Errorf("Completed after %d of %d pieces", len(verified), c.numPieces())
+			}
+		case StateChanged:
+			states = append(states, ev.State)
+			return ev.State == StateStopped
+		}
+		return false
+	})
+
+	if !announced || !connected {
+		t.Errorf("announced = %v, connected = %v, want both", announced, connected)
+	}
+	if len(verified) != c.numPieces() {
+		t.Errorf("got %d PieceVerified events, want %d", len(verified), c.numPieces())
+	}
+	if len(states) != 2 || states[0] != StateRunning {
+		t.Errorf("state changes = %v, want [running stopped]", states)
+	}
+}
+
+func TestSequentialDownload(t *testing.T) {
+	data := testData(12*blockSize + 100)
+	spec := newTestSpec(data, blockSize)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	out := filepath.Join(t.TempDir(), "leech.bin")
+	c, err := NewClient(spec, ClientParams{OutputPath: out, Listener: l, Sequential: true})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	// The last piece is needed first, e.g. for a media index.
+	c.SetPieceDeadline(c.numPieces()-1, time.Now().Add(time.Second))
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	defer c.Stop()
+	if err := c.Download(context.Background()); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	var order []int
+	waitEvent(t, events, func(ev Event) bool {
+		if v, ok := ev.(PieceVerified); ok {
+			order = append(order, v.Index)
+		}
+		_, ok := ev.(Completed)
+		return ok
+	})
+	// One peer answers in order, so pieces complete in the order requested.
+	want := []int{c.numPieces() - 1}
+	for i := 0; i < c.numPieces()-1; i++ {
+		want = append(want, i)
+	}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("pieces verified in order %v, want %v", order, want)
+	}
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// Files are downloaded by priority. A piece gets the highest priority of
+// the files it overlaps, so a piece shared by a skipped file and a wanted
+// one is still downloaded; storage keeps the skipped file's share of it
+// in the part file. Only wanted pieces count towards completion.
+
+// filePath returns where file i goes when the torrent is stored at path:
+// path itself for a single-file torrent, else a path inside the path
+// directory. The names in a torrent are sanitized first, see
+// storage.SanitizeName.
+func (c *Client) filePath(path string, i int) string {
+	if !c.Spec.Info.IsMultiFile() {
+		return path
+	}
+	return filepath.Join(path, c.paths[i])
+}
+
+// partPath is where storage keeps the bytes of skipped files.
+func partPath(path string) string {
+	return path + ".parts"
+}
+
+// layout describes the torrent where it is stored to the storage backend.
+func (c *Client) layout() storage.Layout {
+	return c.layoutAt(c.StoragePath())
+}
+
+// layoutAt describes the torrent as if it was stored at path. Its files
+// must stay in the torrent's directory, or that of a single file.
+func (c *Client) layoutAt(path string) storage.Layout {
+	root := path
+	if !c.Spec.Info.IsMultiFile() {
+		root = filepath.Dir(path)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := make([]storage.File, len(c.files))
+	for i, f := range c.files {
+		files[i] = storage.File{
+			Path:   c.filePath(path, i),
+			Length: f.Length,
+			Skip:   c.filePrio[i] == piece.PrioritySkip,
+		}
+	}
+	return storage.Layout{
+		InfoHash:    c.InfoHash,
+		PieceLength: c.Spec.Info.PieceLength,
+		Files:       files,
+		PartPath:    partPath(path),
+		Root:        root,
+	}
+}
+
+// openStorage opens the torrent's storage. Skipped files that don't
+// exist yet aren't created, if the backend can skip files.
+func (c *Client) openStorage() (storage.Torrent, error) {
+	return c.Params.Storage.Open(c.layout())
+}
+
+// hasStoredData reports whether storage may hold data from earlier, which
+// is worth checking if there is no resume data. Only backends that can
+// tell, like files, are trusted to say no.
+func (c *Client) hasStoredData() bool {
+	st, ok := c.Params.Storage.(storage.Statter)
+	if !ok {
+		return true
+	}
+	for _, f := range st.Stat(c.layout()) {
+		if f.Length >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// markStoredComplete tells storage about the pieces found complete when
+// opening it, from resume data or a check. Backends only hear of pieces
+// written in this run otherwise.
+func (c *Client) markStoredComplete() error {
+	have, _ := c.bitfield()
+	for i := 0; i < c.numPieces(); i++ {
+		if !have.HasPiece(i) {
+			continue
+		}
+		if err := c.store.MarkComplete(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFilePriority changes the priority of file index of
+// Spec.Info.FileList(). Files that are no longer skipped are created
+// right away if the client is started and the backend skips files.
+func (c *Client) SetFilePriority(index int, prio piece.Priority) error {
+	if index < 0 || index >= len(c.files) {
+		return fmt.Errorf("engine: no file %d", index)
+	}
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if skipper, ok := c.store.(storage.FileSkipper); ok && c.state != StateStopped {
+		if err := skipper.SetSkip(index, prio == piece.PrioritySkip); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.filePrio[index] = prio
+	c.mu.Unlock()
+	c.applyPriorities()
+	return nil
+}
+
+// FilePriorities returns the priority of every file, in FileList order.
+func (c *Client) FilePriorities() []piece.Priority {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]piece.Priority(nil), c.filePrio...)
+}
+
+// isWanted reports whether piece index belongs to a file that isn't skipped.
+func (c *Client) isWanted(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wanted.HasPiece(index)
+}
+
+// applyPriorities derives piece priorities and the wanted pieces from the
+// file priorities. Peers catch up on what we want on their next tick.
+func (c *Client) applyPriorities() {
+	pieceLength := c.Spec.Info.PieceLength
+	prios := make([]piece.Priority, c.numPieces())
+	for i := range prios {
+		prios[i] = piece.PrioritySkip
+	}
+
+	c.mu.Lock()
+	for i, f := range c.files {
+		if f.Length == 0 {
+			continue
+		}
+		first, last := int(f.Offset/pieceLength), int((f.Offset+f.Length-1)/pieceLength)
+		for p := first; p <= last; p++ {
+			prios[p] = max(prios[p], c.filePrio[i])
+		}
+	}
+	wanted := make(piece.Bitfield, len(c.have))
+	for i, prio := range prios {
+		c.picker.SetPriority(i, prio)
+		if prio != piece.PrioritySkip {
+			wanted.SetPiece(i)
+		}
+	}
+	c.wanted = wanted
+	completed := c.updateDone()
+	c.mu.Unlock()
+
+	if completed {
+		c.completed()
+	}
+}
+
+// updateDone closes done once every wanted piece is verified, and
+// replaces it when that stops being true. It reports whether it closed
+// done. c.mu must be held.
+func (c *Client) updateDone() bool {
+	var closed bool
+	select {
+	case <-c.done:
+		closed = true
+	default:
+	}
+
+	switch complete := c.complete(); {
+	case complete && !closed:
+		c.undone = make(chan struct{})
+		close(c.done)
+		return true
+	case !complete && closed:
+		c.done = make(chan struct{}) // Not complete anymore
+		close(c.undone)
+	}
+	return false
+}
+
+// completion reports whether the torrent is complete, and returns a
+// channel closed once that changes.
+func (c *Client) completion() (bool, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return true, c.undone
+	default:
+		return false, c.done
+	}
+}
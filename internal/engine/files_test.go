@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/bencode"
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/storage"
+	"github.com/Minesto23/peerwire/internal/torrent"
+)
+
+// newMultiFileSpec builds a torrent over data, split into files of the
+// given lengths named f0, f1 and so on, in a subdirectory for the last.
+func newMultiFileSpec(data []byte, pieceLength int, lengths ...int64) *torrent.TorrentSpec {
+	spec := newTestSpec(data, pieceLength)
+	spec.Info.Name = "test"
+	for i, length := range lengths {
+		path := []string{"f" + string(rune('0'+i))}
+		if i == len(lengths)-1 {
+			path = append([]string{"sub"}, path...)
+		}
+		spec.Info.Files = append(spec.Info.Files, torrent.FileInfo{Length: length, Path: path})
+	}
+	spec.InfoHash = sha1.Sum(append([]byte(spec.Info.Pieces), byte(len(lengths))))
+	return spec
+}
+
+// writeContent lays data out on disk at out the way spec wants it.
+func writeContent(t *testing.T, spec *torrent.TorrentSpec, out string, data []byte) {
+	t.Helper()
+	if !spec.Info.IsMultiFile() {
+		if err := os.WriteFile(out, data, 0666); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		return
+	}
+	for _, f := range spec.Info.FileList() {
+		path := filepath.Join(out, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(path, data[f.Offset:f.Offset+f.Length], 0666); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+}
+
+func TestSkippedFileNotDownloaded(t *testing.T) {
+	// Pieces of two blocks: piece 2 lies within f1 alone, pieces 1 and 3
+	// straddle it and the files around it.
+	data := testData(8*blockSize + 100)
+	spec := newMultiFileSpec(data, 2*blockSize, 3*blockSize, 4*blockSize, blockSize+100)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	out := filepath.Join(t.TempDir(), "test")
+	c, err := NewClient(spec, ClientParams{
+		OutputPath:     out,
+		Listener:       l,
+		FilePriorities: []piece.Priority{piece.PriorityNormal, piece.PrioritySkip, piece.PriorityHigh},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c.Download(ctx); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	if done, total := c.Progress(); done != 4 || total != 4 {
+		t.Errorf("Progress() = %d/%d, want 4/4", done, total)
+	}
+	if c.hasPiece(2) {
+		t.Error("piece 2 of the skipped file was downloaded")
+	}
+	if _, err := os.Stat(filepath.Join(out, "f1")); !os.IsNotExist(err) {
+		t.Errorf("skipped file was created: %v", err)
+	}
+	files := spec.Info.FileList()
+	for _, i := range []int{0, 2} {
+		f := files[i]
+		got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(f.Path)))
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if !bytes.Equal(got, data[f.Offset:f.Offset+f.Length]) {
+			t.Errorf("%s does not match", f.Path)
+		}
+	}
+
+	// Wanting the file after all creates it from the part file, and the
+	// download picks up the rest.
+	if err := c.SetFilePriority(1, piece.PriorityNormal); err != nil {
+		t.Fatalf("SetFilePriority() error = %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(20 * time.Second):
+		t.Fatal("download of the formerly skipped file did not finish")
+	}
+	got, err := os.ReadFile(filepath.Join(out, "f1"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if f := files[1]; !bytes.Equal(got, data[f.Offset:f.Offset+f.Length]) {
+		t.Error("f1 does not match")
+	}
+	if _, err := os.Stat(partPath(c.StoragePath())); !os.IsNotExist(err) {
+		t.Errorf("part file left behind: %v", err)
+	}
+}
+
+func TestFilePrioritiesValidated(t *testing.T) {
+	data := testData(2 * blockSize)
+	spec := newMultiFileSpec(data, blockSize, blockSize, blockSize)
+	_, err := NewClient(spec, ClientParams{FilePriorities: []piece.Priority{piece.PriorityHigh}})
+	if err == nil {
+		t.Error("NewClient accepted one priority for two files")
+	}
+}
+
+func TestCheckedFilesLosePartSuffix(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newMultiFileSpec(data, 2*blockSize, 4*blockSize, blockSize+100)
+	out := filepath.Join(t.TempDir(), "test")
+	writeContent(t, spec, out, data)
+
+	// f0 is complete, sub/f1 is missing a piece; both are left unfinished.
+	f0, f1 := filepath.Join(out, "f0"), filepath.Join(out, "sub", "f1")
+	os.WriteFile(f1, make([]byte, blockSize+100), 0666)
+	for _, path := range []string{f0, f1} {
+		if err := os.Rename(path, path+".part"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClient(spec, ClientParams{
+		OutputPath: out,
+		Storage:    storage.FileBackend{PartSuffix: true},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := c.Recheck(); err != nil {
+		t.Fatalf("Recheck() error = %v", err)
+	}
+	if _, err := os.Stat(f0); err != nil {
+		t.Errorf("complete file not renamed: %v", err)
+	}
+	if _, err := os.Stat(f1 + ".part"); err != nil {
+		t.Errorf("incomplete file lost its suffix: %v", err)
+	}
+}
+
+func TestHostileFileNames(t *testing.T) {
+	// Names meant to escape the download directory or trip up a
+	// filesystem. Parse already refuses ".." and "/" in paths, though not
+	// in the name.
+	hostile := [][]string{
+		{"etc:", "pass*wd"},
+		{`..\..\evil.exe`},
+		{"C:", "Windows", "evil"},
+		{"CON"},
+		{"bad\xffname"},
+		{strings.Repeat("a", 300) + ".txt"},
+	}
+	var files []interface{}
+	for _, path := range hostile {
+		elems := make([]interface{}, len(path))
+		for i, e := range path {
+			elems[i] = e
+		}
+		files = append(files, map[string]interface{}{"length": int64(1), "path": elems})
+	}
+	raw, err := bencode.Marshal(map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info": map[string]interface{}{
+			"name":         "../../escape",
+			"piece length": int64(blockSize),
+			"pieces":       string(make([]byte, 20)),
+			"files":        files,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := torrent.Parse(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	name, err := storage.SanitizeName(spec.Info.Name)
+	if err != nil {
+		t.Fatalf("SanitizeName() error = %v", err)
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, name)
+	c, err := NewClient(spec, ClientParams{OutputPath: out})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	layout := c.layout()
+	for _, f := range layout.Files {
+		rel, err := filepath.Rel(out, f.Path)
+		if err != nil || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			t.Errorf("file %s is outside %s", f.Path, out)
+		}
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			if len(elem) > storage.MaxNameLength || strings.ContainsAny(elem, `\:`) {
+				t.Errorf("file name %q left unsanitized", elem)
+			}
+		}
+	}
+
+	store, err := c.openStorage()
+	if err != nil {
+		t.Fatalf("openStorage() error = %v", err)
+	}
+	store.Close()
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != name {
+		t.Errorf("files created outside the torrent directory: %v", entries)
+	}
+}
+
+func TestHostilePieces(t *testing.T) {
+	// Piece lengths and hash counts that don't add up would have the
+	// client index past its hashes or divide by zero.
+	hash := string(make([]byte, 20))
+	for _, tt := range []struct {
+		name        string
+		pieceLength int64
+		pieces      string
+		lengths     []int64
+	}{
+		{"too few hashes", 16, hash, []int64{10, 100}},
+		{"too many hashes", blockSize, hash + hash + hash, []int64{10, 100}},
+		{"zero piece length", 0, hash, []int64{10, 100}},
+		{"negative piece length", -blockSize, hash, []int64{10}},
+		{"partial hash", blockSize, hash[:13], []int64{10}},
+		{"huge file", blockSize, hash, []int64{10, 1 << 62, 1 << 62}},
+		{"negative file", blockSize, hash, []int64{100, -90}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []interface{}
+			var specFiles []torrent.FileInfo
+			var length int64
+			for i, l := range tt.lengths {
+				name := fmt.Sprintf("f%d", i)
+				files = append(files, map[string]interface{}{"length": l, "path": []interface{}{name}})
+				specFiles = append(specFiles, torrent.FileInfo{Length: l, Path: []string{name}})
+				length += l
+			}
+			raw, err := bencode.Marshal(map[string]interface{}{
+				"announce": "http://tracker.invalid/announce",
+				"info": map[string]interface{}{
+					"name":         "hostile",
+					"piece length": tt.pieceLength,
+					"pieces":       tt.pieces,
+					"files":        files,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := torrent.Parse(bytes.NewReader(raw)); err == nil {
+				t.Error("Parse() succeeded")
+			}
+
+			spec := &torrent.TorrentSpec{Info: torrent.InfoDictionary{
+				Name:        "hostile",
+				PieceLength: tt.pieceLength,
+				Pieces:      tt.pieces,
+				Length:      length,
+				Files:       specFiles,
+			}}
+			if _, err := NewClient(spec, ClientParams{OutputPath: t.TempDir()}); err == nil {
+				t.Error("NewClient() succeeded")
+			}
+		})
+	}
+}
+
+func TestCollidingFileNamesRejected(t *testing.T) {
+	data := testData(2 * blockSize)
+	spec := newMultiFileSpec(data, blockSize, blockSize, blockSize)
+	spec.Info.Files[0].Path = []string{"sub", "f1."} // Same as sub/f1 on Windows
+	if _, err := NewClient(spec, ClientParams{OutputPath: t.TempDir()}); !errors.Is(err, storage.ErrUnsafePath) {
+		t.Errorf("NewClient() error = %v, want ErrUnsafePath", err)
+	}
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/ratelimit"
+)
+
+// How often scheduled rate limits are re-evaluated.
+const rateScheduleInterval = 30 * time.Second
+
+// rateLimits is one level of rate limiting (a torrent or the session):
+// normal limits, an optional schedule of alternative ones and the pair of
+// limiters enforcing whichever is in effect.
+type rateLimits struct {
+	down, up *ratelimit.Limiter
+
+	mu       sync.Mutex
+	normal   ratelimit.Rates
+	schedule ratelimit.Schedule
+}
+
+func newRateLimits(normal ratelimit.Rates, schedule ratelimit.Schedule) *rateLimits {
+	r := &rateLimits{
+		down:     ratelimit.NewLimiter(0),
+		up:       ratelimit.NewLimiter(0),
+		normal:   normal,
+		schedule: schedule,
+	}
+	r.apply(time.Now())
+	return r
+}
+
+func (r *rateLimits) get() (ratelimit.Rates, ratelimit.Schedule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.normal, r.schedule
+}
+
+func (r *rateLimits) set(normal ratelimit.Rates) {
+	r.mu.Lock()
+	r.normal = normal
+	r.mu.Unlock()
+	r.apply(time.Now())
+}
+
+func (r *rateLimits) setSchedule(s ratelimit.Schedule) {
+	r.mu.Lock()
+	r.schedule = s
+	r.mu.Unlock()
+	r.apply(time.Now())
+}
+
+// apply sets the limiters to the limits in effect at now.
+func (r *rateLimits) apply(now time.Time) {
+	normal, schedule := r.get()
+	rates := schedule.Limits(normal, now)
+	r.down.SetRate(rates.Download)
+	r.up.SetRate(rates.Upload)
+}
+
+// run follows the schedule until quit is closed.
+func (r *rateLimits) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(rateScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.apply(now)
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/peer"
+)
+
+// ListenerParams configures a Listener.
+type ListenerParams struct {
+	// Port to listen on. 0 lets the OS pick a free port.
+	Port int
+	// MaxConns caps the connections of all registered torrents together,
+	// inbound and outbound. 0 means 200.
+	MaxConns int
+}
+
+// Listener accepts inbound peer connections and routes each one to the
+// registered torrent matching the handshake's info hash, so several torrents
+// can share one port.
+type Listener struct {
+	ln       net.Listener
+	maxConns int
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Client
+	pending  map[net.Conn]struct{} // still handshaking
+	closed   bool
+	wg       sync.WaitGroup // handle goroutines
+}
+
+// NewListener starts listening on params.Port. Call Serve to accept connections.
+func NewListener(params ListenerParams) (*Listener, error) {
+	if params.MaxConns == 0 {
+		params.MaxConns = 200
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", params.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{
+		ln:       ln,
+		maxConns: params.MaxConns,
+		torrents: make(map[[20]byte]*Client),
+		pending:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Port returns the port actually listened on.
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Register routes connections for c's info hash to c.
+func (l *Listener) Register(c *Client) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.torrents[c.InfoHash]; ok {
+		return fmt.Errorf("torrent %x is already registered", c.InfoHash)
+	}
+	l.torrents[c.InfoHash] = c
+	return nil
+}
+
+// Unregister stops routing connections to c.
+func (l *Listener) Unregister(c *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.torrents[c.InfoHash] == c {
+		delete(l.torrents, c.InfoHash)
+	}
+}
+
+// Serve accepts connections until the listener is closed.
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		l.pending[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go func() {
+			defer l.wg.Done()
+			l.handle(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, drops those still handshaking and
+// waits for every handler to return. Connections already handed to a
+// torrent last until the torrent stops, so stop registered torrents first.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	err := l.ln.Close()
+	for conn := range l.pending {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+// handOff takes conn out of the handshaking set. It fails if the
+// listener was closed in the meantime.
+func (l *Listener) handOff(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, conn)
+	return !l.closed
+}
+
+func (l *Listener) lookup(infoHash [20]byte) *Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[infoHash]
+}
+
+// hasCapacity reports whether the global connection limit allows one more.
+func (l *Listener) hasCapacity() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := 0
+	for _, c := range l.torrents {
+		total += c.numConns()
+	}
+	return total < l.maxConns
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	defer conn.Close()
+	defer l.handOff(conn)
+
+	if !l.hasCapacity() {
+		return
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return
+	}
+
+	h, err := peer.ReadHandshake(conn)
+	if err != nil {
+		return
+	}
+
+	c := l.lookup(h.InfoHash)
+	if c == nil {
+		return // Not a torrent we serve
+	}
+	if !c.acceptsPeer(h.PeerID) || c.isBanned(conn.RemoteAddr().String()) {
+		return
+	}
+
+	reply := peer.NewHandshake(c.InfoHash, c.PeerID)
+	if err := reply.Write(conn); err != nil {
+		return
+	}
+
+	if !l.handOff(conn) {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c.runConn(conn, conn.RemoteAddr().String(), h.PeerID, true)
+}
@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// LocatedFile is a file of the torrent that Locate found on disk.
+type LocatedFile struct {
+	Index  int    // in Spec.Info.FileList()
+	Source string // where it was found
+	Mode   storage.LinkMode
+}
+
+// Locate looks in dirs for files of a stopped torrent that are on disk
+// already, say as part of another torrent, so they needn't be downloaded.
+// Files of the right size are candidates, those of the right name first.
+// A candidate is taken once the pieces it holds match their hashes; pieces
+// shared with other files are checked with the candidates taken for those.
+// What is found is put in place with mode, never over an existing file,
+// and the torrent is then checked like Recheck does, so it starts with
+// every piece found.
+//
+// Only files whose every piece matched are linked: pieces of the others
+// are downloaded later, and writing them through a link would change the
+// source too. Those are copied instead, under the name the backend gives
+// incomplete files.
+func (c *Client) Locate(dirs []string, mode storage.LinkMode) ([]LocatedFile, error) {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if c.state != StateStopped {
+		return nil, errors.New("engine: can only locate files of a stopped torrent")
+	}
+	st, ok := c.Params.Storage.(storage.Statter)
+	if _, moves := c.Params.Storage.(storage.Mover); !ok || !moves {
+		return nil, errors.New("engine: storage doesn't keep files")
+	}
+	layout := c.layout()
+	if err := layout.CheckRoot(); err != nil {
+		return nil, err
+	}
+
+	// Files on disk already aren't looked for, but help check the pieces
+	// they share with the others.
+	sources := make([]string, len(c.files))
+	needed := make(map[int64]bool)
+	for i, state := range st.Stat(layout) {
+		if i >= len(layout.Files) {
+			break // The part file, which holds no whole file
+		}
+		f := layout.Files[i]
+		if state.Length == f.Length {
+			sources[i] = state.Path
+		} else if !f.Skip && f.Length > 0 {
+			needed[f.Length] = true
+		}
+	}
+	bySize := findFiles(dirs, needed)
+
+	var found []LocatedFile
+	verified := make(map[int]bool) // pieces matched with the files found
+	for progress := true; progress; {
+		progress = false
+		for i, f := range layout.Files {
+			if sources[i] != "" || f.Skip {
+				continue
+			}
+			for _, cand := range c.candidates(i, bySize[f.Length]) {
+				if checked := c.matches(i, cand, sources); checked != nil {
+					sources[i] = cand
+					for _, p := range checked {
+						verified[p] = true
+					}
+					found = append(found, LocatedFile{Index: i, Source: cand, Mode: mode})
+					progress = true
+					break
+				}
+			}
+		}
+	}
+
+	for n, lf := range found {
+		to, linkMode := layout.Files[lf.Index].Path, mode
+		if !c.allVerified(lf.Index, verified) {
+			linkMode = storage.LinkCopy
+			if namer, ok := c.Params.Storage.(storage.IncompleteNamer); ok {
+				to = namer.IncompletePath(layout.Files[lf.Index])
+			}
+		}
+		used, err := storage.LinkFile(lf.Source, to, linkMode)
+		if err != nil {
+			return found[:n], err
+		}
+		found[n].Mode = used
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found, c.checkStopped()
+}
+
+// findFiles lists the regular files in dirs, recursively, that have one
+// of the sizes wanted.
+func findFiles(dirs []string, sizes map[int64]bool) map[int64][]string {
+	bySize := make(map[int64][]string)
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil // Unreadable, or not a plain file
+			}
+			if fi, err := d.Info(); err == nil && sizes[fi.Size()] {
+				bySize[fi.Size()] = append(bySize[fi.Size()], p)
+			}
+			return nil
+		})
+	}
+	return bySize
+}
+
+// candidates orders paths so those named like file i come first.
+func (c *Client) candidates(i int, paths []string) []string {
+	name := path.Base(c.files[i].Path)
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return filepath.Base(sorted[a]) == name && filepath.Base(sorted[b]) != name
+	})
+	return sorted
+}
+
+// filePieces returns the first and last piece holding data of file i.
+func (c *Client) filePieces(i int) (first, last int) {
+	f := c.files[i]
+	pieceLength := c.Spec.Info.PieceLength
+	return int(f.Offset / pieceLength), int((f.Offset + f.Length - 1) / pieceLength)
+}
+
+// matches checks the pieces of file i as if it were cand. Pieces shared
+// with files that have no source yet can't be checked. If any piece could
+// be checked, and all of those matched, it returns the pieces checked;
+// otherwise nil.
+func (c *Client) matches(i int, cand string, sources []string) []int {
+	first, last := c.filePieces(i)
+	var checked []int
+	for p := first; p <= last; p++ {
+		buf, ok, err := c.assemble(p, i, cand, sources)
+		if err != nil {
+			return nil
+		}
+		if !ok {
+			continue
+		}
+		if !checkIntegrity(c.newWork(p), buf) {
+			return nil
+		}
+		checked = append(checked, p)
+	}
+	return checked
+}
+
+// allVerified reports whether every piece of file i is in verified.
+func (c *Client) allVerified(i int, verified map[int]bool) bool {
+	first, last := c.filePieces(i)
+	for p := first; p <= last; p++ {
+		if !verified[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// assemble reads piece index from the sources of the files it spans,
+// taking cand for file i. It returns false if a file has no source.
+func (c *Client) assemble(index, i int, cand string, sources []string) ([]byte, bool, error) {
+	start := int64(index) * c.Spec.Info.PieceLength
+	buf := make([]byte, c.pieceLength(index))
+	end := start + int64(len(buf))
+	for j, f := range c.files {
+		from, to := max(start, f.Offset), min(end, f.Offset+f.Length)
+		if from >= to {
+			continue
+		}
+		src := sources[j]
+		if j == i {
+			src = cand
+		}
+		if src == "" {
+			return nil, false, nil
+		}
+		if err := readFileAt(src, buf[from-start:to-start], from-f.Offset); err != nil {
+			return nil, false, err
+		}
+	}
+	return buf, true, nil
+}
+
+func readFileAt(name string, buf []byte, off int64) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, off)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
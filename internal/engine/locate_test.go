@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// putFile writes data to dir/name, creating directories as needed.
+func putFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocateFindsFilesElsewhere(t *testing.T) {
+	// Pieces of two blocks: f1 is too small for a piece of its own, so it
+	// can only be checked along with f0 and sub/f2.
+	data := testData(5*blockSize + 100)
+	spec := newMultiFileSpec(data, 2*blockSize, 3*blockSize, 100, 2*blockSize)
+	f0, f1, f2 := data[:3*blockSize], data[3*blockSize:3*blockSize+100], data[3*blockSize+100:]
+
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	want := []string{
+		putFile(t, dir1, "renamed.bin", f0),
+		putFile(t, dir2, "b/f1", f1),
+		putFile(t, dir2, "other", f2),
+	}
+	// Decoys of the right size and name, but not the right data.
+	putFile(t, dir1, "a/f1", make([]byte, 100))
+	putFile(t, dir1, "f2", make([]byte, len(f2)))
+
+	out := filepath.Join(t.TempDir(), "test")
+	c, err := NewClient(spec, ClientParams{OutputPath: out})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	found, err := c.Locate([]string{dir1, dir2}, storage.LinkHard)
+	if err != nil {
+		t.Fatalf("Locate() error = %v", err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("Locate() found %d files, want 3: %+v", len(found), found)
+	}
+	for _, lf := range found {
+		if lf.Source != want[lf.Index] {
+			t.Errorf("file %d found at %s, want %s", lf.Index, lf.Source, want[lf.Index])
+		}
+		src, _ := os.Stat(lf.Source)
+		dst, err := os.Stat(c.layout().Files[lf.Index].Path)
+		if err != nil || (lf.Mode == storage.LinkHard && !os.SameFile(src, dst)) {
+			t.Errorf("file %d not linked into place (%v, mode %v)", lf.Index, err, lf.Mode)
+		}
+	}
+	if done, total := c.Progress(); done != total {
+		t.Errorf("Progress() = %d/%d after locating every file", done, total)
+	}
+	if c.loadResume() == nil {
+		t.Error("no resume data saved after locating")
+	}
+}
+
+func TestLocateCopiesPartlyCheckedFiles(t *testing.T) {
+	// Only f0 is found, and its last piece is shared with files that
+	// aren't: linking it would let their download write into the source.
+	data := testData(5*blockSize + 100)
+	spec := newMultiFileSpec(data, 2*blockSize, 3*blockSize, 100, 2*blockSize)
+	src := putFile(t, t.TempDir(), "f0", data[:3*blockSize])
+
+	backend := storage.FileBackend{PartSuffix: true}
+	c, err := NewClient(spec, ClientParams{OutputPath: filepath.Join(t.TempDir(), "test"), Storage: backend})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	found, err := c.Locate([]string{filepath.Dir(src)}, storage.LinkHard)
+	if err != nil {
+		t.Fatalf("Locate() error = %v", err)
+	}
+	if len(found) != 1 || found[0].Mode != storage.LinkCopy {
+		t.Fatalf("Locate() = %+v, want f0 copied", found)
+	}
+	f0 := c.layout().Files[0]
+	srcInfo, _ := os.Stat(src)
+	dst, err := os.Stat(backend.IncompletePath(f0))
+	if err != nil {
+		t.Fatalf("copy not kept as an incomplete file: %v", err)
+	}
+	if os.SameFile(srcInfo, dst) {
+		t.Error("partly checked file linked to its source")
+	}
+	if _, err := os.Stat(f0.Path); err == nil {
+		t.Error("partly checked file put under its final name")
+	}
+}
+
+func TestLocatePartial(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newMultiFileSpec(data, 2*blockSize, 3*blockSize, 100, 2*blockSize)
+	dir := t.TempDir()
+	putFile(t, dir, "f0", data[:3*blockSize])
+
+	c, err := NewClient(spec, ClientParams{OutputPath: filepath.Join(t.TempDir(), "test")})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	found, err := c.Locate([]string{dir}, storage.LinkCopy)
+	if err != nil {
+		t.Fatalf("Locate() error = %v", err)
+	}
+	if len(found) != 1 || found[0].Index != 0 || found[0].Mode != storage.LinkCopy {
+		t.Fatalf("Locate() = %+v, want f0 copied", found)
+	}
+	// Piece 0 lies in f0 alone; piece 1 needs the others too.
+	if done, _ := c.Progress(); done != 1 {
+		t.Errorf("%d pieces complete, want 1", done)
+	}
+}
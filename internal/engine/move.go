@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+// StoragePath returns where the torrent's data is: OutputPath, unless it
+// is still in IncompleteDir or was moved with MoveStorage.
+func (c *Client) StoragePath() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.path
+}
+
+// incompletePath is where the torrent is downloaded to with an
+// IncompleteDir.
+func (c *Client) incompletePath() string {
+	return filepath.Join(c.Params.IncompleteDir, filepath.Base(c.Params.OutputPath))
+}
+
+// MoveStorage moves the torrent's data and resume data to newPath, which
+// takes the place of OutputPath: a file for a single-file torrent, a
+// directory for a multi-file one. Files are renamed if possible, and
+// otherwise copied and read back, such as across filesystems. A running
+// torrent keeps uploading meanwhile; downloaded pieces wait.
+func (c *Client) MoveStorage(newPath string) error {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	return c.moveStorage(newPath)
+}
+
+// moveStorage does the work of MoveStorage. c.lifeMu must be held.
+func (c *Client) moveStorage(newPath string) error {
+	mover, ok := c.Params.Storage.(storage.Mover)
+	if !ok {
+		return errors.New("engine: storage can't be moved")
+	}
+	oldPath := c.StoragePath()
+	switch {
+	case newPath == "":
+		return errors.New("engine: no path to move storage to")
+	case newPath == oldPath:
+		return nil
+	}
+	from, to := c.layoutAt(oldPath), c.layoutAt(newPath)
+
+	if c.state == StateStopped {
+		if err := mover.Move(from, to); err != nil {
+			return err
+		}
+		c.setPath(newPath)
+		if err := moveResume(oldPath, newPath); err != nil {
+			c.events.publish(StorageError{Op: "move", Index: -1, Err: err})
+		}
+	} else {
+		// Peers keep reading from the old storage until the new one
+		// takes over, but nothing may be written meanwhile.
+		c.disk.holdWrites()
+		defer c.disk.releaseWrites()
+		if err := c.store.Flush(); err != nil {
+			return err
+		}
+		if err := mover.Move(from, to); err != nil {
+			return err
+		}
+		store, err := c.Params.Storage.Open(to)
+		if err != nil {
+			// The old storage still works, through open files or the
+			// originals of copies, but the next start looks at newPath.
+			c.setPath(newPath)
+			return err
+		}
+		c.disk.swap(store).Close()
+		c.store = store
+		c.setPath(newPath)
+		c.saveResumeOrReport()
+		if err := os.Remove(resumePath(oldPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.events.publish(StorageError{Op: "move", Index: -1, Err: err})
+		}
+	}
+
+	// Copies leave the originals behind.
+	if err := mover.Remove(from); err != nil {
+		c.events.publish(StorageError{Op: "move", Index: -1, Err: err})
+	}
+	if c.Spec.Info.IsMultiFile() {
+		removeEmptyDirs(oldPath)
+	}
+	c.events.publish(StorageMoved{Path: newPath})
+	return nil
+}
+
+func (c *Client) setPath(path string) {
+	c.mu.Lock()
+	c.path = path
+	c.mu.Unlock()
+}
+
+// moveResume takes the resume file of a stopped torrent along. Copies
+// keep their modification times, so it stays valid.
+func moveResume(oldPath, newPath string) error {
+	data, err := os.ReadFile(resumePath(oldPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0777); err != nil {
+		return err
+	}
+	if err := os.WriteFile(resumePath(newPath), data, 0666); err != nil {
+		return err
+	}
+	return os.Remove(resumePath(oldPath))
+}
+
+// removeEmptyDirs removes dir and the directories in it, as far as they
+// are empty.
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, e.Name()))
+		}
+	}
+	os.Remove(dir) // Fails unless empty
+}
+
+// completed announces that every wanted piece is verified, and has the
+// data moved out of IncompleteDir.
+func (c *Client) completed() {
+	c.events.publish(Completed{})
+	if c.moveDue() {
+		go c.moveWhenComplete()
+	}
+}
+
+// moveDue reports whether the torrent is complete but still in
+// IncompleteDir.
+func (c *Client) moveDue() bool {
+	if c.Params.IncompleteDir == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.complete() && c.path == c.incompletePath()
+}
+
+// moveWhenComplete moves a complete torrent from IncompleteDir to
+// OutputPath. Stop does the same if this doesn't get to run first.
+//
+// A torrent found complete by Start is only moved once Start succeeded:
+// this waits for it, and a stopped torrent is left alone.
+func (c *Client) moveWhenComplete() {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+	if c.state == StateStopped || !c.moveDue() {
+		return // Not started, moved already, or incomplete again
+	}
+	if err := c.moveStorage(c.Params.OutputPath); err != nil {
+		c.events.publish(StorageError{Op: "move", Index: -1, Err: err})
+	}
+}
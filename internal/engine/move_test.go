@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/storage"
+)
+
+func TestMovedOutOfIncompleteDir(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newMultiFileSpec(data, 2*blockSize, 3*blockSize, 2*blockSize+100)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	dir := t.TempDir()
+	incoming, out := filepath.Join(dir, "incoming"), filepath.Join(dir, "done", "test")
+	c, err := NewClient(spec, ClientParams{OutputPath: out, IncompleteDir: incoming, Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	if got := c.StoragePath(); got != filepath.Join(incoming, "test") {
+		t.Fatalf("StoragePath() = %s before downloading, want it in the incomplete dir", got)
+	}
+
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c.Download(ctx); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	for moved := false; !moved; {
+		select {
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case StorageMoved:
+				moved = ev.Path == out
+			case StorageError:
+				t.Fatalf("storage error: %v", ev.Err)
+			}
+		case <-ctx.Done():
+			t.Fatal("storage not moved on completion")
+		}
+	}
+
+	var got []byte
+	for _, f := range spec.Info.FileList() {
+		b, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(f.Path)))
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("moved data does not match")
+	}
+	if entries, _ := os.ReadDir(incoming); len(entries) != 0 {
+		t.Errorf("incomplete dir not emptied: %v", entries)
+	}
+	if _, err := os.Stat(out + ".resume"); err != nil {
+		t.Errorf("resume data not moved along: %v", err)
+	}
+}
+
+func TestMoveStorageWhileSeeding(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+
+	seeder, seedListener := newSeeder(t, spec, data)
+	oldPath := seeder.StoragePath()
+	newPath := filepath.Join(t.TempDir(), "archive", "seed.bin")
+	if err := seeder.MoveStorage(newPath); err != nil {
+		t.Fatalf("MoveStorage() error = %v", err)
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("data left at the old path: %v", err)
+	}
+	if seeder.StoragePath() != newPath {
+		t.Errorf("StoragePath() = %s, want %s", seeder.StoragePath(), newPath)
+	}
+
+	// The seeder goes on seeding from the new place.
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+	out := filepath.Join(t.TempDir(), "leech.bin")
+	c, err := NewClient(spec, ClientParams{OutputPath: out, Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c.Download(ctx); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match")
+	}
+}
+
+func TestMoveStoppedTorrentKeepsResume(t *testing.T) {
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, blockSize)
+	out := filepath.Join(t.TempDir(), "data.bin")
+	writeContent(t, spec, out, data)
+
+	c, err := NewClient(spec, ClientParams{OutputPath: out})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := c.Recheck(); err != nil { // Saves resume data
+		t.Fatalf("Recheck() error = %v", err)
+	}
+	newPath := filepath.Join(t.TempDir(), "data.bin")
+	if err := c.MoveStorage(newPath); err != nil {
+		t.Fatalf("MoveStorage() error = %v", err)
+	}
+
+	c, err = NewClient(spec, ClientParams{OutputPath: newPath})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if c.loadResume() == nil {
+		t.Error("resume data not usable after the move")
+	}
+}
+
+// unmarkableBackend is a FileBackend whose storage fails MarkComplete.
+type unmarkableBackend struct{ storage.FileBackend }
+
+type unmarkableTorrent struct{ storage.Torrent }
+
+func (b unmarkableBackend) Open(layout storage.Layout) (storage.Torrent, error) {
+	t, err := b.FileBackend.Open(layout)
+	return unmarkableTorrent{t}, err
+}
+
+func (unmarkableTorrent) MarkComplete(int) error {
+	return errors.New("MarkComplete failed")
+}
+
+func TestFailedStartDoesntMove(t *testing.T) {
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, blockSize)
+	dir := t.TempDir()
+	incoming, out := filepath.Join(dir, "incoming"), filepath.Join(dir, "done", "data.bin")
+	c, err := NewClient(spec, ClientParams{OutputPath: out, IncompleteDir: incoming, Storage: unmarkableBackend{}})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	// Complete data in the incomplete dir: the check in Start finds it
+	// all, and then Start fails.
+	os.MkdirAll(incoming, 0777)
+	writeContent(t, spec, c.StoragePath(), data)
+	if err := c.Start(); err == nil {
+		c.Stop()
+		t.Fatal("Start() succeeded with failing storage")
+	}
+
+	for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(out); err == nil {
+			t.Fatal("data moved although Start failed")
+		}
+	}
+	if c.StoragePath() == out {
+		t.Error("StoragePath() changed although Start failed")
+	}
+}
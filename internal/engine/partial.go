@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"github.com/Minesto23/peerwire/internal/piece"
+)
+
+// partialPiece is a piece being downloaded. Blocks from any peer land in
+// the same buffer, so in endgame mode several peers can work on one piece
+// and whoever delivers a block first wins.
+// All fields are guarded by Client.mu.
+type partialPiece struct {
+	work     *piece.Work
+	buf      []byte
+	got      []bool
+	from     []string // per block, the IP that sent it, for smart ban
+	received int
+	// requesters lists, per block, the peers with an outstanding request for it.
+	requesters [][]*peerConn
+	owners     map[*peerConn]bool
+	// done is set once the piece is finished (or failed verification); owners
+	// drop it on their next turn.
+	done bool
+}
+
+func newPartialPiece(work *piece.Work) *partialPiece {
+	numBlocks := work.Length / blockSize
+	if work.Length%blockSize != 0 {
+		numBlocks++ // partial block at end
+	}
+	return &partialPiece{
+		work:       work,
+		buf:        make([]byte, work.Length),
+		got:        make([]bool, numBlocks),
+		from:       make([]string, numBlocks),
+		requesters: make([][]*peerConn, numBlocks),
+		owners:     make(map[*peerConn]bool),
+	}
+}
+
+// block returns the wire coordinates of block b.
+func (p *partialPiece) block(b int) blockRequest {
+	begin := b * blockSize
+	length := blockSize
+	if begin+length > p.work.Length {
+		length = p.work.Length - begin
+	}
+	return blockRequest{p.work.Index, begin, length}
+}
+
+func containsPeer(list []*peerConn, pc *peerConn) bool {
+	for _, other := range list {
+		if other == pc {
+			return true
+		}
+	}
+	return false
+}
+
+func removePeer(list []*peerConn, pc *peerConn) []*peerConn {
+	for i, other := range list {
+		if other == pc {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// acquirePiece finds a piece for pc to work on. Normally this is the rarest
+// piece nobody is downloading yet; in endgame mode it is an unfinished piece
+// that other peers are already on.
+func (c *Client) acquirePiece(pc *peerConn, has piece.Bitfield) *partialPiece {
+	if index, ok := c.picker.Pick(has); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// Keep blocks a previous (disconnected) peer already delivered.
+		p := c.partials[index]
+		if p == nil || p.done {
+			p = newPartialPiece(c.newWork(index))
+			c.partials[index] = p
+		}
+		p.owners[pc] = true
+		return p
+	}
+
+	if !c.picker.InEndgame() {
+		return nil // There is work left, just none this peer can do
+	}
+
+	// Endgame: join the unfinished piece with the fewest peers on it.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var best *partialPiece
+	for index, p := range c.partials {
+		if p.done || p.owners[pc] || !has.HasPiece(index) {
+			continue
+		}
+		if best == nil || len(p.owners) < len(best.owners) {
+			best = p
+		}
+	}
+	if best != nil {
+		best.owners[pc] = true
+	}
+	return best
+}
+
+// claimBlocks marks up to max missing blocks of p as requested by pc and
+// returns them. A block is normally requested from one peer only; once
+// several peers share the piece (endgame) duplicates are allowed.
+func (c *Client) claimBlocks(pc *peerConn, p *partialPiece, max int) []blockRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.done {
+		return nil
+	}
+
+	endgame := len(p.owners) > 1
+	var refs []blockRequest
+	for b := range p.got {
+		if len(refs) == max {
+			break
+		}
+		if p.got[b] || containsPeer(p.requesters[b], pc) {
+			continue
+		}
+		if len(p.requesters[b]) > 0 && !endgame {
+			continue
+		}
+		p.requesters[b] = append(p.requesters[b], pc)
+		refs = append(refs, p.block(b))
+	}
+	return refs
+}
+
+// releasePiece detaches pc from p. If nobody else is working on it, the
+// piece goes back to the picker; blocks received so far are kept.
+func (c *Client) releasePiece(pc *peerConn, p *partialPiece) {
+	c.mu.Lock()
+	delete(p.owners, pc)
+	for b := range p.requesters {
+		p.requesters[b] = removePeer(p.requesters[b], pc)
+	}
+	orphaned := len(p.owners) == 0 && !p.done
+	c.mu.Unlock()
+
+	if orphaned {
+		c.picker.Release(p.work.Index)
+	}
+}
+
+// blockReceived stores a block delivered by pc. It returns the peers that
+// requested the same block and should now be sent a Cancel, and whether
+// this block completed the piece. Duplicates are ignored and count as
+// wasted; only stored blocks count as downloaded.
+func (c *Client) blockReceived(pc *peerConn, p *partialPiece, begin int, data []byte) (cancel []*peerConn, complete bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := begin / blockSize
+	if p.done || p.got[b] {
+		// Another peer beat this one to it (endgame).
+		pc.wasted.Add(int64(len(data)))
+		c.wasted.Add(int64(len(data)))
+		return nil, false
+	}
+
+	pc.downloaded.Add(int64(len(data)))
+	c.downloaded.Add(int64(len(data)))
+	copy(p.buf[begin:], data)
+	p.got[b] = true
+	p.from[b] = peerIP(pc.addr)
+	p.received++
+
+	for _, other := range p.requesters[b] {
+		if other != pc {
+			cancel = append(cancel, other)
+		}
+	}
+	p.requesters[b] = nil
+
+	if p.received < len(p.got) {
+		return cancel, false
+	}
+
+	p.done = true
+	delete(c.partials, p.work.Index)
+	return cancel, true
+}
+
+// pieceFinished reports whether p no longer needs work from anyone.
+func (c *Client) pieceFinished(p *partialPiece) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return p.done
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/torrent"
+)
+
+var errReaderClosed = errors.New("reader closed")
+
+// Reader reads one file of a torrent while it downloads. Reads block
+// until the pieces they need are verified, and move those pieces to the
+// front of the queue; the pieces after the read position are fetched in
+// order (see SetReadCursor). With several readers the latest read sets
+// the cursor.
+//
+// Reader implements io.ReadSeeker and io.ReaderAt, so it can be handed to
+// http.ServeContent to serve range requests for a download in progress.
+type Reader struct {
+	c    *Client
+	file torrent.File
+
+	mu  sync.Mutex
+	pos int64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReader returns a reader for f, one of c.Spec.Info.FileList(). Reads
+// fail with ErrStopped while the client is stopped.
+func (c *Client) NewReader(f torrent.File) *Reader {
+	return &Reader{c: c, file: f, closed: make(chan struct{})}
+}
+
+// Read reads from the current position. It returns as soon as the piece
+// at the position is available, so it may return less than len(p).
+// It waits without holding the position, so Seek and Close don't wait
+// for it; a Seek meanwhile wins over the read's advance.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+
+	if pos >= r.file.Length {
+		return 0, io.EOF
+	}
+	// Up to the end of the current piece only: don't wait for the next
+	// piece when there is something to return already.
+	abs := r.file.Offset + pos
+	pieceEnd := (abs/r.c.Spec.Info.PieceLength + 1) * r.c.Spec.Info.PieceLength
+	if left := pieceEnd - abs; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	r.c.SetReadCursor(r.c.pieceAt(abs))
+	n, err := r.ReadAt(p, pos)
+	r.mu.Lock()
+	if r.pos == pos {
+		r.pos += int64(n)
+	}
+	r.mu.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position for the next Read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		return 0, errors.New("engine: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("engine: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes at off, waiting for every piece they span.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("engine: negative offset")
+	}
+	if off >= r.file.Length {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := r.file.Length - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+
+	n := 0
+	pieceLength := r.c.Spec.Info.PieceLength
+	for n < len(p) {
+		abs := r.file.Offset + off + int64(n)
+		index := r.c.pieceAt(abs)
+		chunk := p[n:]
+		if end := int64(index+1) * pieceLength; abs+int64(len(chunk)) > end {
+			chunk = chunk[:end-abs]
+		}
+
+		if err := r.waitPiece(index); err != nil {
+			return n, err
+		}
+		if err := r.c.readData(abs, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, eof
+}
+
+// Close ends blocked reads with an error and clears the read cursor, so
+// the download goes back to rarest first until another Reader reads.
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.c.SetReadCursor(-1)
+	})
+	return nil
+}
+
+// waitPiece blocks until piece index is verified, asking for it first.
+func (r *Reader) waitPiece(index int) error {
+	select {
+	case <-r.closed:
+		return errReaderClosed
+	default:
+	}
+	if r.c.hasPiece(index) {
+		return nil
+	}
+
+	events, unsubscribe := r.c.Subscribe()
+	defer func() { unsubscribe() }()
+	r.c.SetPieceDeadline(index, time.Now())
+
+	// Subscribed before looking again, so the piece can't slip by unnoticed.
+	for !r.c.hasPiece(index) {
+		if r.c.State() == StateStopped {
+			return ErrStopped
+		}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the loop looks again.
+				events, unsubscribe = r.c.Subscribe()
+			}
+		case <-r.closed:
+			r.c.SetPieceDeadline(index, time.Time{})
+			return errReaderClosed
+		}
+	}
+	return nil
+}
+
+// pieceAt returns the piece holding byte off of the content.
+func (c *Client) pieceAt(off int64) int {
+	return int(off / c.Spec.Info.PieceLength)
+}
+
+// readData reads verified data for a Reader. Storage is only open while
+// the client is started. The read doesn't wait for Start, Recheck or
+// MoveStorage to finish: the disk I/O pool keeps it safe from them.
+func (c *Client) readData(off int64, p []byte) error {
+	d := c.diskIO()
+	if d == nil {
+		return ErrStopped
+	}
+	if err := d.readAt(p, off); err != nil {
+		if errors.Is(err, ErrStopped) {
+			return err
+		}
+		c.events.publish(StorageError{Op: "read", Index: c.pieceAt(off), Err: err})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaderOverCompleteData(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+	c, _ := newSeeder(t, spec, data)
+
+	files := c.Spec.Info.FileList()
+	if len(files) != 1 || files[0].Length != int64(len(data)) {
+		t.Fatalf("FileList() = %+v", files)
+	}
+	r := c.NewReader(files[0])
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read data does not match")
+	}
+
+	// A read across a piece boundary.
+	buf := make([]byte, 100)
+	off := int64(2*blockSize - 50)
+	if n, err := r.ReadAt(buf, off); n != len(buf) || err != nil {
+		t.Fatalf("ReadAt() = %d, %v", n, err)
+	}
+	if !bytes.Equal(buf, data[off:off+100]) {
+		t.Error("ReadAt() data does not match")
+	}
+
+	// Seeking, and reading past the end.
+	if pos, err := r.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data))-10 {
+		t.Fatalf("Seek() = %d, %v", pos, err)
+	}
+	if n, err := r.ReadAt(buf, int64(len(data))-10); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt() at the end = %d, %v, want 10, EOF", n, err)
+	}
+}
+
+func TestReaderWaitsForPieces(t *testing.T) {
+	data := testData(8*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+
+	_, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+	c, err := NewClient(spec, ClientParams{OutputPath: filepath.Join(t.TempDir(), "leech.bin"), Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer c.Stop()
+
+	// Read the end first: it has to wait for the pieces to arrive.
+	r := c.NewReader(c.Spec.Info.FileList()[0])
+	defer r.Close()
+	off := int64(len(data)) - 3*blockSize
+	buf := make([]byte, 3*blockSize)
+	if n, err := r.ReadAt(buf, off); n != len(buf) || err != nil {
+		t.Fatalf("ReadAt() = %d, %v", n, err)
+	}
+	if !bytes.Equal(buf, data[off:]) {
+		t.Error("ReadAt() data does not match")
+	}
+}
+
+func TestReaderUnblocksOnCloseAndStop(t *testing.T) {
+	data := testData(4 * blockSize)
+	spec := newTestSpec(data, 2*blockSize)
+	// The tracker returns a peer that never answers, so nothing arrives.
+	spec.Announce = newTracker(t, 1).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+	c, err := NewClient(spec, ClientParams{OutputPath: filepath.Join(t.TempDir(), "leech.bin"), Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	read := func(r *Reader) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 10))
+			errc <- err
+		}()
+		return errc
+	}
+	wait := func(errc chan error, want error) {
+		t.Helper()
+		select {
+		case err := <-errc:
+			if err != want {
+				t.Errorf("Read() error = %v, want %v", err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Read() still blocked")
+		}
+	}
+
+	r := c.NewReader(c.Spec.Info.FileList()[0])
+	errc := read(r)
+	time.Sleep(50 * time.Millisecond)
+	// Seeking doesn't wait for the blocked read, and the read doesn't
+	// move the position it was given.
+	seeked := make(chan struct{})
+	go func() {
+		r.Seek(5, io.SeekStart)
+		close(seeked)
+	}()
+	select {
+	case <-seeked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Seek() blocked behind Read()")
+	}
+	r.Close()
+	wait(errc, errReaderClosed)
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != 5 {
+		t.Errorf("position = %d after Seek(5)", pos)
+	}
+
+	errc = read(c.NewReader(c.Spec.Info.FileList()[0]))
+	time.Sleep(50 * time.Millisecond)
+	c.Stop()
+	wait(errc, ErrStopped)
+}
+
+func TestReadsDontWaitForLifecycle(t *testing.T) {
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, blockSize)
+	c, _ := newSeeder(t, spec, data)
+	r := c.NewReader(c.Spec.Info.FileList()[0])
+	defer r.Close()
+
+	// As if Start, Recheck or MoveStorage were taking their time.
+	c.lifeMu.Lock()
+	read := make(chan error, 1)
+	buf := make([]byte, blockSize)
+	go func() {
+		_, err := r.ReadAt(buf, blockSize)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil || !bytes.Equal(buf, data[blockSize:2*blockSize]) {
+			t.Errorf("ReadAt() error = %v, or wrong data", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("read waited for the lifecycle lock")
+	}
+	c.lifeMu.Unlock()
+
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if _, err := r.ReadAt(buf, 0); err != ErrStopped {
+		t.Errorf("ReadAt() after Stop error = %v, want ErrStopped", err)
+	}
+}
@@ -0,0 +1,285 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Minesto23/peerwire/internal/bencode"
+	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/storage"
+	"github.com/Minesto23/peerwire/internal/tracker"
+)
+
+// resumeData is what we remember about a torrent between runs. It is
+// stored bencoded next to the download, see Client.resumePath.
+type resumeData struct {
+	InfoHash [20]byte
+	Have     piece.Bitfield
+	// Files records the size and modification time of every file as we
+	// left it. If anything changed since, the bitfield can't be trusted.
+	Files []resumeFile
+	Peers []string // host:port
+
+	// Totals over all runs.
+	Downloaded int64
+	Uploaded   int64
+}
+
+type resumeFile struct {
+	Path    string // relative to the resume file's directory
+	Length  int64
+	ModTime int64 // Unix nanoseconds
+}
+
+func (rd *resumeData) marshal() ([]byte, error) {
+	files := make([]interface{}, len(rd.Files))
+	for i, f := range rd.Files {
+		files[i] = map[string]interface{}{
+			"path":   f.Path,
+			"length": f.Length,
+			"mtime":  f.ModTime,
+		}
+	}
+	peers := make([]interface{}, len(rd.Peers))
+	for i, p := range rd.Peers {
+		peers[i] = p
+	}
+	return bencode.Marshal(map[string]interface{}{
+		"info-hash":  rd.InfoHash[:],
+		"pieces":     []byte(rd.Have),
+		"files":      files,
+		"peers":      peers,
+		"downloaded": rd.Downloaded,
+		"uploaded":   rd.Uploaded,
+	})
+}
+
+func parseResume(data []byte) (*resumeData, error) {
+	var raw map[string]interface{}
+	if err := bencode.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	rd := &resumeData{}
+	infoHash, ok := raw["info-hash"].(string)
+	if !ok || len(infoHash) != len(rd.InfoHash) {
+		return nil, errors.New("resume: info hash missing or invalid")
+	}
+	copy(rd.InfoHash[:], infoHash)
+
+	have, ok := raw["pieces"].(string)
+	if !ok {
+		return nil, errors.New("resume: pieces missing")
+	}
+	rd.Have = piece.Bitfield(have)
+
+	files, ok := raw["files"].([]interface{})
+	if !ok {
+		return nil, errors.New("resume: files missing")
+	}
+	for _, f := range files {
+		fm, ok := f.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("resume: invalid file entry")
+		}
+		path, ok1 := fm["path"].(string)
+		length, ok2 := fm["length"].(int64)
+		mtime, ok3 := fm["mtime"].(int64)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, errors.New("resume: invalid file entry")
+		}
+		rd.Files = append(rd.Files, resumeFile{Path: path, Length: length, ModTime: mtime})
+	}
+
+	// Peers and stats are nice to have; ignore them if malformed.
+	if peers, ok := raw["peers"].([]interface{}); ok {
+		for _, p := range peers {
+			if s, ok := p.(string); ok {
+				rd.Peers = append(rd.Peers, s)
+			}
+		}
+	}
+	rd.Downloaded, _ = raw["downloaded"].(int64)
+	rd.Uploaded, _ = raw["uploaded"].(int64)
+	return rd, nil
+}
+
+// resumePath is where the resume file for this torrent lives.
+func (c *Client) resumePath() string {
+	return resumePath(c.StoragePath())
+}
+
+func resumePath(path string) string {
+	return path + ".resume"
+}
+
+// diskFiles describes the stored files of the torrent as they are now,
+// if the backend can tell; see storage.Statter. Paths are relative to the
+// resume file.
+func (c *Client) diskFiles() []resumeFile {
+	st, ok := c.Params.Storage.(storage.Statter)
+	if !ok {
+		return nil
+	}
+	dir := filepath.Dir(c.resumePath())
+	var files []resumeFile
+	for _, f := range st.Stat(c.layout()) {
+		path, err := filepath.Rel(dir, f.Path)
+		if err != nil {
+			path = f.Path
+		}
+		files = append(files, resumeFile{Path: filepath.ToSlash(path), Length: f.Length, ModTime: f.ModTime})
+	}
+	return files
+}
+
+// loadResume reads the resume file. It returns nil if there is none, or if
+// it doesn't describe the files currently on disk.
+func (c *Client) loadResume() *resumeData {
+	if c.StoragePath() == "" {
+		return nil // Nowhere to keep it
+	}
+	data, err := os.ReadFile(c.resumePath())
+	if err != nil {
+		return nil
+	}
+	rd, err := parseResume(data)
+	if err != nil {
+		fmt.Printf("Ignoring resume data: %v\n", err)
+		return nil
+	}
+	if rd.InfoHash != c.InfoHash || len(rd.Have) != len(c.have) {
+		fmt.Println("Ignoring resume data: it belongs to a different torrent")
+		return nil
+	}
+
+	files := c.diskFiles()
+	if len(files) != len(rd.Files) {
+		return nil
+	}
+	for i, f := range files {
+		if f != rd.Files[i] {
+			fmt.Printf("Ignoring resume data: %s changed since it was saved\n", f.Path)
+			return nil
+		}
+	}
+	return rd
+}
+
+// restoreResume marks the pieces of rd as verified and picks up its peers
+// and totals.
+func (c *Client) restoreResume(rd *resumeData) {
+	for i := 0; i < c.numPieces(); i++ {
+		if rd.Have.HasPiece(i) {
+			c.markHave(i)
+			c.markSynced(i) // Resume data only records synced pieces
+		}
+	}
+
+	var peers []tracker.Peer
+	for _, addr := range rd.Peers {
+		host, portStr, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		port, perr := strconv.Atoi(portStr)
+		if err != nil || ip == nil || perr != nil {
+			continue
+		}
+		peers = append(peers, tracker.Peer{IP: ip, Port: uint16(port)})
+	}
+
+	c.mu.Lock()
+	c.resumePeers = peers
+	c.mu.Unlock()
+
+	// Keep the totals since the previous runs on top of this session's.
+	c.baseDownloaded.Store(rd.Downloaded - c.downloaded.Load())
+	c.baseUploaded.Store(rd.Uploaded - c.uploaded.Load())
+}
+
+// saveResume syncs storage, unless Durability is DurabilityNever, and
+// records what is on disk.
+func (c *Client) saveResume() error {
+	return c.writeResume(c.Params.Durability != DurabilityNever)
+}
+
+// writeResume records what is on disk, syncing storage first if flush is
+// set. Only pieces that made it to stable storage are remembered.
+//
+// With DurabilityNever no piece ever is, and resume data matching the
+// files would only keep the next Start from checking them. So there is
+// none: an old resume file is removed instead.
+func (c *Client) writeResume(flush bool) error {
+	c.resumeMu.Lock()
+	defer c.resumeMu.Unlock()
+	if flush {
+		if err := c.syncStorage(); err != nil {
+			return err
+		}
+	}
+	if c.StoragePath() == "" {
+		return nil
+	}
+	if c.Params.Durability == DurabilityNever {
+		if err := os.Remove(c.resumePath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	files := c.diskFiles()
+	rd := &resumeData{
+		InfoHash:   c.InfoHash,
+		Have:       c.syncedPieces(),
+		Files:      files,
+		Downloaded: c.baseDownloaded.Load() + c.downloaded.Load(),
+		Uploaded:   c.baseUploaded.Load() + c.uploaded.Load(),
+	}
+	c.mu.Lock()
+	for addr := range c.knownPeers {
+		rd.Peers = append(rd.Peers, addr)
+	}
+	c.mu.Unlock()
+
+	data, err := rd.marshal()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename, so a crash never leaves a
+	// half-written resume file behind.
+	tmp := c.resumePath() + ".tmp"
+	if err := writeFile(tmp, data, flush); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.resumePath())
+}
+
+// writeFile is os.WriteFile, syncing the file before closing it if flush
+// is set.
+func writeFile(name string, data []byte, flush bool) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && flush {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// saveResumeOrReport saves resume data where failing isn't fatal, telling
+// subscribers about any error.
+func (c *Client) saveResumeOrReport() {
+	if err := c.saveResume(); err != nil {
+		c.events.publish(StorageError{Op: "resume", Index: -1, Err: err})
+	}
+}
@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/peer"
+	"github.com/Minesto23/peerwire/internal/piece"
+)
+
+// Request pipeline tuning. The number of outstanding requests per peer
+// follows the bandwidth-delay product: enough blocks to cover the peer's
+// latency plus pipelineQueueTime worth of data at its current rate.
+const (
+	minPipeline       = 2
+	maxPipeline       = 128
+	initialPipeline   = 8
+	pipelineQueueTime = time.Second
+
+	// A peer that delivers nothing for this long (scaled by its round trip)
+	// while we wait on requests is considered stalled.
+	minRequestTimeout = 10 * time.Second
+	maxRequestTimeout = 60 * time.Second
+)
+
+// pipelineDepth is how many requests we keep outstanding with this peer.
+func (pc *peerConn) pipelineDepth() int {
+	if pc.rate == 0 {
+		return initialPipeline
+	}
+	window := (pc.minRTT + pipelineQueueTime).Seconds()
+	depth := int(pc.rate*window/blockSize) + 1
+	if depth < minPipeline {
+		return minPipeline
+	}
+	if depth > maxPipeline {
+		return maxPipeline
+	}
+	return depth
+}
+
+// requestTimeout scales with the peer's observed round trip.
+func (pc *peerConn) requestTimeout() time.Duration {
+	timeout := 4 * pc.rtt
+	if timeout < minRequestTimeout {
+		return minRequestTimeout
+	}
+	if timeout > maxRequestTimeout {
+		return maxRequestTimeout
+	}
+	return timeout
+}
+
+// sampleRate folds the bytes received since the last call into pc.rate.
+// Called once per tick from the run loop.
+func (pc *peerConn) sampleRate() {
+	now := time.Now()
+	total := pc.downloaded.Load()
+	if !pc.lastSampleTime.IsZero() {
+		elapsed := now.Sub(pc.lastSampleTime).Seconds()
+		if elapsed > 0 {
+			instant := float64(total-pc.lastSample) / elapsed
+			pc.rate = 0.7*pc.rate + 0.3*instant
+		}
+	}
+	pc.lastSample, pc.lastSampleTime = total, now
+}
+
+// sampleRTT records the round trip of one answered request. Only the run
+// loop writes the round trips, under pc.mu so Stats can read them.
+func (pc *peerConn) sampleRTT(rtt time.Duration) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.rtt == 0 {
+		pc.rtt = rtt
+	} else {
+		pc.rtt = (7*pc.rtt + rtt) / 8
+	}
+	if pc.minRTT == 0 || rtt < pc.minRTT {
+		pc.minRTT = rtt
+	}
+}
+
+func (pc *peerConn) numOutstanding() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.outstanding)
+}
+
+// stalled reports whether the peer sat on our requests for too long.
+func (pc *peerConn) stalled() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.outstanding) > 0 && time.Since(pc.waitingSince) > pc.requestTimeout()
+}
+
+// fillRequests tops up the request pipeline, spreading requests over as
+// many pieces as needed: first the pieces we already work on, then new
+// ones from the picker.
+func (pc *peerConn) fillRequests() error {
+	// In endgame another peer may have finished one of our pieces.
+	for _, p := range pc.pieces {
+		if pc.c.pieceFinished(p) {
+			pc.dropPiece(p)
+		}
+	}
+
+	pc.mu.Lock()
+	canRequest := !pc.peerChoking && pc.amInterested
+	want := pc.pipelineDepth() - len(pc.outstanding)
+	pc.mu.Unlock()
+	if !canRequest || want <= 0 || pc.disk.congested() {
+		return nil // The disk needs to catch up first
+	}
+
+	var reqs []blockRequest
+	for _, p := range pc.pieces {
+		reqs = append(reqs, pc.c.claimBlocks(pc, p, want-len(reqs))...)
+	}
+	for len(reqs) < want {
+		// The picker only offers pieces this peer actually has.
+		p := pc.c.acquirePiece(pc, pc.c.avoidSuspects(peerIP(pc.addr), pc.peerBitfield()))
+		if p == nil {
+			break // Nothing left to hand out
+		}
+		pc.pieces[p.work.Index] = p
+		reqs = append(reqs, pc.c.claimBlocks(pc, p, want-len(reqs))...)
+	}
+
+	now := time.Now()
+	for _, req := range reqs {
+		pc.mu.Lock()
+		if len(pc.outstanding) == 0 {
+			pc.waitingSince = now
+		}
+		pc.outstanding[req] = now
+		pc.mu.Unlock()
+
+		payload := peer.FormatRequest(req.index, req.begin, req.length)
+		if err := pc.write(&peer.Message{ID: peer.MsgRequest, Payload: payload}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPiece stops working on p and forgets our requests for it.
+func (pc *peerConn) dropPiece(p *partialPiece) {
+	pc.mu.Lock()
+	for req := range pc.outstanding {
+		if req.index == p.work.Index {
+			delete(pc.outstanding, req)
+		}
+	}
+	pc.mu.Unlock()
+
+	delete(pc.pieces, p.work.Index)
+	pc.c.releasePiece(pc, p)
+}
+
+// releasePieces returns every piece we work on to the picker. Blocks
+// already received stay with the piece for the next peer.
+func (pc *peerConn) releasePieces() {
+	for _, p := range pc.pieces {
+		pc.dropPiece(p)
+	}
+}
+
+// cancelRequest withdraws one of our requests because another peer
+// delivered the block first. Safe to call from any goroutine.
+func (pc *peerConn) cancelRequest(req blockRequest) {
+	pc.mu.Lock()
+	_, ok := pc.outstanding[req]
+	delete(pc.outstanding, req)
+	pc.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	payload := peer.FormatCancel(req.index, req.begin, req.length)
+	if err := pc.write(&peer.Message{ID: peer.MsgCancel, Payload: payload}); err != nil {
+		pc.close()
+	}
+}
+
+func (pc *peerConn) handlePiece(msg *peer.Message) error {
+	index, begin, block, err := peer.ParsePiece(msg)
+	if err != nil {
+		return err
+	}
+
+	req := blockRequest{index, begin, len(block)}
+	pc.mu.Lock()
+	sent, requested := pc.outstanding[req]
+	if requested {
+		delete(pc.outstanding, req)
+		pc.waitingSince = time.Now()
+	}
+	pc.mu.Unlock()
+
+	p := pc.pieces[index]
+	if !requested || p == nil {
+		// Unrequested, cancelled or arriving after a choke. Harmless, but
+		// don't let it count towards anything.
+		pc.wasted.Add(int64(len(block)))
+		pc.c.wasted.Add(int64(len(block)))
+		return nil
+	}
+	if begin%blockSize != 0 || req != p.block(begin/blockSize) {
+		return fmt.Errorf("piece %d: bad block at %d (%d bytes)", index, begin, len(block))
+	}
+	pc.sampleRTT(time.Since(sent))
+
+	cancel, complete := pc.c.blockReceived(pc, p, begin, block)
+	for _, other := range cancel {
+		// Endgame: others asked for the same block; tell them not to bother.
+		pc.c.goNetwork(func() { other.cancelRequest(req) })
+	}
+	if !complete {
+		return nil
+	}
+
+	pc.dropPiece(p)
+	work := p.work
+	if !checkIntegrity(work, p.buf) {
+		// Corrupt. Put back, and find out who is to blame.
+		pc.c.hashFailed.Add(int64(len(p.buf)))
+		pc.c.hashFailures.Add(1)
+		pc.c.pieceFailed(p)
+		pc.c.picker.Release(work.Index)
+		pc.c.events.publish(HashFailed{Index: work.Index, Peer: pc.addr})
+		return nil
+	}
+	pc.c.piecePassed(p)
+	if err := pc.disk.write(&piece.Result{Index: work.Index, Buf: p.buf}); err != nil {
+		pc.c.picker.Release(work.Index)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/ratelimit"
+	"github.com/Minesto23/peerwire/internal/torrent"
+	"github.com/Minesto23/peerwire/internal/tracker"
+)
+
+// A torrent that found no peers is retried after this long.
+const noPeersRetry = time.Minute
+
+// SessionParams configures a Session.
+type SessionParams struct {
+	// Listener accepts incoming connections for every torrent. When nil the
+	// session opens its own on Port (default 6881).
+	Listener *Listener
+	Port     int
+	// MaxConns caps the connections of all torrents together, when the
+	// session opens its own listener. 0 means 200.
+	MaxConns int
+
+	// Tracker is shared by every torrent. Nil means a new tracker.Client.
+	Tracker *tracker.Client
+
+	// MaxActiveDownloads and MaxActiveSeeds limit how many torrents run at
+	// once; the others wait in the queue in the order they were added.
+	// 0 means 3 downloads and 5 seeds, a negative value means no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+
+	// RateLimits caps the traffic of all torrents together, in bytes per
+	// second; 0 means unlimited. RateSchedule optionally switches to other
+	// limits by time of day. Torrents may have tighter limits of their own.
+	RateLimits   ratelimit.Rates
+	RateSchedule ratelimit.Schedule
+
+	// DiskWorkers, WriteQueue and ReadCache limit the disk I/O pool of all
+	// torrents together, as ClientParams does for a lone Client, with the
+	// same defaults.
+	DiskWorkers int
+	WriteQueue  int64
+	ReadCache   int64
+}
+
+// TorrentState is where a torrent stands in a Session.
+type TorrentState string
+
+const (
+	TorrentQueued      TorrentState = "queued"
+	TorrentDownloading TorrentState = "downloading"
+	TorrentSeeding     TorrentState = "seeding"
+	TorrentPaused      TorrentState = "paused"
+	TorrentError       TorrentState = "error"
+)
+
+// TorrentInfo describes one torrent of a Session.
+type TorrentInfo struct {
+	Client *Client
+	State  TorrentState
+	Err    error // set in TorrentError
+}
+
+// Session runs many torrents behind one listen port and peer ID, sharing
+// the tracker client, the global connection limit, rate limits and the
+// disk I/O pool.
+// Torrents are started from a queue so only a limited number download or
+// seed at a time.
+type Session struct {
+	PeerID [20]byte
+	Params SessionParams
+
+	listener *Listener
+	tracker  *tracker.Client
+	limits   *rateLimits
+	bans     *banList
+	disk     *diskPool
+
+	// schedMu serializes starting and stopping torrents. It is held across
+	// Client.Start, which may wait for trackers, so never take it under mu.
+	schedMu sync.Mutex
+
+	mu       sync.Mutex
+	torrents []*sessionTorrent // in the order they were added
+	closed   bool
+
+	kickc chan struct{}
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// sessionTorrent is a torrent's place in the queue. The flags are guarded
+// by Session.mu.
+type sessionTorrent struct {
+	c       *Client
+	paused  bool // by the user
+	active  bool // started by the session
+	err     error
+	retryAt time.Time // for ErrNoPeers
+
+	stopWatch chan struct{} // closed when the session stops c
+}
+
+// NewSession creates a session and starts listening.
+func NewSession(params SessionParams) (*Session, error) {
+	peerID, err := newPeerID()
+	if err != nil {
+		return nil, err
+	}
+	if params.MaxActiveDownloads == 0 {
+		params.MaxActiveDownloads = 3
+	}
+	if params.MaxActiveSeeds == 0 {
+		params.MaxActiveSeeds = 5
+	}
+	if params.Tracker == nil {
+		params.Tracker = tracker.NewClient(tracker.Config{})
+	}
+	if params.DiskWorkers <= 0 {
+		params.DiskWorkers = defaultDiskWorkers
+	}
+	if params.WriteQueue <= 0 {
+		params.WriteQueue = defaultWriteQueue
+	}
+	if params.ReadCache == 0 {
+		params.ReadCache = defaultReadCache
+	}
+
+	l := params.Listener
+	if l == nil {
+		if params.Port == 0 {
+			params.Port = 6881
+		}
+		l, err = NewListener(ListenerParams{Port: params.Port, MaxConns: params.MaxConns})
+		if err != nil {
+			return nil, err
+		}
+		go l.Serve()
+	}
+
+	s := &Session{
+		PeerID:   peerID,
+		Params:   params,
+		listener: l,
+		tracker:  params.Tracker,
+		limits:   newRateLimits(params.RateLimits, params.RateSchedule),
+		bans:     newBanList(),
+		disk:     newDiskPool(params.DiskWorkers, params.WriteQueue, params.ReadCache),
+		kickc:    make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.run()
+	go func() {
+		defer s.wg.Done()
+		s.limits.run(s.quit)
+	}()
+	return s, nil
+}
+
+// Add creates a torrent in the session and queues it. params.Listener and
+// params.Tracker are replaced by the session's, and the session's disk
+// I/O pool is used instead of params' disk settings.
+func (s *Session) Add(spec *torrent.TorrentSpec, params ClientParams) (*Client, error) {
+	params.Listener = s.listener
+	params.Tracker = s.tracker
+	c, err := NewClient(spec, params)
+	if err != nil {
+		return nil, err
+	}
+	c.PeerID = s.PeerID
+	c.sessionLimit = s.limits
+	c.bans = s.bans
+	c.sharedDisk = s.disk
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("session closed")
+	}
+	if s.find(spec.InfoHash) != nil {
+		return nil, fmt.Errorf("torrent %x is already in the session", spec.InfoHash)
+	}
+	s.torrents = append(s.torrents, &sessionTorrent{c: c})
+	s.kick()
+	return c, nil
+}
+
+// Remove stops a torrent and takes it out of the session. Its data stays
+// on disk.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.schedMu.Lock()
+	defer s.schedMu.Unlock()
+
+	s.mu.Lock()
+	t := s.find(infoHash)
+	if t == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	for i, other := range s.torrents {
+		if other == t {
+			s.torrents = append(s.torrents[:i], s.torrents[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	err := s.stopTorrent(t)
+	s.kick() // A slot may have opened up
+	return err
+}
+
+// Pause stops a torrent and keeps it out of the queue until Resume.
+func (s *Session) Pause(infoHash [20]byte) error {
+	s.schedMu.Lock()
+	defer s.schedMu.Unlock()
+
+	s.mu.Lock()
+	t := s.find(infoHash)
+	if t != nil {
+		t.paused = true
+	}
+	s.mu.Unlock()
+	if t == nil {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+
+	err := s.stopTorrent(t)
+	s.kick()
+	return err
+}
+
+// Resume puts a paused or failed torrent back in the queue.
+func (s *Session) Resume(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(infoHash)
+	if t == nil {
+		return fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	t.paused, t.err, t.retryAt = false, nil, time.Time{}
+	s.kick()
+	return nil
+}
+
+// SetRateLimits changes the session-wide normal rate limits.
+func (s *Session) SetRateLimits(r ratelimit.Rates) {
+	s.limits.set(r)
+}
+
+// SetRateSchedule changes when the session's alternative limits apply.
+func (s *Session) SetRateSchedule(sch ratelimit.Schedule) {
+	s.limits.setSchedule(sch)
+}
+
+// RateLimits returns the session-wide normal limits and schedule.
+func (s *Session) RateLimits() (ratelimit.Rates, ratelimit.Schedule) {
+	return s.limits.get()
+}
+
+// Get returns the torrent with the given info hash.
+func (s *Session) Get(infoHash [20]byte) (TorrentInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(infoHash)
+	if t == nil {
+		return TorrentInfo{}, false
+	}
+	return t.info(), true
+}
+
+// List returns every torrent in the order they were added.
+func (s *Session) List() []TorrentInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]TorrentInfo, len(s.torrents))
+	for i, t := range s.torrents {
+		list[i] = t.info()
+	}
+	return list
+}
+
+// Close stops every torrent and, if the session opened it, the listener.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.quit)
+	s.wg.Wait()
+
+	s.schedMu.Lock()
+	defer s.schedMu.Unlock()
+	var firstErr error
+	for _, t := range s.snapshot() {
+		if err := s.stopTorrent(t); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.Params.Listener == nil {
+		s.listener.Close()
+	}
+	s.disk.close()
+	return firstErr
+}
+
+// find returns the torrent with infoHash. s.mu must be held.
+func (s *Session) find(infoHash [20]byte) *sessionTorrent {
+	for _, t := range s.torrents {
+		if t.c.InfoHash == infoHash {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Session) snapshot() []*sessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*sessionTorrent(nil), s.torrents...)
+}
+
+// info reports t's state. Session.mu must be held.
+func (t *sessionTorrent) info() TorrentInfo {
+	info := TorrentInfo{Client: t.c, Err: t.err}
+	switch {
+	case t.paused:
+		info.State = TorrentPaused
+	case t.err != nil:
+		info.State = TorrentError
+	case !t.active:
+		info.State = TorrentQueued
+	case t.c.isComplete():
+		info.State = TorrentSeeding
+	default:
+		info.State = TorrentDownloading
+	}
+	return info
+}
+
+// kick asks the scheduler for another round.
+func (s *Session) kick() {
+	select {
+	case s.kickc <- struct{}{}:
+	default: // A round is pending already
+	}
+}
+
+func (s *Session) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.kickc:
+			s.schedule()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// schedule enforces the active limits: torrents over a limit (typically a
+// download that just became a seed) go back to the queue, then queued
+// torrents are started while there are free slots.
+func (s *Session) schedule() {
+	s.schedMu.Lock()
+	defer s.schedMu.Unlock()
+
+	downloads, seeds := 0, 0
+	// slot reports whether a torrent of c's kind may run, and takes the slot.
+	slot := func(c *Client) bool {
+		count, limit := &downloads, s.Params.MaxActiveDownloads
+		if c.isComplete() {
+			count, limit = &seeds, s.Params.MaxActiveSeeds
+		}
+		if limit >= 0 && *count >= limit {
+			return false
+		}
+		*count++
+		return true
+	}
+
+	list := s.snapshot()
+	for _, t := range list {
+		s.mu.Lock()
+		active := t.active
+		s.mu.Unlock()
+		if active && !slot(t.c) {
+			s.stopTorrent(t)
+		}
+	}
+
+	for _, t := range list {
+		s.mu.Lock()
+		waiting := !t.active && !t.paused && t.err == nil && time.Now().After(t.retryAt)
+		s.mu.Unlock()
+		if waiting && slot(t.c) {
+			s.startTorrent(t)
+		}
+	}
+}
+
+// startTorrent starts t. s.schedMu must be held.
+func (s *Session) startTorrent(t *sessionTorrent) {
+	err := t.c.Start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case errors.Is(err, ErrNoPeers):
+		// Not fatal: try again later, leaving the slot to someone else.
+		t.retryAt = time.Now().Add(noPeersRetry)
+		time.AfterFunc(noPeersRetry, s.kick)
+	case err != nil:
+		t.err = err
+	default:
+		t.active = true
+		t.stopWatch = make(chan struct{})
+		go s.watch(t.c, t.stopWatch)
+	}
+}
+
+// stopTorrent stops t if the session started it. s.schedMu must be held.
+func (s *Session) stopTorrent(t *sessionTorrent) error {
+	s.mu.Lock()
+	active := t.active
+	if active {
+		t.active = false
+		close(t.stopWatch)
+	}
+	s.mu.Unlock()
+	if !active {
+		return nil
+	}
+	return t.c.Stop()
+}
+
+// watch reschedules whenever c completes, since it then needs a seed slot
+// instead of a download slot, and whenever a recheck or a change of
+// priorities makes it incomplete again, which turns that around.
+func (s *Session) watch(c *Client, stop chan struct{}) {
+	complete, changed := c.completion()
+	if complete {
+		s.kick() // It may have completed since it was given a slot
+	}
+	for {
+		select {
+		case <-changed:
+			s.kick()
+		case <-stop:
+			return
+		}
+		_, changed = c.completion()
+	}
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/torrent"
+)
+
+func newTestSession(t *testing.T, params SessionParams) *Session {
+	t.Helper()
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go l.Serve()
+
+	params.Listener = l
+	s, err := NewSession(params)
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func waitState(t *testing.T, s *Session, infoHash [20]byte, want TorrentState) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, ok := s.Get(infoHash)
+		if ok && info.State == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent state = %q, want %q", info.State, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// unreachableSpec is a torrent whose tracker hands out a peer that never
+// answers, so it stays downloading.
+func unreachableSpec(t *testing.T, seed int) *torrent.TorrentSpec {
+	data := testData(blockSize + seed)
+	spec := newTestSpec(data, blockSize)
+	spec.Announce = newTracker(t, 1).URL
+	return spec
+}
+
+func TestSessionSharesDiskPool(t *testing.T) {
+	s := newTestSession(t, SessionParams{DiskWorkers: 2, WriteQueue: 1 << 20, MaxActiveDownloads: -1})
+	dir := t.TempDir()
+	a, b := unreachableSpec(t, 1), unreachableSpec(t, 2)
+	ca, err := s.Add(a, ClientParams{OutputPath: filepath.Join(dir, "a"), DiskWorkers: 8})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	cb, err := s.Add(b, ClientParams{OutputPath: filepath.Join(dir, "b")})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	waitState(t, s, a.InfoHash, TorrentDownloading)
+	waitState(t, s, b.InfoHash, TorrentDownloading)
+
+	da, db := ca.diskIO(), cb.diskIO()
+	if da.pool != s.disk || db.pool != s.disk {
+		t.Fatal("torrents don't use the session's disk pool")
+	}
+	if cap(s.disk.sem) != 2 || s.disk.limit != 1<<20 {
+		t.Errorf("pool has %d workers and a %d byte queue, want the session's", cap(s.disk.sem), s.disk.limit)
+	}
+}
+
+func TestSessionQueue(t *testing.T) {
+	s := newTestSession(t, SessionParams{MaxActiveDownloads: 1})
+	dir := t.TempDir()
+
+	a, b := unreachableSpec(t, 1), unreachableSpec(t, 2)
+	ca, err := s.Add(a, ClientParams{OutputPath: filepath.Join(dir, "a")})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := s.Add(b, ClientParams{OutputPath: filepath.Join(dir, "b")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := s.Add(a, ClientParams{OutputPath: filepath.Join(dir, "a2")}); err == nil {
+		t.Error("Add() accepted the same torrent twice")
+	}
+
+	waitState(t, s, a.InfoHash, TorrentDownloading)
+	waitState(t, s, b.InfoHash, TorrentQueued)
+	if ca.PeerID != s.PeerID || ca.port != s.listener.Port() {
+		t.Error("torrent does not use the session's peer ID and port")
+	}
+
+	// Pausing a frees its slot for b.
+	if err := s.Pause(a.InfoHash); err != nil {
+		t.Fatalf("Pause() error = %v", err)
+	}
+	waitState(t, s, a.InfoHash, TorrentPaused)
+	waitState(t, s, b.InfoHash, TorrentDownloading)
+
+	// Resumed, a has to wait for b.
+	s.Resume(a.InfoHash)
+	waitState(t, s, a.InfoHash, TorrentQueued)
+
+	if err := s.Remove(b.InfoHash); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	waitState(t, s, a.InfoHash, TorrentDownloading)
+	if list := s.List(); len(list) != 1 || list[0].Client != ca {
+		t.Errorf("List() = %v, want only a", list)
+	}
+}
+
+func TestSessionMovesFinishedDownloadToSeedQueue(t *testing.T) {
+	s := newTestSession(t, SessionParams{MaxActiveDownloads: 1, MaxActiveSeeds: 1})
+	dir := t.TempDir()
+
+	// A complete torrent takes the only seed slot.
+	seedData := testData(2*blockSize + 1)
+	seedSpec := newTestSpec(seedData, blockSize)
+	seedSpec.Announce = newTracker(t).URL
+	seedOut := filepath.Join(dir, "seed")
+	os.WriteFile(seedOut, seedData, 0666)
+	if _, err := s.Add(seedSpec, ClientParams{OutputPath: seedOut}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	waitState(t, s, seedSpec.InfoHash, TorrentSeeding)
+
+	// Another torrent downloads from an outside seeder...
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, blockSize)
+	_, l := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, l.Port()).URL
+	c, err := s.Add(spec, ClientParams{OutputPath: filepath.Join(dir, "leech")})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(20 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	// ...and, with no seed slot left, goes back to the queue once done.
+	waitState(t, s, spec.InfoHash, TorrentQueued)
+	waitState(t, s, seedSpec.InfoHash, TorrentSeeding)
+}
+
+func TestSessionRechecksSeedBackIntoDownloads(t *testing.T) {
+	s := newTestSession(t, SessionParams{MaxActiveDownloads: 1, MaxActiveSeeds: 1})
+	dir := t.TempDir()
+
+	// A seed whose tracker knows an outside seeder of the same data...
+	data := testData(3 * blockSize)
+	spec := newTestSpec(data, blockSize)
+	_, l := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, l.Port()).URL
+	out := filepath.Join(dir, "seed")
+	os.WriteFile(out, data, 0666)
+	c, err := s.Add(spec, ClientParams{OutputPath: out})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	waitState(t, s, spec.InfoHash, TorrentSeeding)
+
+	// ...and a download that takes the only download slot.
+	other := unreachableSpec(t, 1)
+	if _, err := s.Add(other, ClientParams{OutputPath: filepath.Join(dir, "other")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	waitState(t, s, other.InfoHash, TorrentDownloading)
+
+	// A recheck finds the seed's data damaged: it wants the download slot
+	// back, being first in line.
+	f, err := os.OpenFile(out, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("garbage"), blockSize)
+	f.Close()
+	if err := c.Recheck(); err != nil {
+		t.Fatalf("Recheck() error = %v", err)
+	}
+	waitState(t, s, other.InfoHash, TorrentQueued)
+
+	// Once repaired it seeds again and hands the slot back.
+	select {
+	case <-c.Done():
+	case <-time.After(20 * time.Second):
+		t.Fatal("repair did not finish")
+	}
+	waitState(t, s, spec.InfoHash, TorrentSeeding)
+	waitState(t, s, other.InfoHash, TorrentDownloading)
+}
@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+)
+
+var errBanned = errors.New("peer is banned")
+
+// Ban is a peer we refuse to talk to.
+type Ban struct {
+	IP     string
+	Reason string
+	Since  time.Time
+}
+
+// banList is the set of banned peers, by IP. A Session shares one list
+// between its torrents, so a peer caught sending garbage for one is gone
+// from all of them.
+type banList struct {
+	mu     sync.Mutex
+	banned map[string]Ban
+}
+
+func newBanList() *banList {
+	return &banList{banned: make(map[string]Ban)}
+}
+
+// ban adds ip to the list. It reports false if it was there already.
+func (b *banList) ban(ip, reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.banned[ip]; ok {
+		return false
+	}
+	b.banned[ip] = Ban{IP: ip, Reason: reason, Since: time.Now()}
+	return true
+}
+
+func (b *banList) isBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.banned[ip]
+	return ok
+}
+
+// list returns the bans, oldest first.
+func (b *banList) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := make([]Ban, 0, len(b.banned))
+	for _, ban := range b.banned {
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Since.Before(bans[j].Since) })
+	return bans
+}
+
+// peerIP returns the host part of a peer address. Bans are by IP, since
+// a peer reconnecting from another port is still the same peer.
+func peerIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// blockRecord is who sent one block of a piece that failed verification,
+// and what the block hashed to.
+type blockRecord struct {
+	ip   string
+	hash [20]byte
+}
+
+// Smart ban: every block of a piece remembers the IP it came from. When
+// the piece fails its hash check we record a hash of each block and
+// download the piece again, from other peers where possible. Once it
+// verifies, every block that differs from the good copy points at the
+// peer that sent it. A peer that sent a whole failed piece alone is
+// banned right away, as nobody else can be to blame.
+
+// pieceFailed records a failed attempt at p. p must be done, so its
+// blocks no longer change.
+func (c *Client) pieceFailed(p *partialPiece) {
+	records := make([]blockRecord, len(p.from))
+	sole := p.from[0]
+	for b, ip := range p.from {
+		req := p.block(b)
+		records[b] = blockRecord{ip: ip, hash: sha1.Sum(p.buf[req.begin : req.begin+req.length])}
+		if ip != sole {
+			sole = ""
+		}
+	}
+
+	if sole != "" {
+		c.banPeer(sole, fmt.Sprintf("sent corrupt piece %d", p.work.Index))
+		return
+	}
+
+	c.mu.Lock()
+	c.failedPieces[p.work.Index] = append(c.failedPieces[p.work.Index], records)
+	c.mu.Unlock()
+}
+
+// piecePassed settles the failed attempts at p, if any, now that p is
+// known to be good: whoever sent a block that differs from it is banned.
+func (c *Client) piecePassed(p *partialPiece) {
+	c.mu.Lock()
+	attempts := c.failedPieces[p.work.Index]
+	delete(c.failedPieces, p.work.Index)
+	c.mu.Unlock()
+
+	for _, records := range attempts {
+		for b, rec := range records {
+			req := p.block(b)
+			if sha1.Sum(p.buf[req.begin:req.begin+req.length]) != rec.hash {
+				c.banPeer(rec.ip, fmt.Sprintf("sent corrupt data for piece %d", p.work.Index))
+			}
+		}
+	}
+}
+
+// avoidSuspects removes from has the failed pieces ip contributed to, so
+// they are downloaded again from somebody else. A piece is only withheld
+// while more peers have it than there are suspects, so a swarm of
+// suspects can still finish it.
+func (c *Client) avoidSuspects(ip string, has piece.Bitfield) piece.Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.failedPieces) == 0 {
+		return has
+	}
+	masked := append(piece.Bitfield(nil), has...)
+	for index, attempts := range c.failedPieces {
+		suspects := make(map[string]bool)
+		for _, records := range attempts {
+			for _, rec := range records {
+				suspects[rec.ip] = true
+			}
+		}
+		if suspects[ip] && c.picker.Availability(index) > len(suspects) {
+			masked.ClearPiece(index)
+		}
+	}
+	return masked
+}
+
+// banPeer bans ip and drops our connections to it. Other torrents of the
+// session notice on their next tick.
+func (c *Client) banPeer(ip, reason string) {
+	if !c.bans.ban(ip, reason) {
+		return
+	}
+	c.events.publish(PeerBanned{IP: ip, Reason: reason})
+	for _, pc := range c.connList() {
+		if peerIP(pc.addr) == ip {
+			pc.close()
+		}
+	}
+}
+
+func (c *Client) isBanned(addr string) bool {
+	return c.bans.isBanned(peerIP(addr))
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/Minesto23/peerwire/internal/piece"
+)
+
+// attempt builds a finished download of piece 0 from data, block b sent
+// by from[b].
+func attempt(c *Client, data []byte, from ...string) *partialPiece {
+	p := newPartialPiece(c.newWork(0))
+	copy(p.buf, data)
+	copy(p.from, from)
+	p.done = true
+	return p
+}
+
+func TestSmartBanFindsCulprit(t *testing.T) {
+	data := testData(3 * blockSize)
+	c, err := NewClient(newTestSpec(data, 3*blockSize), ClientParams{OutputPath: filepath.Join(t.TempDir(), "x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10.0.0.2 corrupts its block; the piece fails and nobody is to blame yet.
+	bad := append([]byte(nil), data...)
+	bad[blockSize+7] ^= 0xff
+	c.pieceFailed(attempt(c, bad, "10.0.0.1", "10.0.0.2", "10.0.0.1"))
+	if bans := c.bans.list(); len(bans) != 0 {
+		t.Fatalf("banned %v after one failure", bans)
+	}
+
+	// Both suspects are avoided while someone else has the piece.
+	has := piece.Bitfield{0x80}
+	c.picker.AddBitfield(has)
+	c.picker.AddBitfield(has)
+	c.picker.AddBitfield(has)
+	if got := c.avoidSuspects("10.0.0.1", has); got.HasPiece(0) {
+		t.Error("suspect offered the failed piece although others have it")
+	}
+	if got := c.avoidSuspects("10.0.0.3", has); !got.HasPiece(0) {
+		t.Error("innocent peer not offered the failed piece")
+	}
+
+	// The good copy shows who sent the bad block.
+	c.piecePassed(attempt(c, data, "10.0.0.3", "10.0.0.3", "10.0.0.1"))
+	bans := c.bans.list()
+	if len(bans) != 1 || bans[0].IP != "10.0.0.2" {
+		t.Errorf("bans = %v, want 10.0.0.2 only", bans)
+	}
+	if !c.isBanned("10.0.0.2:6881") || c.isBanned("10.0.0.1:6881") {
+		t.Error("isBanned() does not match the ban list")
+	}
+	if len(c.failedPieces) != 0 {
+		t.Error("failed attempts kept after the piece passed")
+	}
+}
+
+func TestSmartBanSoleSender(t *testing.T) {
+	data := testData(2 * blockSize)
+	c, err := NewClient(newTestSpec(data, 2*blockSize), ClientParams{OutputPath: filepath.Join(t.TempDir(), "x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	bad := append([]byte(nil), data...)
+	bad[0] ^= 0xff
+	c.pieceFailed(attempt(c, bad, "10.0.0.9", "10.0.0.9"))
+
+	ev := waitEvent(t, events, func(ev Event) bool { _, ok := ev.(PeerBanned); return ok })
+	if ev.(PeerBanned).IP != "10.0.0.9" {
+		t.Errorf("banned %v, want 10.0.0.9", ev)
+	}
+}
+
+func TestBannedPeerRefused(t *testing.T) {
+	data := testData(blockSize)
+	c, _ := newSeeder(t, newTestSpec(data, blockSize), data)
+	c.bans.ban("10.0.0.9", "test")
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if err := c.runConn(local, "10.0.0.9:51413", [20]byte{}, false); err != errBanned {
+		t.Errorf("runConn() = %v, want %v", err, errBanned)
+	}
+	if got := c.Stats().Banned; len(got) != 1 || got[0].Reason != "test" {
+		t.Errorf("Stats().Banned = %v", got)
+	}
+}
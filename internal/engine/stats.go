@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Minesto23/peerwire/internal/peer"
+)
+
+// Rates in stats are averaged over this long.
+const rateWindow = 10 * time.Second
+
+// Stats is a snapshot of a torrent's transfer statistics.
+type Stats struct {
+	// Verified pieces, and all pieces, of the files that aren't skipped.
+	PiecesDone, PiecesTotal int
+
+	// Payload bytes of this run, and including earlier runs.
+	Downloaded, Uploaded           int64
+	TotalDownloaded, TotalUploaded int64
+	// Average payload rates over the last rateWindow, in bytes per second.
+	DownloadRate, UploadRate float64
+
+	// Wasted counts received bytes we had no use for: unrequested blocks
+	// and blocks another peer delivered first. HashFailed counts the bytes
+	// of pieces that failed verification, HashFailures the pieces.
+	Wasted       int64
+	HashFailed   int64
+	HashFailures int
+	// Banned lists the peers smart ban caught sending corrupt data, in
+	// this torrent or, within a Session, any other.
+	Banned []Ban
+
+	// Peers are the live connections, fastest downloads first.
+	Peers []PeerStats
+
+	// Availability is, per piece, how many connected peers have it.
+	// DistributedCopies summarizes it: the number of complete copies in the
+	// swarm, plus the fraction of pieces there is one more copy of.
+	Availability      []int
+	DistributedCopies float64
+}
+
+// PeerStats is a snapshot of one connection.
+type PeerStats struct {
+	Addr     string
+	PeerID   [20]byte
+	Client   string // guessed from the peer ID
+	Incoming bool
+
+	Downloaded, Uploaded     int64   // payload bytes on this connection
+	DownloadRate, UploadRate float64 // average over rateWindow, bytes/s
+	Wasted                   int64
+	RTT                      time.Duration // smoothed block round trip
+
+	AmChoking, AmInterested     bool
+	PeerChoking, PeerInterested bool
+	Optimistic                  bool // holds our optimistic unchoke
+
+	Pieces   int // how many pieces the peer has
+	Requests int // our requests it hasn't answered yet
+}
+
+// Flags summarizes the connection in the usual one-letter codes:
+//
+//	D  downloading: we are interested and not choked
+//	d  we are interested but choked
+//	U  uploading: the peer is interested and not choked
+//	u  the peer is interested but choked
+//	O  optimistic unchoke
+//	I  incoming connection
+func (s PeerStats) Flags() string {
+	var f []byte
+	switch {
+	case s.AmInterested && !s.PeerChoking:
+		f = append(f, 'D')
+	case s.AmInterested:
+		f = append(f, 'd')
+	}
+	switch {
+	case s.PeerInterested && !s.AmChoking:
+		f = append(f, 'U')
+	case s.PeerInterested:
+		f = append(f, 'u')
+	}
+	if s.Optimistic {
+		f = append(f, 'O')
+	}
+	if s.Incoming {
+		f = append(f, 'I')
+	}
+	return string(f)
+}
+
+// Stats returns a snapshot of the torrent's statistics.
+func (c *Client) Stats() Stats {
+	now := time.Now()
+	down, up := c.downloaded.Load(), c.uploaded.Load()
+	s := Stats{
+		PiecesDone:      c.numDone(),
+		PiecesTotal:     c.numWanted(),
+		Downloaded:      down,
+		Uploaded:        up,
+		TotalDownloaded: c.baseDownloaded.Load() + down,
+		TotalUploaded:   c.baseUploaded.Load() + up,
+		DownloadRate:    c.downMeter.rate(now),
+		UploadRate:      c.upMeter.rate(now),
+		Wasted:          c.wasted.Load(),
+		HashFailed:      c.hashFailed.Load(),
+		HashFailures:    int(c.hashFailures.Load()),
+		Availability:    c.picker.Availabilities(),
+		Banned:          c.bans.list(),
+	}
+	s.DistributedCopies = distributedCopies(s.Availability)
+
+	for _, pc := range c.connList() {
+		s.Peers = append(s.Peers, pc.stats(now))
+	}
+	sort.Slice(s.Peers, func(i, j int) bool {
+		return s.Peers[i].DownloadRate > s.Peers[j].DownloadRate
+	})
+	return s
+}
+
+func (pc *peerConn) stats(now time.Time) PeerStats {
+	s := PeerStats{
+		Addr:         pc.addr,
+		PeerID:       pc.peerID,
+		Client:       peer.ClientName(pc.peerID),
+		Incoming:     pc.incoming,
+		Downloaded:   pc.downloaded.Load(),
+		Uploaded:     pc.uploaded.Load(),
+		DownloadRate: pc.downMeter.rate(now),
+		UploadRate:   pc.upMeter.rate(now),
+		Wasted:       pc.wasted.Load(),
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	s.RTT = pc.rtt
+	s.AmChoking, s.AmInterested = pc.amChoking, pc.amInterested
+	s.PeerChoking, s.PeerInterested = pc.peerChoking, pc.peerInterested
+	s.Optimistic = pc.optimistic
+	s.Requests = len(pc.outstanding)
+	for i := 0; i < pc.c.numPieces(); i++ {
+		if pc.bitfield.HasPiece(i) {
+			s.Pieces++
+		}
+	}
+	return s
+}
+
+// distributedCopies is the lowest availability plus the fraction of
+// pieces that are more available than that.
+func distributedCopies(avail []int) float64 {
+	if len(avail) == 0 {
+		return 0
+	}
+	min := avail[0]
+	for _, a := range avail {
+		if a < min {
+			min = a
+		}
+	}
+	above := 0
+	for _, a := range avail {
+		if a > min {
+			above++
+		}
+	}
+	return float64(min) + float64(above)/float64(len(avail))
+}
+
+// rateMeter averages the growth of a byte counter over rateWindow. It is
+// fed a sample of the counter about once a second.
+type rateMeter struct {
+	mu      sync.Mutex
+	samples []rateSample // oldest first
+}
+
+type rateSample struct {
+	at    time.Time
+	total int64
+}
+
+func (m *rateMeter) sample(now time.Time, total int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, rateSample{now, total})
+	m.expire(now)
+}
+
+// rate returns the average rate in bytes per second up to now. Once
+// sampling stops the rate decays to zero over rateWindow.
+func (m *rateMeter) rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(now)
+	if len(m.samples) < 2 {
+		return 0
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	secs := now.Sub(first.at).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return float64(last.total-first.total) / secs
+}
+
+// expire drops samples older than the window. m.mu must be held.
+func (m *rateMeter) expire(now time.Time) {
+	cutoff := now.Add(-rateWindow)
+	n := 0
+	for n < len(m.samples) && m.samples[n].at.Before(cutoff) {
+		n++
+	}
+	m.samples = append(m.samples[:0], m.samples[n:]...)
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	start := time.Now()
+	for i := 0; i <= 5; i++ {
+		m.sample(start.Add(time.Duration(i)*time.Second), int64(i)*1000)
+	}
+	if got := m.rate(start.Add(5 * time.Second)); got != 1000 {
+		t.Errorf("rate() = %v, want 1000", got)
+	}
+
+	// Without new samples the average decays, then drops to zero.
+	if got := m.rate(start.Add(10 * time.Second)); got >= 1000 || got <= 0 {
+		t.Errorf("rate() 5s after the last sample = %v", got)
+	}
+	if got := m.rate(start.Add(time.Minute)); got != 0 {
+		t.Errorf("rate() long after the last sample = %v, want 0", got)
+	}
+}
+
+func TestDistributedCopies(t *testing.T) {
+	tests := []struct {
+		avail []int
+		want  float64
+	}{
+		{nil, 0},
+		{[]int{0, 0, 0, 0}, 0},
+		{[]int{1, 1, 1, 1}, 1},
+		{[]int{2, 1, 3, 1}, 1.5},
+		{[]int{0, 1, 1, 1}, 0.75},
+	}
+	for _, tt := range tests {
+		if got := distributedCopies(tt.avail); got != tt.want {
+			t.Errorf("distributedCopies(%v) = %v, want %v", tt.avail, got, tt.want)
+		}
+	}
+}
+
+func TestPeerStatsFlags(t *testing.T) {
+	tests := []struct {
+		s    PeerStats
+		want string
+	}{
+		{PeerStats{AmChoking: true, PeerChoking: true}, ""},
+		{PeerStats{AmInterested: true, AmChoking: true}, "D"},
+		{PeerStats{AmInterested: true, PeerChoking: true, PeerInterested: true}, "dU"},
+		{PeerStats{PeerInterested: true, AmChoking: true, Incoming: true}, "uI"},
+		{PeerStats{PeerInterested: true, Optimistic: true}, "UO"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Flags(); got != tt.want {
+			t.Errorf("%+v.Flags() = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestStatsAfterDownload(t *testing.T) {
+	data := testData(5*blockSize + 100)
+	spec := newTestSpec(data, 2*blockSize)
+
+	seeder, seedListener := newSeeder(t, spec, data)
+	spec.Announce = newTracker(t, seedListener.Port()).URL
+
+	l, err := NewListener(ListenerParams{})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer l.Close()
+
+	c, err := NewClient(spec, ClientParams{OutputPath: filepath.Join(t.TempDir(), "leech.bin"), Listener: l})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Stop()
+	if err := c.Download(context.Background()); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	s := c.Stats()
+	if s.PiecesDone != s.PiecesTotal || s.PiecesTotal != c.numPieces() {
+		t.Errorf("pieces = %d/%d, want %d/%d", s.PiecesDone, s.PiecesTotal, c.numPieces(), c.numPieces())
+	}
+	if s.Downloaded != int64(len(data)) || s.TotalDownloaded != s.Downloaded {
+		t.Errorf("Downloaded = %d (total %d), want %d", s.Downloaded, s.TotalDownloaded, len(data))
+	}
+	if s.HashFailures != 0 || s.HashFailed != 0 {
+		t.Errorf("hash failures = %d (%d bytes), want none", s.HashFailures, s.HashFailed)
+	}
+	if len(s.Peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(s.Peers))
+	}
+	p := s.Peers[0]
+	if p.Client != "PeerWire 0.0.0.1" || p.Incoming {
+		t.Errorf("peer client = %q, incoming = %v", p.Client, p.Incoming)
+	}
+	if p.Downloaded != int64(len(data)) || p.Pieces != c.numPieces() {
+		t.Errorf("peer downloaded = %d, pieces = %d", p.Downloaded, p.Pieces)
+	}
+	if p.RTT <= 0 {
+		t.Errorf("peer RTT = %v, want a measurement", p.RTT)
+	}
+	if s.DistributedCopies != 1 {
+		t.Errorf("DistributedCopies = %v, want 1", s.DistributedCopies)
+	}
+
+	// The seeder sees the same connection from the other end.
+	ss := seeder.Stats()
+	if ss.Uploaded != int64(len(data)) {
+		t.Errorf("seeder Uploaded = %d, want %d", ss.Uploaded, len(data))
+	}
+	if len(ss.Peers) != 1 || !ss.Peers[0].Incoming {
+		t.Errorf("seeder peers = %+v, want one incoming", ss.Peers)
+	}
+}
@@ -2,25 +2,143 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Minesto23/peerwire/internal/peer"
 	"github.com/Minesto23/peerwire/internal/piece"
+	"github.com/Minesto23/peerwire/internal/ratelimit"
 	"github.com/Minesto23/peerwire/internal/tracker"
 )
 
-func (c *Client) startDownloadWorker(p tracker.Peer, workQueue chan *piece.Work, results chan *piece.Result) {
-	conn, err := net.DialTimeout("tcp", p.String(), 5*time.Second)
+const (
+	// Block size 16KB, the de facto standard request size.
+	blockSize = 16384
+	// Requests larger than this are ignored (most clients use the same limit).
+	maxRequestLength = 128 * 1024
+	// Maximum number of queued incoming requests per peer.
+	maxUploadQueue = 256
+
+	readTimeout     = 3 * time.Minute
+	writeTimeout    = 30 * time.Second
+	keepAlivePeriod = 90 * time.Second
+)
+
+var (
+	errSeedToSeed   = errors.New("both sides are seeding")
+	errTooManyConns = errors.New("connection limit reached")
+	errNotRunning   = errors.New("client is not running")
+)
+
+// blockRequest identifies a block on the wire, in either direction.
+type blockRequest struct {
+	index, begin, length int
+}
+
+// peerConn is an established (handshaken) connection to a single peer.
+// The run loop owns the download state; everything under mu is shared with
+// the upload goroutine, other connections and the client.
+type peerConn struct {
+	c        *Client
+	disk     *diskIO // of the Start the connection runs under
+	conn     net.Conn
+	addr     string
+	peerID   [20]byte
+	incoming bool
+
+	writeMu   sync.Mutex
+	lastWrite time.Time
+
+	mu             sync.Mutex
+	bitfield       piece.Bitfield
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	optimistic     bool // set by the choker
+	uploads        []blockRequest
+	// outstanding holds our requests the peer hasn't answered yet.
+	outstanding  map[blockRequest]time.Time
+	waitingSince time.Time // last progress while requests were outstanding
+
+	uploadReady chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+
+	pieces map[int]*partialPiece // pieces we are requesting blocks of
+	rate   float64               // smoothed download rate in bytes/s
+	rtt    time.Duration         // smoothed block round trip
+	minRTT time.Duration         // best round trip seen, our latency estimate
+
+	lastSample     int64
+	lastSampleTime time.Time
+
+	// Payload byte counters, sampled by the choker and the meters.
+	downloaded         atomic.Int64
+	uploaded           atomic.Int64
+	wasted             atomic.Int64
+	downMeter, upMeter rateMeter
+
+	// Per-peer rate limits, charged together with the torrent's and session's.
+	downLimit, upLimit *ratelimit.Limiter
+}
+
+func newPeerConn(c *Client, conn net.Conn, addr string, peerID [20]byte, incoming bool) *peerConn {
+	c.mu.Lock()
+	rates := c.peerRates
+	c.mu.Unlock()
+	downLimit := ratelimit.NewLimiter(rates.Download)
+	upLimit := ratelimit.NewLimiter(rates.Upload)
+
+	down := []*ratelimit.Limiter{downLimit, c.limits.down}
+	up := []*ratelimit.Limiter{upLimit, c.limits.up}
+	if c.sessionLimit != nil {
+		down = append(down, c.sessionLimit.down)
+		up = append(up, c.sessionLimit.up)
+	}
+
+	return &peerConn{
+		c:           c,
+		disk:        c.diskIO(),
+		conn:        ratelimit.NewConn(conn, down, up),
+		downLimit:   downLimit,
+		upLimit:     upLimit,
+		addr:        addr,
+		peerID:      peerID,
+		incoming:    incoming,
+		bitfield:    make(piece.Bitfield, (c.numPieces()+7)/8),
+		amChoking:   true,
+		peerChoking: true,
+		outstanding: make(map[blockRequest]time.Time),
+		pieces:      make(map[int]*partialPiece),
+		uploadReady: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (c *Client) startDownloadWorker(ctx context.Context, p tracker.Peer) {
+	if !c.hasCapacity() || c.isBanned(p.String()) {
+		return
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", p.String())
 	if err != nil {
 		// fmt.Printf("Failed to connect to %s: %v\n", p, err)
 		return // Exit worker
 	}
 	defer conn.Close()
 
+	// Abort the handshake if we are stopped meanwhile.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
 	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
 		return
 	}
@@ -39,181 +157,392 @@ func (c *Client) startDownloadWorker(p tracker.Peer, workQueue chan *piece.Work,
 	if !bytes.Equal(readH.InfoHash[:], c.InfoHash[:]) {
 		return // Wrong swarm
 	}
+	if !c.acceptsPeer(readH.PeerID) {
+		return
+	}
 
-	// 2. Initialize Peer State
-	bf := make(piece.Bitfield, len(c.Spec.Info.Pieces)/20/8+1) // Roughly enough
-	// Note: We don't know exact size from handshake, we wait for bitfield msg.
-	// Actually bitfield message defines size.
+	// Deadlines are managed per read/write from here on.
+	conn.SetDeadline(time.Time{})
 
-	choked := true
+	// 2. Run the connection until it dies
+	c.runConn(conn, p.String(), readH.PeerID, false)
+}
 
-	// 3. Main Loop
-	for {
-		// Read Message
-		msg, err := peer.ReadMessage(conn)
-		if err != nil {
-			return // Connection closed or error
-		}
+// runConn drives a handshaken connection until it fails, is closed or the
+// client stops.
+func (c *Client) runConn(conn net.Conn, addr string, peerID [20]byte, incoming bool) error {
+	ctx, ok := c.track()
+	if !ok {
+		return errNotRunning
+	}
+	defer c.wg.Done()
+	if c.isBanned(addr) {
+		return errBanned
+	}
 
-		if msg == nil {
-			// Keep-alive
-			continue
-		}
+	pc := newPeerConn(c, conn, addr, peerID, incoming)
+	if !c.addConn(pc) {
+		return errTooManyConns
+	}
+	defer c.removeConn(pc)
+
+	c.events.publish(PeerConnected{Peer: addr, PeerID: peerID})
+	err := pc.run(ctx)
+	c.events.publish(PeerDisconnected{Peer: addr, PeerID: peerID, Err: err})
+	return err
+}
+
+func (pc *peerConn) run(ctx context.Context) error {
+	defer pc.close()
+	defer pc.releasePieces()
+
+	// Advertise what we already have
+	if err := pc.sendBitfield(); err != nil {
+		return err
+	}
 
-		switch msg.ID {
-		case peer.MsgUnchoke:
-			choked = false
-		case peer.MsgChoke:
-			choked = true
-		case peer.MsgHave:
-			index, err := peer.ParseHave(msg)
-			if err == nil {
-				bf.SetPiece(index)
+	// The loops are done before the connection is: once the network is
+	// stopped, nothing reads or writes for it any more.
+	msgs := make(chan *peer.Message)
+	errc := make(chan error, 1)
+	var loops sync.WaitGroup
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		pc.readLoop(msgs, errc)
+	}()
+	go func() {
+		defer loops.Done()
+		pc.uploadLoop()
+	}()
+	defer loops.Wait()
+	defer pc.close() // Ends the loops
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-msgs:
+			if err := pc.handleMessage(msg); err != nil {
+				return err
 			}
-		case peer.MsgBitfield:
-			// Replace our bitfield
-			if len(msg.Payload) > len(bf) {
-				bf = make(piece.Bitfield, len(msg.Payload))
+		case err := <-errc:
+			return err
+		case <-ticker.C:
+			if err := pc.tick(); err != nil {
+				return err
 			}
-			copy(bf, msg.Payload)
-		case peer.MsgPiece:
-			// Handled in downloadPiece logic mostly, but if we get random piece?
-			// Usually we only get pieces we requested.
+		case <-pc.closed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
-		// Try to work
-		// Simple logic: If unchoked, try to grab work
-		if !choked {
-			// Pull work non-blocking or blocking?
-			// Blocking is safer for the queue, but if we can't do the work, we must return it.
-			select {
-			case work := <-workQueue:
-				if !bf.HasPiece(work.Index) {
-					// Peer doesn't have it. Return to queue.
-					// Potential infinite loop if all peers lack this piece.
-					// Yield a bit to prevent tight loop
-					workQueue <- work // Put back
-					time.Sleep(time.Second)
-					continue
-				}
-
-				// Download
-				buf, err := downloadPiece(conn, work)
-				if err != nil {
-					// Failed. Put back to queue.
-					workQueue <- work
-					// fmt.Printf("Failed to download piece %d from %s: %v\n", work.Index, p, err)
-					return // Close connection on failure to be robust (find new peer)
-				}
-
-				// Verify
-				if !checkIntegrity(work, buf) {
-					// Corrupt. Put back.
-					workQueue <- work
-					// fmt.Printf("Integrity check failed for piece %d from %s\n", work.Index, p)
-					continue
-				}
-
-				// Convert to result (send copy because buf might be reused if we didn't alloc fresh)
-				// We alloc fresh in downloadPiece
-
-				// Send Have message to keep peer alive/inform
-				// (Optional for leechers but good practice)
-
-				results <- &piece.Result{Index: work.Index, Buf: buf}
-
-			case <-time.After(time.Second):
-				// Idle
-			}
-		} else {
-			// If choked, send Interested
-			// We should send interested once.
-			// Simplification: Send interested always if we are choked and want data
-			msg := &peer.Message{ID: peer.MsgInterested}
-			msg.Write(conn)
+		if err := pc.fillRequests(); err != nil {
+			return err
 		}
 	}
 }
 
-func checkIntegrity(work *piece.Work, buf []byte) bool {
-	hash := sha1.Sum(buf)
-	return bytes.Equal(hash[:], work.Hash)
+// close tears down the connection. Safe to call from any goroutine.
+func (pc *peerConn) close() {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		pc.conn.Close()
+	})
 }
 
-func downloadPiece(conn net.Conn, work *piece.Work) ([]byte, error) {
-	// Send requests
-	// Block size 16KB
-	const blockSize = 16384
-	// Relaxed timeout for pipelining and large pieces
-	timeLeft := 60 * time.Second
-	conn.SetDeadline(time.Now().Add(timeLeft))
+// maxMessageLength is the longest message a peer may send: a block with
+// its ID, index and offset, or our bitfield if that is longer. Since we
+// never request more than a block, nothing legitimate is larger.
+func (c *Client) maxMessageLength() int {
+	return max(1+8+blockSize, 1+(c.numPieces()+7)/8)
+}
 
-	numBlocks := work.Length / blockSize
-	if work.Length%blockSize != 0 {
-		numBlocks++ // partial block at end
+func (pc *peerConn) readLoop(msgs chan<- *peer.Message, errc chan<- error) {
+	maxLength := pc.c.maxMessageLength()
+	for {
+		pc.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, err := peer.ReadMessage(pc.conn, maxLength)
+		if err != nil {
+			errc <- err
+			return
+		}
+		if msg == nil {
+			continue // Keep-alive
+		}
+		select {
+		case msgs <- msg:
+		case <-pc.closed:
+			return
+		}
 	}
+}
 
-	buf := make([]byte, work.Length)
-
-	// Pipelining: Send all requests first, then read all responses
-	// Note: For very large pieces, we might want to batch this, but strict 16KB blocks
-	// means a 256KB piece is only 16 requests. This is safe to burst.
+// write sends a message. Safe for concurrent use.
+func (pc *peerConn) write(msg *peer.Message) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
 
-	// 1. Send ALL requests
-	for i := 0; i < numBlocks; i++ {
-		begin := i * blockSize
-		length := blockSize
-		if begin+length > work.Length {
-			length = work.Length - begin
-		}
+	pc.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := msg.Write(pc.conn); err != nil {
+		return err
+	}
+	pc.lastWrite = time.Now()
+	return nil
+}
 
-		req := peer.FormatRequest(work.Index, begin, length)
-		msg := &peer.Message{ID: peer.MsgRequest, Payload: req}
-		if err := msg.Write(conn); err != nil {
-			return nil, err
-		}
+func (pc *peerConn) sendBitfield() error {
+	bf, hasAny := pc.c.bitfield()
+	if !hasAny {
+		return nil // Bitfield may be omitted when we have nothing
 	}
+	return pc.write(&peer.Message{ID: peer.MsgBitfield, Payload: bf})
+}
+
+func (pc *peerConn) sendHave(index int) error {
+	return pc.write(&peer.Message{ID: peer.MsgHave, Payload: peer.FormatHave(index)})
+}
 
-	// 2. Read ALL responses
-	blocksReceived := 0
-	for blocksReceived < numBlocks {
-		resp, err := peer.ReadMessage(conn)
+func (pc *peerConn) handleMessage(msg *peer.Message) error {
+	switch msg.ID {
+	case peer.MsgChoke:
+		pc.mu.Lock()
+		pc.peerChoking = true
+		pc.mu.Unlock()
+		// A choke discards our outstanding requests; let others have our pieces.
+		pc.releasePieces()
+	case peer.MsgUnchoke:
+		pc.mu.Lock()
+		pc.peerChoking = false
+		pc.mu.Unlock()
+	case peer.MsgInterested:
+		pc.mu.Lock()
+		pc.peerInterested = true
+		pc.mu.Unlock()
+		// Don't make newcomers wait for the next choke round if a slot is free.
+		if pc.c.numUnchoked() < pc.c.Params.UploadSlots {
+			return pc.unchoke()
+		}
+	case peer.MsgNotInterested:
+		pc.mu.Lock()
+		pc.peerInterested = false
+		pc.mu.Unlock()
+	case peer.MsgHave:
+		index, err := peer.ParseHave(msg)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if index < 0 || index >= pc.c.numPieces() {
+			return fmt.Errorf("have for invalid piece %d", index)
+		}
+		pc.mu.Lock()
+		isNew := !pc.bitfield.HasPiece(index)
+		pc.bitfield.SetPiece(index)
+		pc.mu.Unlock()
+		if isNew {
+			pc.c.picker.AddHave(index)
 		}
-		if resp == nil {
-			continue // keep-alive
+		return pc.updateInterest()
+	case peer.MsgBitfield:
+		if err := piece.Bitfield(msg.Payload).Check(pc.c.numPieces()); err != nil {
+			return err
 		}
+		pc.mu.Lock()
+		old := make(piece.Bitfield, len(pc.bitfield))
+		copy(old, pc.bitfield)
+		copy(pc.bitfield, msg.Payload)
+		bf := make(piece.Bitfield, len(pc.bitfield))
+		copy(bf, pc.bitfield)
+		pc.mu.Unlock()
+		pc.c.picker.RemoveBitfield(old)
+		pc.c.picker.AddBitfield(bf)
+		return pc.updateInterest()
+	case peer.MsgRequest:
+		index, begin, length, err := peer.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		pc.queueUpload(blockRequest{index, begin, length})
+	case peer.MsgCancel:
+		index, begin, length, err := peer.ParseCancel(msg)
+		if err != nil {
+			return err
+		}
+		pc.cancelUpload(blockRequest{index, begin, length})
+	case peer.MsgPiece:
+		return pc.handlePiece(msg)
+	}
+	return nil
+}
 
-		switch resp.ID {
-		case peer.MsgPiece:
-			// Format: <index><begin><block>
-			if len(resp.Payload) < 8 {
-				return nil, fmt.Errorf("piece message too short")
-			}
+func (pc *peerConn) tick() error {
+	pc.sampleRate()
+	now := time.Now()
+	pc.downMeter.sample(now, pc.downloaded.Load())
+	pc.upMeter.sample(now, pc.uploaded.Load())
+	if pc.c.isBanned(pc.addr) {
+		return errBanned // By another torrent of the session
+	}
+	if pc.stalled() {
+		// Close connection on timeout to be robust (find new peer)
+		return fmt.Errorf("peer stalled with %d requests outstanding", pc.numOutstanding())
+	}
 
-			// Extract begin offset to know where to put it
-			begin := int(binary.BigEndian.Uint32(resp.Payload[4:8]))
+	if err := pc.updateInterest(); err != nil {
+		return err
+	}
 
-			if begin >= work.Length {
-				return nil, fmt.Errorf("piece begin out of bounds")
-			}
+	pc.writeMu.Lock()
+	idle := time.Since(pc.lastWrite) > keepAlivePeriod
+	pc.writeMu.Unlock()
+	if idle {
+		var keepAlive *peer.Message
+		return pc.write(keepAlive)
+	}
+	return nil
+}
+
+// updateInterest tells the peer whether it has anything we still need.
+func (pc *peerConn) updateInterest() error {
+	bf := pc.peerBitfield()
+	interested := pc.c.needsFrom(bf)
+	peerComplete := pc.c.isSeed(bf)
 
-			data := resp.Payload[8:]
-			copy(buf[begin:], data)
-			blocksReceived++
+	pc.mu.Lock()
+	wasInterested := pc.amInterested
+	pc.amInterested = interested
+	pc.mu.Unlock()
 
-		case peer.MsgChoke:
-			return nil, fmt.Errorf("peer choked during download")
+	if peerComplete && pc.c.isComplete() {
+		return errSeedToSeed
+	}
 
-		case peer.MsgHave:
-			// Process have message to keep bitfield up to date (optional but good)
-			// For this worker function, we might just ignore or update local scope?
-			// We won't update global bitfield here as we don't have access to it easily without mutex.
-			// Just ignore.
-			continue
+	if interested == wasInterested {
+		return nil
+	}
+	id := peer.MsgNotInterested
+	if interested {
+		id = peer.MsgInterested
+	}
+	return pc.write(&peer.Message{ID: id})
+}
+
+// peerBitfield returns a copy of the pieces the peer has.
+// Lock order: never hold pc.mu while calling into the client, and vice versa.
+func (pc *peerConn) peerBitfield() piece.Bitfield {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	bf := make(piece.Bitfield, len(pc.bitfield))
+	copy(bf, pc.bitfield)
+	return bf
+}
+
+func (pc *peerConn) choke() error {
+	pc.mu.Lock()
+	if pc.amChoking {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.amChoking = true
+	// Choking discards every pending request of the peer.
+	pc.uploads = nil
+	pc.mu.Unlock()
+	return pc.write(&peer.Message{ID: peer.MsgChoke})
+}
+
+func (pc *peerConn) unchoke() error {
+	pc.mu.Lock()
+	if !pc.amChoking {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.amChoking = false
+	pc.mu.Unlock()
+	return pc.write(&peer.Message{ID: peer.MsgUnchoke})
+}
+
+// queueUpload validates and queues a block request from the peer.
+func (pc *peerConn) queueUpload(req blockRequest) {
+	if req.length <= 0 || req.length > maxRequestLength || req.begin < 0 {
+		return
+	}
+	if req.index < 0 || req.index >= pc.c.numPieces() || req.begin+req.length > pc.c.pieceLength(req.index) {
+		return
+	}
+	if !pc.c.hasPiece(req.index) {
+		return
+	}
+
+	pc.mu.Lock()
+	if pc.amChoking || len(pc.uploads) >= maxUploadQueue {
+		// Requests while choked are dropped, as the spec allows.
+		pc.mu.Unlock()
+		return
+	}
+	pc.uploads = append(pc.uploads, req)
+	pc.mu.Unlock()
+
+	select {
+	case pc.uploadReady <- struct{}{}:
+	default:
+	}
+}
+
+func (pc *peerConn) cancelUpload(req blockRequest) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for i, r := range pc.uploads {
+		if r == req {
+			pc.uploads = append(pc.uploads[:i], pc.uploads[i+1:]...)
+			return
+		}
+	}
+}
+
+func (pc *peerConn) popUpload() (blockRequest, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if len(pc.uploads) == 0 || pc.amChoking {
+		return blockRequest{}, false
+	}
+	req := pc.uploads[0]
+	pc.uploads = pc.uploads[1:]
+	return req, true
+}
+
+// uploadLoop serves queued block requests from storage.
+func (pc *peerConn) uploadLoop() {
+	for {
+		select {
+		case <-pc.uploadReady:
+		case <-pc.closed:
+			return
+		}
+
+		for {
+			req, ok := pc.popUpload()
+			if !ok {
+				break
+			}
+			data, err := pc.disk.readBlock(req.index, req.begin, req.length)
+			if err != nil {
+				pc.close()
+				return
+			}
+			msg := &peer.Message{ID: peer.MsgPiece, Payload: peer.FormatPiece(req.index, req.begin, data)}
+			if err := pc.write(msg); err != nil {
+				pc.close()
+				return
+			}
+			pc.uploaded.Add(int64(len(data)))
+			pc.c.uploaded.Add(int64(len(data)))
 		}
 	}
+}
 
-	return buf, nil
+func checkIntegrity(work *piece.Work, buf []byte) bool {
+	hash := sha1.Sum(buf)
+	return bytes.Equal(hash[:], work.Hash)
 }
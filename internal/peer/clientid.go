@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// azureusClients maps the two-letter codes of Azureus-style peer IDs
+// ("-XXvvvv-...") to client names.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"PW": "PeerWire",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// ClientName guesses the client software from a peer ID, e.g.
+// "-qB4250-..." is "qBittorrent 4.2.5" and "M7-4-3--..." is "Mainline
+// 7.4.3". Unrecognized IDs give "Unknown".
+func ClientName(peerID [20]byte) string {
+	id := string(peerID[:])
+
+	if id[0] == '-' && id[7] == '-' {
+		name, ok := azureusClients[id[1:3]]
+		if !ok {
+			name = fmt.Sprintf("Unknown (%s)", printable(id[1:3]))
+		}
+		if v, ok := azureusVersion(id[3:7]); ok {
+			return name + " " + v
+		}
+		return name
+	}
+
+	// Mainline style: a letter followed by dash-separated version numbers.
+	if id[0] == 'M' {
+		if v, ok := mainlineVersion(id[1:8]); ok {
+			return "Mainline " + v
+		}
+	}
+	return "Unknown"
+}
+
+// azureusVersion turns the four version characters into "a.b.c", one
+// component per character, dropping trailing zero components. Letters
+// stand for 10 and up.
+func azureusVersion(s string) (string, bool) {
+	parts := make([]string, 0, len(s))
+	for _, ch := range []byte(s) {
+		var n int
+		switch {
+		case ch >= '0' && ch <= '9':
+			n = int(ch - '0')
+		case ch >= 'A' && ch <= 'Z':
+			n = int(ch-'A') + 10
+		case ch >= 'a' && ch <= 'z':
+			n = int(ch-'a') + 10
+		default:
+			return "", false
+		}
+		parts = append(parts, fmt.Sprint(n))
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, "."), true
+}
+
+// mainlineVersion parses "7-4-3--" or "4-10-2-" style versions.
+func mainlineVersion(s string) (string, bool) {
+	var parts []string
+	for _, f := range strings.Split(s, "-") {
+		if f == "" {
+			continue
+		}
+		for _, ch := range []byte(f) {
+			if ch < '0' || ch > '9' {
+				return "", false
+			}
+		}
+		parts = append(parts, f)
+	}
+	if len(parts) != 3 {
+		return "", false
+	}
+	return strings.Join(parts, "."), true
+}
+
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,27 @@
+package peer
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"-qB4250-abcdefghijkl", "qBittorrent 4.2.5"},
+		{"-TR2940-abcdefghijkl", "Transmission 2.9.4"},
+		{"-LT1208-abcdefghijkl", "libtorrent 1.2.0.8"},
+		{"-PW0001-abcdefghijkl", "PeerWire 0.0.0.1"},
+		{"-ZZ1000-abcdefghijkl", "Unknown (ZZ) 1.0"},
+		{"-UT3!00-abcdefghijkl", "µTorrent"},
+		{"M7-4-3--abcdefghijkl", "Mainline 7.4.3"},
+		{"M4-10-2-abcdefghijkl", "Mainline 4.10.2"},
+		{"abcdefghijklmnopqrst", "Unknown"},
+	}
+	for _, tt := range tests {
+		var id [20]byte
+		copy(id[:], tt.id)
+		if got := ClientName(id); got != tt.want {
+			t.Errorf("ClientName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package peer
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -27,9 +28,16 @@ type Message struct {
 	Payload []byte
 }
 
+// ErrMessageTooLong is returned by ReadMessage for a message longer than
+// allowed.
+var ErrMessageTooLong = errors.New("peer: message too long")
+
 // ReadMessage reads a message from the stream.
 // Handles keep-alives (length 0) by returning nil, nil.
-func ReadMessage(r io.Reader) (*Message, error) {
+// The length prefix comes from the peer, so messages longer than
+// maxLength bytes, ID included, are refused with ErrMessageTooLong
+// before anything is allocated for them.
+func ReadMessage(r io.Reader, maxLength int) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 	if _, err := io.ReadFull(r, lengthBuf); err != nil {
 		return nil, err
@@ -41,6 +49,9 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if uint64(length) > uint64(maxLength) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLong, length)
+	}
 
 	messageBuf := make([]byte, length)
 	if _, err := io.ReadFull(r, messageBuf); err != nil {
@@ -105,3 +116,50 @@ func ParseHave(msg *Message) (int, error) {
 	index := binary.BigEndian.Uint32(msg.Payload)
 	return int(index), nil
 }
+
+// ParseRequest parses the payload of a Request message.
+// Format: <index><begin><length>
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("request message expected payload 12 bytes, got %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// FormatPiece builds the payload of a Piece message.
+// Format: <index><begin><block>
+func FormatPiece(index, begin int, block []byte) []byte {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return payload
+}
+
+// ParsePiece parses the payload of a Piece message.
+// The returned block aliases the message payload.
+func ParsePiece(msg *Message) (index, begin int, block []byte, err error) {
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("piece message too short: %d bytes", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// FormatCancel builds the payload of a Cancel message.
+// It has the same layout as a Request: <index><begin><length>
+func FormatCancel(index, begin, length int) []byte {
+	return FormatRequest(index, begin, length)
+}
+
+// ParseCancel parses the payload of a Cancel message.
+func ParseCancel(msg *Message) (index, begin, length int, err error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("cancel message expected payload 12 bytes, got %d", len(msg.Payload))
+	}
+	return ParseRequest(msg)
+}
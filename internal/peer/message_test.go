@@ -2,6 +2,7 @@ package peer
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -28,7 +29,7 @@ func TestMessage(t *testing.T) {
 		t.Errorf("Wire bytes mismatch. Got %v, Want %v", buf.Bytes(), expected)
 	}
 
-	readMsg, err := ReadMessage(&buf)
+	readMsg, err := ReadMessage(&buf, 1<<20)
 	if err != nil {
 		t.Fatalf("ReadMessage() error = %v", err)
 	}
@@ -53,7 +54,7 @@ func TestKeepAlive(t *testing.T) {
 		t.Errorf("KeepAlive bytes mismatch")
 	}
 
-	readMsg, err := ReadMessage(&buf)
+	readMsg, err := ReadMessage(&buf, 1<<20)
 	if err != nil {
 		t.Fatalf("ReadMessage() error = %v", err)
 	}
@@ -62,3 +63,68 @@ func TestKeepAlive(t *testing.T) {
 		t.Errorf("Expected nil message (keep-alive), got %v", readMsg)
 	}
 }
+
+func TestRequestAndPiece(t *testing.T) {
+	req := &Message{ID: MsgRequest, Payload: FormatRequest(3, 16384, 1024)}
+	index, begin, length, err := ParseRequest(req)
+	if err != nil {
+		t.Fatalf("ParseRequest() error = %v", err)
+	}
+	if index != 3 || begin != 16384 || length != 1024 {
+		t.Errorf("ParseRequest() = %d, %d, %d, want 3, 16384, 1024", index, begin, length)
+	}
+
+	block := []byte("block data")
+	msg := &Message{ID: MsgPiece, Payload: FormatPiece(3, 16384, block)}
+	index, begin, got, err := ParsePiece(msg)
+	if err != nil {
+		t.Fatalf("ParsePiece() error = %v", err)
+	}
+	if index != 3 || begin != 16384 || !bytes.Equal(got, block) {
+		t.Errorf("ParsePiece() = %d, %d, %q", index, begin, got)
+	}
+
+	if _, _, _, err := ParsePiece(&Message{ID: MsgPiece, Payload: []byte{1, 2}}); err == nil {
+		t.Error("ParsePiece() accepted a short payload")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	msg := &Message{ID: MsgCancel, Payload: FormatCancel(7, 32768, 16384)}
+
+	var buf bytes.Buffer
+	if err := msg.Write(&buf); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	// Length 13, ID 8, then index/begin/length.
+	expected := []byte{0, 0, 0, 13, 8, 0, 0, 0, 7, 0, 0, 0x80, 0, 0, 0, 0x40, 0}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Wire bytes mismatch. Got %v, Want %v", buf.Bytes(), expected)
+	}
+
+	readMsg, err := ReadMessage(&buf, 1<<20)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	index, begin, length, err := ParseCancel(readMsg)
+	if err != nil {
+		t.Fatalf("ParseCancel() error = %v", err)
+	}
+	if index != 7 || begin != 32768 || length != 16384 {
+		t.Errorf("ParseCancel() = %d, %d, %d, want 7, 32768, 16384", index, begin, length)
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	// A 4 GiB length prefix must be refused without reading on.
+	buf := bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 7})
+	if _, err := ReadMessage(buf, 1+8+16384); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("ReadMessage() error = %v, want ErrMessageTooLong", err)
+	}
+
+	var ok bytes.Buffer
+	(&Message{ID: MsgPiece, Payload: make([]byte, 8+16384)}).Write(&ok)
+	if _, err := ReadMessage(&ok, 1+8+16384); err != nil {
+		t.Errorf("ReadMessage() error = %v for a full block", err)
+	}
+}
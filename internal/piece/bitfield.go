@@ -1,5 +1,10 @@
 package piece
 
+import (
+	"errors"
+	"fmt"
+)
+
 // Bitfield represents the pieces a peer has.
 type Bitfield []byte
 
@@ -26,3 +31,28 @@ func (bf Bitfield) SetPiece(index int) {
 
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+// ClearPiece clears a bit in the bitfield.
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+
+	bf[byteIndex] &^= 1 << (7 - offset)
+}
+
+// Check makes sure a bitfield received from a peer fits a torrent of
+// numPieces pieces: one bit per piece, rounded up to whole bytes, with
+// the spare bits at the end cleared.
+func (bf Bitfield) Check(numPieces int) error {
+	if len(bf) != (numPieces+7)/8 {
+		return fmt.Errorf("bitfield of %d bytes for %d pieces", len(bf), numPieces)
+	}
+	if spare := len(bf)*8 - numPieces; spare > 0 && bf[len(bf)-1]&(1<<spare-1) != 0 {
+		return errors.New("bitfield has spare bits set")
+	}
+	return nil
+}
@@ -32,4 +32,30 @@ func TestBitfield(t *testing.T) {
 	if bf[1] != 0x80 {
 		t.Errorf("Bitfield[1] = %x, want 0x80", bf[1])
 	}
+
+	// Clear 7th piece again
+	bf.ClearPiece(7)
+	if bf[0] != 0x80 || bf.HasPiece(7) {
+		t.Errorf("Bitfield[0] = %x after ClearPiece(7), want 0x80", bf[0])
+	}
+}
+
+func TestBitfieldCheck(t *testing.T) {
+	tests := []struct {
+		bf    Bitfield
+		valid bool
+	}{
+		{Bitfield{0xff, 0xe0}, true},  // 11 pieces
+		{Bitfield{0xff, 0xf0}, false}, // A spare bit set
+		{Bitfield{0xff, 0xe0, 0}, false},
+		{Bitfield{0xff}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.bf.Check(11); (err == nil) != tt.valid {
+			t.Errorf("%x.Check(11) = %v, want valid = %v", []byte(tt.bf), err, tt.valid)
+		}
+	}
+	if err := (Bitfield{0xff}).Check(8); err != nil {
+		t.Errorf("full byte Check(8) = %v", err)
+	}
 }
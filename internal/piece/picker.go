@@ -0,0 +1,271 @@
+package piece
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RandomFirstPieces is how many pieces are picked at random before switching
+// to rarest first. A new peer wants something to trade quickly, and rare
+// pieces are by definition slow to get.
+const RandomFirstPieces = 4
+
+type pieceState uint8
+
+const (
+	stateMissing pieceState = iota
+	stateActive             // handed out to a peer
+	stateDone               // verified and stored
+)
+
+// Picker decides which piece to download next. It aggregates the bitfields
+// and Have messages of every connected peer into availability counts and
+// hands out the rarest piece a given peer can provide.
+//
+// Pieces have priorities: higher ones go first and skipped ones are
+// never picked. For streaming, pieces can also be given deadlines, which
+// go before anything else, earliest first, even if skipped; and a read
+// cursor, from which the next pieces are fetched in order. Everything
+// else is picked rarest first.
+// It is safe for concurrent use.
+type Picker struct {
+	mu           sync.Mutex
+	rng          *rand.Rand
+	availability []int
+	state        []pieceState
+	priority     []Priority
+	numDone      int
+
+	deadlines map[int]time.Time
+	// Pieces cursor to cursor+readahead-1 are picked in order; a negative
+	// readahead means up to the last piece (sequential mode). cursor is -1
+	// when there is no reader.
+	cursor, readahead int
+	sequential        bool
+}
+
+// NewPicker creates a picker for numPieces pieces, none of them done.
+func NewPicker(numPieces int) *Picker {
+	return &Picker{
+		rng:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+		priority:     make([]Priority, numPieces),
+		deadlines:    make(map[int]time.Time),
+		cursor:       -1,
+	}
+}
+
+// SetDeadline asks for piece index to be downloaded before t. Pieces
+// with deadlines are picked before any other, the earliest first. A zero
+// t removes the deadline.
+func (p *Picker) SetDeadline(index int, t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.state) {
+		return
+	}
+	if t.IsZero() || p.state[index] == stateDone {
+		delete(p.deadlines, index)
+		return
+	}
+	p.deadlines[index] = t
+}
+
+// SetPriority changes the priority of piece index. Skipping a piece that
+// is being downloaded doesn't stop the download.
+func (p *Picker) SetPriority(index int, prio Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.priority) {
+		p.priority[index] = prio
+	}
+}
+
+// SetCursor moves the read cursor: the readahead pieces from index on are
+// picked in order, after those with deadlines. A negative index removes
+// the cursor.
+func (p *Picker) SetCursor(index, readahead int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cursor, p.readahead = index, readahead
+}
+
+// SetSequential switches to downloading in order, from the cursor if
+// there is one, or from the first piece.
+func (p *Picker) SetSequential(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = on
+}
+
+// AddBitfield counts every piece in bf as available from one more peer.
+func (p *Picker) AddBitfield(bf Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// RemoveBitfield undoes AddBitfield, typically when a peer disconnects.
+func (p *Picker) RemoveBitfield(bf Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if bf.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+// AddHave counts a single piece announced by a Have message.
+func (p *Picker) AddHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Availability returns how many connected peers have piece index.
+func (p *Picker) Availability(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.availability[index]
+}
+
+// Availabilities returns the availability of every piece.
+func (p *Picker) Availabilities() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.availability...)
+}
+
+// Pick selects a missing piece that a peer has, going by the peer's
+// bitfield has, and marks it active: the one with the earliest deadline,
+// else the next wanted one in order after the read cursor, else the
+// rarest of the highest priority. Ties are broken at random. It returns
+// false if the peer has nothing we still need that isn't already being
+// downloaded.
+func (p *Picker) Pick(has Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pickable := func(i int) bool {
+		return p.state[i] == stateMissing && has.HasPiece(i)
+	}
+	wanted := func(i int) bool {
+		return pickable(i) && p.priority[i] != PrioritySkip
+	}
+	take := func(i int) (int, bool) {
+		p.state[i] = stateActive
+		return i, true
+	}
+
+	urgent := -1
+	for i, t := range p.deadlines {
+		if pickable(i) && (urgent == -1 || t.Before(p.deadlines[urgent])) {
+			urgent = i
+		}
+	}
+	if urgent != -1 {
+		return take(urgent)
+	}
+
+	from, end := p.cursor, p.cursor+p.readahead
+	if p.sequential {
+		from = max(from, 0)
+		end = len(p.state)
+	}
+	if from >= 0 {
+		for i := from; i < min(end, len(p.state)); i++ {
+			if wanted(i) {
+				return take(i)
+			}
+		}
+	}
+
+	randomFirst := p.numDone < RandomFirstPieces
+	best, bestPrio, bestAvail, ties := -1, PrioritySkip, 0, 0
+	for i := range p.state {
+		if !wanted(i) {
+			continue
+		}
+
+		prio, avail := p.priority[i], p.availability[i]
+		if randomFirst {
+			avail = 0 // Every candidate is equally good
+		}
+
+		switch {
+		case best == -1 || prio > bestPrio || prio == bestPrio && avail < bestAvail:
+			best, bestPrio, bestAvail, ties = i, prio, avail, 1
+		case prio == bestPrio && avail == bestAvail:
+			// Reservoir sampling keeps each tie equally likely.
+			ties++
+			if p.rng.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	if best == -1 {
+		return 0, false
+	}
+	return take(best)
+}
+
+// Release returns an active piece to the pool, e.g. after a failed download.
+func (p *Picker) Release(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == stateActive {
+		p.state[index] = stateMissing
+	}
+}
+
+// MarkDone records that piece index is verified and stored.
+func (p *Picker) MarkDone(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] != stateDone {
+		p.state[index] = stateDone
+		p.numDone++
+	}
+	delete(p.deadlines, index)
+}
+
+// MarkMissing undoes MarkDone, e.g. when a recheck finds the data corrupt.
+func (p *Picker) MarkMissing(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == stateDone {
+		p.state[index] = stateMissing
+		p.numDone--
+	}
+}
+
+// InEndgame reports whether every piece we still need has been handed out.
+// From then on the engine may request the same blocks from several peers.
+// Skipped pieces don't count as needed.
+func (p *Picker) InEndgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active := false
+	for i, st := range p.state {
+		if p.priority[i] == PrioritySkip {
+			continue
+		}
+		switch st {
+		case stateMissing:
+			return false
+		case stateActive:
+			active = true
+		}
+	}
+	return active // Else nothing is left at all
+}
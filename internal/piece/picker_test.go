@@ -0,0 +1,171 @@
+package piece
+
+import (
+	"testing"
+	"time"
+)
+
+func fullBitfield(n int) Bitfield {
+	bf := make(Bitfield, (n+7)/8)
+	for i := 0; i < n; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	p := NewPicker(4)
+	// Get past the random-first phase.
+	p.numDone = RandomFirstPieces
+
+	// Pieces 0-2 are on two peers, piece 3 only on one.
+	p.AddBitfield(fullBitfield(4))
+	common := make(Bitfield, 1)
+	common.SetPiece(0)
+	common.SetPiece(1)
+	common.SetPiece(2)
+	p.AddBitfield(common)
+
+	index, ok := p.Pick(fullBitfield(4))
+	if !ok || index != 3 {
+		t.Fatalf("Pick() = %d, %v, want the rare piece 3", index, ok)
+	}
+
+	// A peer without piece 3 still gets a piece it has.
+	index, ok = p.Pick(common)
+	if !ok || !common.HasPiece(index) {
+		t.Fatalf("Pick() = %d, %v, want a piece the peer has", index, ok)
+	}
+}
+
+func TestPickerOnlyOffersWhatPeerHas(t *testing.T) {
+	p := NewPicker(16)
+	bf := make(Bitfield, 2)
+	bf.SetPiece(9)
+	p.AddBitfield(bf)
+
+	index, ok := p.Pick(bf)
+	if !ok || index != 9 {
+		t.Fatalf("Pick() = %d, %v, want 9", index, ok)
+	}
+
+	// Piece 9 is active now, so there is nothing left for this peer.
+	if _, ok := p.Pick(bf); ok {
+		t.Error("Pick() handed out an active piece")
+	}
+
+	// Releasing makes it available again.
+	p.Release(9)
+	if index, ok := p.Pick(bf); !ok || index != 9 {
+		t.Errorf("Pick() after Release = %d, %v, want 9", index, ok)
+	}
+
+	p.MarkDone(9)
+	p.Release(9) // must not resurrect a done piece
+	if _, ok := p.Pick(bf); ok {
+		t.Error("Pick() handed out a done piece")
+	}
+}
+
+func TestPickerRandomFirst(t *testing.T) {
+	// During the random-first phase availability is ignored, so over
+	// many trials more than one piece must come up first.
+	seen := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		p := NewPicker(8)
+		p.AddBitfield(fullBitfield(8))
+		p.AddHave(0) // piece 0 is the most common, 1-7 tie
+		index, _ := p.Pick(fullBitfield(8))
+		seen[index] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("random-first picked the same piece every time: %v", seen)
+	}
+}
+
+func TestPickerStreaming(t *testing.T) {
+	p := NewPicker(10)
+	all := fullBitfield(10)
+	p.AddBitfield(all)
+
+	// Deadlines come first, earliest first, and may be changed or removed.
+	now := time.Now()
+	p.SetDeadline(7, now.Add(2*time.Second))
+	p.SetDeadline(5, now.Add(time.Second))
+	p.SetDeadline(9, now.Add(3*time.Second))
+	p.SetDeadline(9, time.Time{})
+	for _, want := range []int{5, 7} {
+		if index, ok := p.Pick(all); !ok || index != want {
+			t.Fatalf("Pick() = %d, %v, want deadline piece %d", index, ok, want)
+		}
+	}
+
+	// Then the readahead window after the cursor, in order.
+	p.SetCursor(2, 2)
+	for _, want := range []int{2, 3} {
+		if index, ok := p.Pick(all); !ok || index != want {
+			t.Fatalf("Pick() = %d, %v, want readahead piece %d", index, ok, want)
+		}
+	}
+	// Past the window it is rarest first again; make piece 0 the rare one.
+	p.numDone = RandomFirstPieces
+	p.AddBitfield(Bitfield{0x7f, 0xc0})
+	if index, ok := p.Pick(all); !ok || index != 0 {
+		t.Fatalf("Pick() = %d, %v, want the rare piece 0", index, ok)
+	}
+
+	// Sequential mode takes everything after the cursor in order.
+	p.SetSequential(true)
+	for _, want := range []int{4, 6, 8, 9, 1} {
+		if index, ok := p.Pick(all); !ok || index != want {
+			t.Fatalf("Pick() = %d, %v, want %d", index, ok, want)
+		}
+	}
+}
+
+func TestPickerPriorities(t *testing.T) {
+	p := NewPicker(4)
+	p.numDone = RandomFirstPieces
+	all := fullBitfield(4)
+	p.AddBitfield(all)
+	p.AddHave(1) // piece 1 is no longer the rarest
+
+	p.SetPriority(0, PrioritySkip)
+	p.SetPriority(1, PriorityHigh)
+	p.SetPriority(3, PriorityLow)
+
+	// Highest priority first, even if it's more common; never a skipped piece.
+	for _, want := range []int{1, 2, 3} {
+		if index, ok := p.Pick(all); !ok || index != want {
+			t.Fatalf("Pick() = %d, %v, want %d", index, ok, want)
+		}
+	}
+	if index, ok := p.Pick(all); ok {
+		t.Fatalf("Pick() = %d, want nothing but the skipped piece left", index)
+	}
+	if !p.InEndgame() {
+		t.Error("InEndgame() = false with every wanted piece handed out")
+	}
+
+	// A deadline still fetches a skipped piece.
+	p.SetDeadline(0, time.Now())
+	if index, ok := p.Pick(all); !ok || index != 0 {
+		t.Fatalf("Pick() = %d, %v, want the piece with a deadline", index, ok)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, prio := range []Priority{PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh} {
+		got, err := ParsePriority(prio.String())
+		if err != nil || got != prio {
+			t.Errorf("ParsePriority(%q) = %v, %v", prio.String(), got, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority accepted an unknown name")
+	}
+	var zero Priority
+	if zero != PriorityNormal {
+		t.Errorf("zero Priority is %v, want normal", zero)
+	}
+}
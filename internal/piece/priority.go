@@ -0,0 +1,39 @@
+package piece
+
+import "fmt"
+
+// Priority is how much a piece is wanted. Higher priorities are picked
+// first; skipped pieces are not downloaded at all. The zero value is
+// PriorityNormal.
+type Priority int8
+
+const (
+	PrioritySkip Priority = iota - 2
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = map[Priority]string{
+	PrioritySkip:   "skip",
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority parses the name of a priority, as returned by String.
+func ParsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
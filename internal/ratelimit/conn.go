@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+)
+
+// writeChunk bounds how much is written per wait, so large writes are
+// spread out instead of sent in one burst after a long pause.
+const writeChunk = 16 * 1024
+
+// Conn throttles a net.Conn: reads are charged to the read limiters after
+// the fact, writes to the write limiters before they happen.
+type Conn struct {
+	net.Conn
+	read, write []*Limiter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn wraps conn. Each chain typically holds a peer, a torrent and a
+// session limiter; any of them may be nil.
+func NewConn(conn net.Conn, read, write []*Limiter) *Conn {
+	return &Conn{
+		Conn:   conn,
+		read:   read,
+		write:  write,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := Wait(c.closed, n, c.read...); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > writeChunk {
+			chunk = chunk[:writeChunk]
+		}
+		if err := Wait(c.closed, len(chunk), c.write...); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection and aborts any throttled read or write.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,114 @@
+// Package ratelimit throttles peer connections with token buckets.
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Wait when the wait is cancelled.
+var ErrClosed = errors.New("ratelimit: closed")
+
+// Limiter is a token bucket refilled at a fixed number of bytes per second.
+// Bytes may be taken on credit: a caller taking more than is available
+// waits until the debt is paid off. A rate of 0 means unlimited.
+// It is safe for concurrent use, and the rate can change at any time.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 = unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter allowing rate bytes per second.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// Rate returns the current rate in bytes per second, 0 if unlimited.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// SetRate changes the rate. A rate <= 0 removes the limit.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.refill(time.Now())
+	l.rate = float64(rate)
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// burst is how many unused bytes may pile up: half a second's worth, so
+// an idle connection can't follow up with a long spike.
+func (l *Limiter) burst() float64 {
+	return l.rate / 2
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst() {
+			l.tokens = l.burst()
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n bytes and returns how long to wait before using them.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait takes n bytes from every limiter in chain and blocks until all of
+// them allow it, or cancel is closed. Nil limiters are skipped, so levels
+// that have no limit can simply be left out.
+func Wait(cancel <-chan struct{}, n int, chain ...*Limiter) error {
+	var delay time.Duration
+	for _, l := range chain {
+		if d := l.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-cancel:
+		return ErrClosed
+	}
+}
+
+// Rates is a pair of limits in bytes per second. 0 means unlimited.
+type Rates struct {
+	Download int64
+	Upload   int64
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(100 * 1024)
+
+	// The bucket starts empty, so 50KB at 100KB/s take half a second.
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := Wait(nil, 10*1024, l); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("50KB at 100KB/s took %v, want ~500ms", elapsed)
+	}
+
+	// Lifting the limit at runtime takes effect immediately.
+	l.SetRate(0)
+	start = time.Now()
+	Wait(nil, 10<<20, l)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("unlimited Wait() took %v", elapsed)
+	}
+}
+
+func TestWaitUsesSlowestLimiter(t *testing.T) {
+	fast, slow := NewLimiter(1<<30), NewLimiter(1024)
+
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- Wait(cancel, 4096, fast, nil, slow) }()
+
+	select {
+	case <-done:
+		t.Fatal("Wait() did not block on the slow limiter")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(cancel)
+	if err := <-done; err != ErrClosed {
+		t.Errorf("cancelled Wait() = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestConnThrottlesWrites(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	c := NewConn(local, nil, []*Limiter{NewLimiter(64 * 1024)})
+	defer c.Close()
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 48*1024)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("48KB at 64KB/s took only %v", elapsed)
+	}
+}
+
+func TestScheduleLimits(t *testing.T) {
+	normal := Rates{Download: 1000, Upload: 100}
+	alt := Rates{Download: 10, Upload: 1}
+	at := func(clock string) time.Time {
+		d, err := ParseClock(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local).Add(d)
+	}
+
+	office := Schedule{Enabled: true, Alt: alt, From: 9 * time.Hour, To: 17 * time.Hour}
+	night := Schedule{Enabled: true, Alt: alt, From: 22 * time.Hour, To: 6 * time.Hour}
+
+	tests := []struct {
+		s     Schedule
+		clock string
+		want  Rates
+	}{
+		{office, "08:59", normal},
+		{office, "09:00", alt},
+		{office, "16:59", alt},
+		{office, "17:00", normal},
+		{night, "23:30", alt},
+		{night, "05:00", alt},
+		{night, "12:00", normal},
+		{Schedule{Alt: alt, From: 0, To: 24 * time.Hour}, "12:00", normal}, // disabled
+	}
+	for _, tt := range tests {
+		if got := tt.s.Limits(normal, at(tt.clock)); got != tt.want {
+			t.Errorf("%s-%s at %s = %v, want %v", FormatClock(tt.s.From), FormatClock(tt.s.To), tt.clock, got, tt.want)
+		}
+	}
+
+	if _, err := ParseClock("25:00"); err == nil {
+		t.Error("ParseClock() accepted 25:00")
+	}
+}
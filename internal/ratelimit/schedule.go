@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schedule switches to alternative limits during part of the day, e.g.
+// to stay out of the way during office hours.
+type Schedule struct {
+	Enabled bool
+	Alt     Rates
+	// From and To are times of day, as offsets from midnight. The window
+	// wraps past midnight when To is before From.
+	From, To time.Duration
+}
+
+// Limits returns the rates in effect at now: s.Alt inside the window,
+// normal outside it or when the schedule is disabled.
+func (s Schedule) Limits(normal Rates, now time.Time) Rates {
+	if !s.Enabled || s.From == s.To {
+		return normal
+	}
+	y, m, d := now.Date()
+	t := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+
+	inside := s.From <= t && t < s.To
+	if s.To < s.From {
+		inside = t >= s.From || t < s.To
+	}
+	if inside {
+		return s.Alt
+	}
+	return normal
+}
+
+// ParseClock parses a time of day such as "09:30" into an offset from
+// midnight.
+func ParseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// FormatClock is the inverse of ParseClock.
+func FormatClock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
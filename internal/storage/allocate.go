@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Allocation is how FileBackend reserves disk space for new files.
+type Allocation int
+
+const (
+	// AllocateSparse only sets the length of a file, leaving the
+	// filesystem to find room as pieces are written. It's instant, but
+	// the disk can fill up halfway and large files tend to fragment.
+	AllocateSparse Allocation = iota
+	// AllocateFull reserves every block up front without writing them:
+	// fallocate on Linux, zero-filling where that isn't available.
+	AllocateFull
+	// AllocateZero writes zeros over the whole file.
+	AllocateZero
+)
+
+func (a Allocation) String() string {
+	switch a {
+	case AllocateSparse:
+		return "sparse"
+	case AllocateFull:
+		return "full"
+	case AllocateZero:
+		return "zero"
+	}
+	return fmt.Sprintf("Allocation(%d)", int(a))
+}
+
+// ParseAllocation parses the name of an allocation mode, as returned by
+// String.
+func ParseAllocation(s string) (Allocation, error) {
+	for _, a := range []Allocation{AllocateSparse, AllocateFull, AllocateZero} {
+		if s == a.String() {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown allocation mode %q", s)
+}
+
+// allocate grows f from length from to length to.
+func allocate(f *os.File, from, to int64, mode Allocation) error {
+	switch mode {
+	case AllocateFull:
+		if err := fallocate(f, from, to-from); err == nil || !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+		return zeroFill(f, from, to)
+	case AllocateZero:
+		return zeroFill(f, from, to)
+	}
+	return f.Truncate(to)
+}
+
+// zeroFill writes zeros over [from, to) of f.
+func zeroFill(f *os.File, from, to int64) error {
+	zeros := make([]byte, min(to-from, 1<<20))
+	for off := from; off < to; {
+		n, err := f.WriteAt(zeros[:min(to-off, int64(len(zeros)))], off)
+		if err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// ErrNoSpace is returned when the files of a torrent don't fit on disk.
+var ErrNoSpace = errors.New("storage: not enough free disk space")
+
+// checkSpace makes sure there is room for files that are about to be
+// created or grown to their full length, so a download fails right away
+// rather than when the disk fills up. Filesystems that can't tell their
+// free space are given the benefit of the doubt.
+func checkSpace(files []*diskFile) error {
+	need := make(map[string]int64) // by the directory the files go under
+	var dirs []string
+	for _, df := range files {
+		var size int64
+		if fi, err := os.Stat(df.path); err == nil {
+			size = fi.Size()
+		}
+		if size >= df.Length {
+			continue
+		}
+		dir := existingDir(df.path)
+		if _, ok := need[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		need[dir] += df.Length - size
+	}
+	for _, dir := range dirs {
+		if free, ok := freeSpace(dir); ok && need[dir] > free {
+			return fmt.Errorf("%w in %s: %d bytes needed, %d available", ErrNoSpace, dir, need[dir], free)
+		}
+	}
+	return nil
+}
+
+// existingDir returns the nearest directory above path that exists.
+func existingDir(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves n bytes of f at off, growing the file as needed.
+// Filesystems without support fail with an error matching
+// errors.ErrUnsupported.
+func fallocate(f *os.File, off, n int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, off, n)
+}
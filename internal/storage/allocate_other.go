@@ -0,0 +1,13 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// fallocate is only available on Linux; callers zero-fill instead.
+func fallocate(f *os.File, off, n int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocationModes(t *testing.T) {
+	for _, mode := range []Allocation{AllocateSparse, AllocateFull, AllocateZero} {
+		t.Run(mode.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f")
+			// Growing a file must keep what is in it.
+			if err := os.WriteFile(path, []byte("kept"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			s, err := FileBackend{Allocation: mode}.Open(Layout{Files: []File{{Path: path, Length: 3 << 20}}})
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer s.Close()
+
+			fi, err := os.Stat(path)
+			if err != nil || fi.Size() != 3<<20 {
+				t.Fatalf("file size = %v, %v; want %d", fi.Size(), err, 3<<20)
+			}
+			got := make([]byte, 3<<20)
+			if _, err := s.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			want := append([]byte("kept"), make([]byte, 3<<20-4)...)
+			if !bytes.Equal(got, want) {
+				t.Error("allocated file doesn't read back as its old data and zeros")
+			}
+		})
+	}
+}
+
+func TestParseAllocation(t *testing.T) {
+	for _, mode := range []Allocation{AllocateSparse, AllocateFull, AllocateZero} {
+		if got, err := ParseAllocation(mode.String()); got != mode || err != nil {
+			t.Errorf("ParseAllocation(%q) = %v, %v", mode, got, err)
+		}
+	}
+	if _, err := ParseAllocation("prealloc"); err == nil {
+		t.Error("ParseAllocation accepted an unknown mode")
+	}
+}
+
+func TestOpenChecksFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok := freeSpace(dir); !ok {
+		t.Skip("free space unknown on this system")
+	}
+	files := []File{
+		{Path: filepath.Join(dir, "small"), Length: 10},
+		{Path: filepath.Join(dir, "sub", "huge"), Length: 1 << 60},
+	}
+	_, err := FileBackend{}.Open(Layout{Files: files})
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Open() error = %v, want ErrNoSpace", err)
+	}
+	if _, err := os.Stat(files[0].Path); !os.IsNotExist(err) {
+		t.Error("files were created before the space check failed")
+	}
+
+	// Skipped files don't need room.
+	files[1].Skip = true
+	s, err := FileBackend{}.Open(Layout{Files: files, PieceLength: 16, PartPath: filepath.Join(dir, "parts")})
+	if err != nil {
+		t.Fatalf("Open() with the huge file skipped: %v", err)
+	}
+	s.Close()
+}
+
+func TestPartSuffix(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	// Pieces of 10 bytes: a is pieces 0 and 1, b pieces 1 and 2.
+	layout := Layout{
+		Files:       []File{{Path: path("a"), Length: 12}, {Path: path("b"), Length: 13}},
+		PieceLength: 10,
+	}
+	b := FileBackend{PartSuffix: true}
+	s, err := b.Open(layout)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer s.Close()
+
+	exists := func(name string) bool {
+		_, err := os.Stat(path(name))
+		return err == nil
+	}
+	if exists("a") || !exists("a.part") || !exists("b.part") {
+		t.Fatal("incomplete files not created with a .part suffix")
+	}
+	if states := b.Stat(layout); states[0].Path != path("a.part") || states[0].Length != 12 {
+		t.Errorf("Stat() = %+v, want a.part described", states)
+	}
+
+	data := []byte("0123456789abcdefghijklmno")
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	for _, index := range []int{0, 2, 1} {
+		if err := s.MarkComplete(index); err != nil {
+			t.Fatalf("MarkComplete(%d) error = %v", index, err)
+		}
+		if index == 2 && (exists("a") || exists("b")) {
+			t.Fatal("file renamed before all its pieces were complete")
+		}
+	}
+	if !exists("a") || !exists("b") || exists("a.part") || exists("b.part") {
+		t.Fatal("complete files not renamed")
+	}
+
+	// Still readable and writable after the rename.
+	if _, err := s.WriteAt([]byte("X"), 11); err != nil {
+		t.Fatalf("WriteAt() after rename: %v", err)
+	}
+	got, _ := os.ReadFile(path("a"))
+	if string(got) != "0123456789aX" {
+		t.Errorf("a = %q after rename", got)
+	}
+}
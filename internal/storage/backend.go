@@ -0,0 +1,89 @@
+package storage
+
+import "io"
+
+// Backend stores the content of torrents. The engine only talks to
+// storage through this interface, so embedders can keep data anywhere:
+// FileBackend keeps it in files, MemoryBackend in memory, MmapBackend in
+// memory-mapped files.
+type Backend interface {
+	// Open prepares storage for a torrent, creating it if needed.
+	Open(layout Layout) (Torrent, error)
+}
+
+// Layout describes the content of a torrent to a backend.
+type Layout struct {
+	InfoHash    [20]byte
+	PieceLength int64
+	// Files are in content order. File backends create them at their
+	// paths; others may use the paths as keys, or ignore them.
+	Files []File
+	// PartPath is where a file backend may keep the data of skipped
+	// files. Empty if there is none.
+	PartPath string
+	// Root is the directory the files must stay in, if set. File backends
+	// refuse files outside it, or reached through a symbolic link below
+	// it.
+	Root string
+}
+
+// Length is the size of the whole content.
+func (l Layout) Length() int64 {
+	var n int64
+	for _, f := range l.Files {
+		n += f.Length
+	}
+	return n
+}
+
+// NumPieces is how many pieces the content is split into.
+func (l Layout) NumPieces() int {
+	if l.PieceLength <= 0 {
+		return 0
+	}
+	return int((l.Length() + l.PieceLength - 1) / l.PieceLength)
+}
+
+// Torrent is the stored content of one torrent. Offsets are in the
+// content, the concatenation of the torrent's files. It must be safe for
+// concurrent use; the engine never writes the same range concurrently.
+type Torrent interface {
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete is called once piece index is verified and written.
+	MarkComplete(index int) error
+	// Flush makes everything written so far durable.
+	Flush() error
+	Close() error
+}
+
+// FileSkipper is implemented by a Torrent that can leave files out, see
+// File.Skip.
+type FileSkipper interface {
+	// SetSkip changes whether file i, in Layout.Files, is wanted.
+	SetSkip(i int, skip bool) error
+}
+
+// Statter is implemented by a Backend whose data can change between
+// runs behind the engine's back, such as files on disk. Resume data is
+// only trusted while Stat reports the same as when it was saved.
+type Statter interface {
+	// Stat describes the stored data of a torrent without opening it.
+	Stat(layout Layout) []FileState
+}
+
+// IncompleteNamer is implemented by a Backend that keeps incomplete
+// files under a name of their own, see FileBackend.PartSuffix.
+type IncompleteNamer interface {
+	// IncompletePath is where f is kept until all its pieces are
+	// complete.
+	IncompletePath(f File) string
+}
+
+// FileState is the size and modification time of a stored file. A
+// missing file has a Length of -1.
+type FileState struct {
+	Path    string
+	Length  int64
+	ModTime int64 // Unix nanoseconds
+}
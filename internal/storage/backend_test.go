@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// testBackend runs a backend through what the engine does with it: write
+// pieces spanning files, read them back, flush, and find the data again
+// after reopening.
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+	dir := t.TempDir()
+	layout := Layout{
+		InfoHash:    [20]byte{1},
+		PieceLength: 8,
+		Files: []File{
+			{Path: filepath.Join(dir, "a"), Length: 5},
+			{Path: filepath.Join(dir, "empty"), Length: 0},
+			{Path: filepath.Join(dir, "sub", "b"), Length: 15},
+		},
+	}
+	if n := layout.NumPieces(); n != 3 {
+		t.Fatalf("NumPieces() = %d, want 3", n)
+	}
+
+	s, err := b.Open(layout)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	data := []byte("0123456789abcdefghij")
+	for off := 0; off < len(data); off += 8 {
+		end := min(off+8, len(data))
+		if n, err := s.WriteAt(data[off:end], int64(off)); err != nil || n != end-off {
+			t.Fatalf("WriteAt(%d) = %d, %v", off, n, err)
+		}
+		if err := s.MarkComplete(off / 8); err != nil {
+			t.Fatalf("MarkComplete(%d) error = %v", off/8, err)
+		}
+	}
+	if _, err := s.WriteAt([]byte("xx"), 19); err == nil {
+		t.Error("WriteAt past the end succeeded")
+	}
+
+	got := make([]byte, 10)
+	if n, err := s.ReadAt(got, 3); err != nil || n != 10 || !bytes.Equal(got, data[3:13]) {
+		t.Errorf("ReadAt(3) = %d, %v, %q", n, err, got)
+	}
+	if n, err := s.ReadAt(got, 15); err != io.EOF || n != 5 || !bytes.Equal(got[:5], data[15:]) {
+		t.Errorf("ReadAt past the end = %d, %v, %q", n, err, got[:n])
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s, err = b.Open(layout)
+	if err != nil {
+		t.Fatalf("Open() again error = %v", err)
+	}
+	defer s.Close()
+	got = make([]byte, len(data))
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("after reopening, ReadAt = %q, %v", got, err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	testBackend(t, FileBackend{})
+}
+
+func TestMemoryBackend(t *testing.T) {
+	b := NewMemoryBackend()
+	testBackend(t, b)
+
+	s, _ := b.Open(Layout{InfoHash: [20]byte{1}, PieceLength: 8, Files: []File{{Length: 20}}})
+	m := s.(*MemoryStorage)
+	if !m.Completed(2) || m.Completed(3) {
+		t.Error("Completed() doesn't match the pieces marked complete")
+	}
+	m.WriteAt([]byte("abcd"), 0)
+	if len(m.undo) != 0 {
+		t.Error("storage that can't crash keeps overwritten data")
+	}
+}
+
+func TestMemoryBackendCrash(t *testing.T) {
+	b := NewMemoryBackend()
+	b.Crashable = true
+	s, _ := b.Open(Layout{InfoHash: [20]byte{2}, PieceLength: 4, Files: []File{{Length: 8}}})
+	m := s.(*MemoryStorage)
+
+	m.WriteAt([]byte("abcd"), 0)
+	m.MarkComplete(0)
+	m.Flush()
+	m.WriteAt([]byte("efgh"), 4)
+	m.MarkComplete(1)
+	m.WriteAt([]byte("xy"), 2)
+	b.Crash()
+
+	got := make([]byte, 8)
+	m.ReadAt(got, 0)
+	if want := []byte("abcd\x00\x00\x00\x00"); !bytes.Equal(got, want) {
+		t.Errorf("data after Crash() = %q, want %q", got, want)
+	}
+	if !m.Completed(0) || m.Completed(1) {
+		t.Error("Crash() kept an unflushed complete mark or lost a flushed one")
+	}
+}
+
+func TestFileBackendStat(t *testing.T) {
+	dir := t.TempDir()
+	layout := Layout{
+		Files: []File{
+			{Path: filepath.Join(dir, "a"), Length: 4},
+			{Path: filepath.Join(dir, "b"), Length: 4, Skip: true},
+		},
+		PieceLength: 4,
+		PartPath:    filepath.Join(dir, "parts"),
+	}
+	var b FileBackend
+	for _, st := range b.Stat(layout) {
+		if st.Length != -1 {
+			t.Errorf("%s: Length = %d before opening, want -1", st.Path, st.Length)
+		}
+	}
+
+	s, err := b.Open(layout)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer s.Close()
+	states := b.Stat(layout)
+	if len(states) != 2 || states[0].Length != 4 || states[1].Length != -1 {
+		t.Errorf("Stat() = %+v, want a created and b missing, no part file", states)
+	}
+}
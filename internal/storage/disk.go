@@ -1,47 +1,506 @@
 package storage
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
-// Storage handles reading and writing to the target file.
-type Storage struct {
-	file *os.File
+// File is one file of a torrent's content on disk.
+type File struct {
+	Path   string
+	Length int64
+	// Skip marks a file nobody wants. It is not created; see Storage.
+	Skip bool
 }
 
-// NewStorage opens or creates the file at path with the given length.
-func NewStorage(path string, length int64) (*Storage, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+// FileBackend keeps torrents in files, see FileStorage. The zero value
+// creates sparse files under their final names.
+type FileBackend struct {
+	// Allocation is how space is reserved for new files.
+	Allocation Allocation
+	// PartSuffix has files kept under their name plus ".part" until all
+	// of their pieces are complete, when they are renamed in one step.
+	PartSuffix bool
+}
+
+// partSuffix marks incomplete files, see FileBackend.PartSuffix.
+const partSuffix = ".part"
+
+// Open opens or creates the files of layout.
+func (b FileBackend) Open(layout Layout) (Torrent, error) {
+	if err := layout.CheckRoot(); err != nil {
+		return nil, err
+	}
+	return b.open(layout.Files, layout.PartPath, layout.PieceLength)
+}
+
+// Stat describes the files of layout as they are on disk, followed by
+// the part file if there is one. An incomplete file is described under
+// its ".part" name.
+func (b FileBackend) Stat(layout Layout) []FileState {
+	var states []FileState
+	for _, f := range layout.Files {
+		st := statFile(f.Path)
+		if st.Length < 0 && b.PartSuffix {
+			if part := statFile(f.Path + partSuffix); part.Length >= 0 {
+				st = part
+			}
+		}
+		states = append(states, st)
+	}
+	if layout.PartPath != "" {
+		if st := statFile(layout.PartPath); st.Length >= 0 {
+			states = append(states, st)
+		}
+	}
+	return states
+}
+
+// IncompletePath is where f is kept until complete: under its own path,
+// plus ".part" if PartSuffix is set.
+func (b FileBackend) IncompletePath(f File) string {
+	if b.PartSuffix && f.Length > 0 {
+		return f.Path + partSuffix
+	}
+	return f.Path
+}
+
+func statFile(path string) FileState {
+	fi, err := os.Stat(path)
 	if err != nil {
+		return FileState{Path: path, Length: -1}
+	}
+	return FileState{Path: path, Length: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+}
+
+// FileStorage maps a torrent's content, one contiguous byte range, onto
+// its files.
+//
+// Skipped files are never created. Pieces that straddle a skipped file
+// and a wanted one are still downloaded, so their bytes in the skipped
+// file go to a part file instead, at the same offset as in the content.
+// The part file is sparse: only those boundary pieces take up space. A
+// skipped file that is on disk already, say from before it was skipped,
+// keeps being used.
+//
+// With a part suffix, files are created under a temporary name and only
+// get their own once MarkComplete has been called for all their pieces.
+type FileStorage struct {
+	pieceLength int64
+	length      int64
+	allocation  Allocation
+	partSuffix  bool
+
+	mu       sync.RWMutex // guards the handles of files; Lock to change them
+	files    []*diskFile
+	complete []bool // pieces, tracked with a part suffix only
+
+	partPath string
+	partMu   sync.Mutex
+	part     *os.File // opened on first use
+}
+
+type diskFile struct {
+	File
+	path   string   // where the file is: Path, or Path plus a part suffix
+	offset int64    // in the content
+	f      *os.File // nil while the file is in the part file
+}
+
+// OpenFiles opens or creates the files making up a torrent's content, in
+// content order, creating directories as needed. partPath is where the
+// part file goes, and pieceLength lets SetSkip tell which bytes of a
+// file can be in it. New files are sparse; see FileBackend for more.
+func OpenFiles(files []File, partPath string, pieceLength int64) (*FileStorage, error) {
+	return FileBackend{}.open(files, partPath, pieceLength)
+}
+
+func (b FileBackend) open(files []File, partPath string, pieceLength int64) (*FileStorage, error) {
+	s := &FileStorage{
+		pieceLength: pieceLength,
+		allocation:  b.Allocation,
+		partSuffix:  b.PartSuffix,
+		partPath:    partPath,
+	}
+	// Find out which files there are before touching any of them.
+	exists := make([]bool, len(files))
+	var opening []*diskFile
+	for i, f := range files {
+		df := &diskFile{File: f, path: f.Path, offset: s.length}
+		s.length += f.Length
+		s.files = append(s.files, df)
+
+		_, err := os.Stat(f.Path)
+		if errors.Is(err, fs.ErrNotExist) && b.IncompletePath(f) != f.Path {
+			df.path = b.IncompletePath(f)
+			_, err = os.Stat(df.path)
+		}
+		exists[i] = err == nil
+		if exists[i] || !f.Skip {
+			opening = append(opening, df)
+		}
+	}
+	if b.PartSuffix && pieceLength > 0 {
+		s.complete = make([]bool, (s.length+pieceLength-1)/pieceLength)
+	}
+	if err := checkSpace(opening); err != nil {
 		return nil, err
 	}
 
-	// Truncate to ensure correct size
-	if err := file.Truncate(length); err != nil {
-		file.Close()
+	for i, df := range s.files {
+		var err error
+		switch {
+		case exists[i]:
+			err = df.open(s.allocation)
+		case !df.Skip:
+			err = s.create(df)
+		} // Else it stays in the part file
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if err := s.dropPartIfUnused(); err != nil {
+		s.Close()
 		return nil, err
 	}
+	return s, nil
+}
+
+// open creates the file if needed and brings it to its full length,
+// allocating what is missing.
+func (df *diskFile) open(allocation Allocation) error {
+	if dir := filepath.Dir(df.path); dir != "." {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(df.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	switch {
+	case err != nil:
+	case fi.Size() > df.Length:
+		err = f.Truncate(df.Length)
+	case fi.Size() < df.Length:
+		err = allocate(f, fi.Size(), df.Length, allocation)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	df.f = f
+	return nil
+}
+
+// finish renames a file that is complete to its own name. s.mu must be
+// held.
+func (s *FileStorage) finish(df *diskFile) error {
+	if df.f == nil || df.path == df.Path {
+		return nil
+	}
+	for first, last := s.pieces(df); first <= last; first++ {
+		if !s.complete[first] {
+			return nil
+		}
+	}
+	// Not every system can rename open files.
+	if err := df.f.Close(); err != nil {
+		return err
+	}
+	df.f = nil
+	renameErr := os.Rename(df.path, df.Path)
+	if renameErr == nil {
+		df.path = df.Path
+	}
+	f, err := os.OpenFile(df.path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	df.f = f
+	return renameErr
+}
+
+// pieces returns the first and last piece overlapping df.
+func (s *FileStorage) pieces(df *diskFile) (first, last int) {
+	return int(df.offset / s.pieceLength), int((df.offset + df.Length - 1) / s.pieceLength)
+}
+
+// SetSkip changes whether file i is wanted. A file that becomes wanted is
+// created, and whatever of it was kept in the part file moves into it.
+// Skipping a file leaves it on disk.
+func (s *FileStorage) SetSkip(i int, skip bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	df := s.files[i]
+	df.Skip = skip
+	if skip || df.f != nil {
+		return nil
+	}
+	if err := checkSpace([]*diskFile{df}); err != nil {
+		return err
+	}
+	if err := s.create(df); err != nil {
+		return err
+	}
+	if s.complete != nil {
+		// Its pieces may all have been downloaded as boundary pieces.
+		if err := s.finish(df); err != nil {
+			return err
+		}
+	}
+	return s.dropPartIfUnused()
+}
 
-	return &Storage{file: file}, nil
+// create creates a file that was kept in the part file so far, and moves
+// its bytes out of there. s.mu must be held, or s not shared yet.
+func (s *FileStorage) create(df *diskFile) error {
+	if err := df.open(s.allocation); err != nil {
+		return err
+	}
+	// Only the pieces the file shares with its neighbours can have been
+	// downloaded while it was skipped: its first and its last.
+	start, end := df.offset, df.offset+df.Length
+	if s.pieceLength > 0 && s.partPath != "" {
+		firstEnd := min(end, (start/s.pieceLength+1)*s.pieceLength)
+		lastStart := max(firstEnd, end/s.pieceLength*s.pieceLength)
+		if err := s.moveFromPart(df, start, firstEnd); err != nil {
+			return err
+		}
+		if err := s.moveFromPart(df, lastStart, end); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Write writes a block of data at the specified offset.
-func (s *Storage) Write(offset int64, data []byte) error {
-	_, err := s.file.WriteAt(data, offset)
+// moveFromPart copies content bytes [start, end) from the part file into
+// df. s.mu must be held.
+func (s *FileStorage) moveFromPart(df *diskFile, start, end int64) error {
+	if start >= end {
+		return nil
+	}
+	part, err := s.partFile(false)
+	if err != nil || part == nil {
+		return err
+	}
+	buf := make([]byte, end-start)
+	if err := readFull(part, buf, start); err != nil {
+		return err
+	}
+	_, err = df.f.WriteAt(buf, start-df.offset)
 	return err
 }
 
-// Read reads a block of data from the specified offset.
-func (s *Storage) Read(offset int64, length int) ([]byte, error) {
-	buf := make([]byte, length)
-	_, err := s.file.ReadAt(buf, offset)
+// dropPartIfUnused removes the part file once every file is on disk.
+// s.mu must be held.
+func (s *FileStorage) dropPartIfUnused() error {
+	if s.partPath == "" {
+		return nil
+	}
+	for _, df := range s.files {
+		if df.f == nil {
+			return nil
+		}
+	}
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	if s.part != nil {
+		s.part.Close()
+		s.part = nil
+	}
+	if err := os.Remove(s.partPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// partFile returns the part file, opening it if needed. Unless create is
+// set it returns nil if there is no part file yet.
+func (s *FileStorage) partFile(create bool) (*os.File, error) {
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	if s.part != nil {
+		return s.part, nil
+	}
+	if s.partPath == "" {
+		return nil, errors.New("storage: no part file for skipped files")
+	}
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(s.partPath, flags, 0666)
+	if !create && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return buf, nil
+	s.part = f
+	return f, nil
+}
+
+// span calls fn for each file overlapping the content range [offset,
+// offset+length), with the overlap's position in the content and its
+// length. s.mu must be held.
+func (s *FileStorage) span(offset, length int64, fn func(df *diskFile, off, n int64) error) error {
+	end := offset + length
+	for _, df := range s.files {
+		from := max(offset, df.offset)
+		to := min(end, df.offset+df.Length)
+		if from >= to {
+			continue
+		}
+		if err := fn(df, from, to-from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteAt writes data at offset of the content.
+func (s *FileStorage) WriteAt(data []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(data)) > s.length {
+		return 0, errors.New("storage: write past the end of the content")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	written := 0
+	err := s.span(offset, int64(len(data)), func(df *diskFile, off, n int64) error {
+		chunk := data[off-offset : off-offset+n]
+		f, at := df.f, off-df.offset
+		if f == nil {
+			part, err := s.partFile(true)
+			if err != nil {
+				return err
+			}
+			f, at = part, off
+		}
+		m, err := f.WriteAt(chunk, at)
+		written += m
+		return err
+	})
+	return written, err
+}
+
+// ReadAt reads len(buf) bytes at offset of the content. Parts of skipped
+// files that were never written read as zeros.
+func (s *FileStorage) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("storage: negative offset")
+	}
+	var eof error
+	if rest := s.length - offset; int64(len(buf)) > rest {
+		buf, eof = buf[:max(rest, 0)], io.EOF
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	read := 0
+	err := s.span(offset, int64(len(buf)), func(df *diskFile, off, n int64) error {
+		chunk := buf[off-offset : off-offset+n]
+		if df.f != nil {
+			m, err := df.f.ReadAt(chunk, off-df.offset)
+			read += m
+			return err
+		}
+		part, err := s.partFile(false)
+		switch {
+		case err != nil:
+			return err
+		case part == nil:
+			clear(chunk)
+		default:
+			if err := readFull(part, chunk, off); err != nil {
+				return err
+			}
+		}
+		read += len(chunk)
+		return nil
+	})
+	if err != nil {
+		return read, err
+	}
+	return read, eof
+}
+
+// readFull reads len(buf) bytes of the sparse part file at off. Past its
+// end, it's all zeros.
+func readFull(f *os.File, buf []byte, off int64) error {
+	n, err := f.ReadAt(buf, off)
+	if err == io.EOF {
+		clear(buf[n:])
+		return nil
+	}
+	return err
+}
+
+// MarkComplete records that piece index is complete, and renames the
+// files that are complete with it, if there is a part suffix. It does
+// nothing otherwise.
+func (s *FileStorage) MarkComplete(index int) error {
+	if s.complete == nil {
+		return nil
+	}
+	if index < 0 || index >= len(s.complete) {
+		return errors.New("storage: no such piece")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.complete[index] = true
+	start := int64(index) * s.pieceLength
+	return s.span(start, min(s.pieceLength, s.length-start), func(df *diskFile, _, _ int64) error {
+		return s.finish(df)
+	})
 }
 
-// Close closes the file.
-func (s *Storage) Close() error {
-	return s.file.Close()
+// Close closes the files.
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, df := range s.files {
+		if df.f == nil {
+			continue
+		}
+		if err := df.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		df.f = nil
+	}
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	if s.part != nil {
+		if err := s.part.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.part = nil
+	}
+	return firstErr
+}
+
+// Flush syncs written data to stable storage.
+func (s *FileStorage) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, df := range s.files {
+		if df.f == nil {
+			continue
+		}
+		if err := df.f.Sync(); err != nil {
+			return err
+		}
+	}
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	if s.part != nil {
+		return s.part.Sync()
+	}
+	return nil
 }
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LinkMode is how LinkFile puts a file in place.
+type LinkMode int
+
+const (
+	// LinkCopy copies the file.
+	LinkCopy LinkMode = iota
+	// LinkHard makes a hard link, sharing the data with the original:
+	// writing to one changes both.
+	LinkHard
+	// LinkReflink makes a copy that shares the data with the original
+	// until either is changed, on filesystems that can (Btrfs, XFS).
+	LinkReflink
+)
+
+func (m LinkMode) String() string {
+	switch m {
+	case LinkCopy:
+		return "copy"
+	case LinkHard:
+		return "hard"
+	case LinkReflink:
+		return "reflink"
+	}
+	return fmt.Sprintf("LinkMode(%d)", int(m))
+}
+
+// ParseLinkMode parses the name of a link mode, as returned by String.
+func ParseLinkMode(s string) (LinkMode, error) {
+	for _, m := range []LinkMode{LinkCopy, LinkHard, LinkReflink} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown link mode %q", s)
+}
+
+// LinkFile creates dst with the content of src, creating directories as
+// needed. Where mode isn't possible, such as links across filesystems, it
+// falls back to a copy, which is read back like in FileBackend.Move. It
+// returns the mode used. It never overwrites dst.
+func LinkFile(src, dst string, mode LinkMode) (LinkMode, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return mode, err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return mode, fmt.Errorf("storage: %s already exists", dst)
+	}
+	switch mode {
+	case LinkHard:
+		if os.Link(src, dst) == nil {
+			return LinkHard, nil
+		}
+	case LinkReflink:
+		if reflink(src, dst) == nil {
+			return LinkReflink, nil
+		}
+	}
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return LinkCopy, err
+	}
+	return LinkCopy, nil
+}
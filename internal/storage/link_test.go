@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.WriteFile(src, []byte("shared data"), 0666)
+
+	for _, mode := range []LinkMode{LinkCopy, LinkHard, LinkReflink} {
+		dst := filepath.Join(dir, mode.String(), "dst")
+		used, err := LinkFile(src, dst, mode)
+		if err != nil {
+			t.Fatalf("LinkFile(%v) error = %v", mode, err)
+		}
+		if used != mode && used != LinkCopy {
+			t.Errorf("LinkFile(%v) used %v", mode, used)
+		}
+		if got, _ := os.ReadFile(dst); string(got) != "shared data" {
+			t.Errorf("LinkFile(%v) made %q", mode, got)
+		}
+		if _, err := LinkFile(src, dst, mode); err == nil {
+			t.Errorf("LinkFile(%v) overwrote a file", mode)
+		}
+	}
+
+	if m, err := ParseLinkMode("reflink"); m != LinkReflink || err != nil {
+		t.Errorf("ParseLinkMode(reflink) = %v, %v", m, err)
+	}
+	if _, err := ParseLinkMode("soft"); err == nil {
+		t.Error("ParseLinkMode accepted an unknown mode")
+	}
+}
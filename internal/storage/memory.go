@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// MemoryBackend keeps torrents in memory, for tests and for data that
+// needn't outlive the process. A torrent's data survives Close: opening
+// it again, by info hash, finds it as it was left.
+type MemoryBackend struct {
+	// Crashable makes torrents opened from now on keep what they overwrite
+	// until the next Flush, so Crash can throw away what wasn't flushed,
+	// as a power loss would with files. That costs up to the size of the
+	// data again, so it is meant for tests.
+	Crashable bool
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*MemoryStorage
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{torrents: make(map[[20]byte]*MemoryStorage)}
+}
+
+// Open returns the torrent's storage, creating it zeroed if it's new.
+func (b *MemoryBackend) Open(layout Layout) (Torrent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m, ok := b.torrents[layout.InfoHash]; ok && int64(len(m.data)) == layout.Length() {
+		return m, nil
+	}
+	m := &MemoryStorage{
+		data:      make([]byte, layout.Length()),
+		complete:  make([]bool, layout.NumPieces()),
+		crashable: b.Crashable,
+	}
+	b.torrents[layout.InfoHash] = m
+	return m, nil
+}
+
+// Crash puts every crashable torrent back the way it was at its last
+// Flush, as if the machine had lost power. Storage opened before keeps
+// working on the reverted data.
+func (b *MemoryBackend) Crash() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.torrents {
+		m.revert()
+	}
+}
+
+// MemoryStorage is a torrent kept by a MemoryBackend.
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	data     []byte
+	complete []bool
+	// undo holds what was overwritten since the last Flush, oldest first,
+	// so Crash can revert it. Only kept if crashable.
+	undo      []memoryUndo
+	crashable bool
+}
+
+// memoryUndo is an unflushed change: data that was at off, or the
+// complete mark of a piece.
+type memoryUndo struct {
+	off   int64
+	data  []byte
+	piece int // -1 for data
+}
+
+// ReadAt reads len(p) bytes at off.
+func (m *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if off < 0 {
+		return 0, errors.New("storage: negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at off.
+func (m *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(m.data)) {
+		return 0, errors.New("storage: write past the end of the content")
+	}
+	if m.crashable {
+		old := append([]byte(nil), m.data[off:off+int64(len(p))]...)
+		m.undo = append(m.undo, memoryUndo{off: off, data: old, piece: -1})
+	}
+	return copy(m.data[off:], p), nil
+}
+
+// MarkComplete records that piece index is complete.
+func (m *MemoryStorage) MarkComplete(index int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if index < 0 || index >= len(m.complete) {
+		return errors.New("storage: no such piece")
+	}
+	if m.crashable && !m.complete[index] {
+		m.undo = append(m.undo, memoryUndo{piece: index})
+	}
+	m.complete[index] = true
+	return nil
+}
+
+// Completed reports whether piece index has been marked complete.
+func (m *MemoryStorage) Completed(index int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return index >= 0 && index < len(m.complete) && m.complete[index]
+}
+
+// Flush makes what was written survive Crash.
+func (m *MemoryStorage) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.undo = nil
+	return nil
+}
+
+// revert undoes everything since the last Flush.
+func (m *MemoryStorage) revert() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.undo) - 1; i >= 0; i-- {
+		u := m.undo[i]
+		if u.piece >= 0 {
+			m.complete[u.piece] = false
+		} else {
+			copy(m.data[u.off:], u.data)
+		}
+	}
+	m.undo = nil
+}
+
+// Close does nothing; the data stays with the backend.
+func (m *MemoryStorage) Close() error {
+	return nil
+}
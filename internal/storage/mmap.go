@@ -0,0 +1,174 @@
+//go:build unix
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// MmapBackend keeps torrents in files it maps into memory, so reads and
+// writes are plain copies and the kernel does the I/O. It creates every
+// file in full: skipping files needs FileBackend.
+type MmapBackend struct{}
+
+// Open creates and maps the files of layout.
+func (MmapBackend) Open(layout Layout) (Torrent, error) {
+	if err := layout.CheckRoot(); err != nil {
+		return nil, err
+	}
+	m := &MmapStorage{}
+	var offset int64
+	for _, f := range layout.Files {
+		mf, err := mapFile(f.Path, f.Length)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		mf.offset = offset
+		offset += f.Length
+		m.files = append(m.files, mf)
+	}
+	m.length = offset
+	return m, nil
+}
+
+// Stat describes the files of layout as they are on disk.
+func (MmapBackend) Stat(layout Layout) []FileState {
+	return FileBackend{}.Stat(Layout{Files: layout.Files})
+}
+
+// mapFile creates the file at path with the given length and maps it.
+// Empty files can't be mapped and get no mapping.
+func mapFile(path string, length int64) (mappedFile, error) {
+	mf := mappedFile{length: length}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return mf, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return mf, err
+	}
+	if err := f.Truncate(length); err != nil {
+		f.Close()
+		return mf, err
+	}
+	mf.f = f
+	if length == 0 {
+		return mf, nil
+	}
+	if int64(int(length)) != length {
+		f.Close()
+		return mf, errors.New("storage: file too large to map")
+	}
+	mf.data, err = syscall.Mmap(int(f.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+	}
+	return mf, err
+}
+
+// MmapStorage is a torrent kept by an MmapBackend.
+type MmapStorage struct {
+	files  []mappedFile
+	length int64
+}
+
+type mappedFile struct {
+	offset, length int64
+	f              *os.File // kept open for Flush
+	data           []byte
+}
+
+// span calls fn for every mapped file overlapping [offset, offset+n),
+// with the overlap as a slice of the mapping and its position in the
+// content.
+func (m *MmapStorage) span(offset, n int64, fn func(mapped []byte, off int64)) {
+	end := offset + n
+	for _, mf := range m.files {
+		from := max(offset, mf.offset)
+		to := min(end, mf.offset+mf.length)
+		if from < to {
+			fn(mf.data[from-mf.offset:to-mf.offset], from)
+		}
+	}
+}
+
+// ReadAt reads len(p) bytes at off.
+func (m *MmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("storage: negative offset")
+	}
+	var eof error
+	if rest := m.length - off; int64(len(p)) > rest {
+		p, eof = p[:max(rest, 0)], io.EOF
+	}
+	m.span(off, int64(len(p)), func(mapped []byte, at int64) {
+		copy(p[at-off:], mapped)
+	})
+	return len(p), eof
+}
+
+// WriteAt writes p at off.
+func (m *MmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > m.length {
+		return 0, errors.New("storage: write past the end of the content")
+	}
+	m.span(off, int64(len(p)), func(mapped []byte, at int64) {
+		copy(mapped, p[at-off:])
+	})
+	return len(p), nil
+}
+
+// MarkComplete does nothing: files need no bookkeeping per piece.
+func (m *MmapStorage) MarkComplete(index int) error {
+	return nil
+}
+
+// Flush syncs the files. Mapped pages live in the page cache along with
+// everything else written to a file, so this writes them back too.
+func (m *MmapStorage) Flush() error {
+	for _, mf := range m.files {
+		if err := mf.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close unmaps and closes the files. Nothing may be read or written
+// afterwards.
+func (m *MmapStorage) Close() error {
+	var firstErr error
+	for i := range m.files {
+		mf := &m.files[i]
+		if mf.data != nil {
+			if err := syscall.Munmap(mf.data); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mf.data = nil
+		}
+		if mf.f != nil {
+			if err := mf.f.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mf.f = nil
+		}
+	}
+	return firstErr
+}
+
+// Move moves the files of from to the paths of to, see FileBackend.Move.
+func (MmapBackend) Move(from, to Layout) error {
+	return FileBackend{}.Move(from, to)
+}
+
+// Remove deletes the files of layout.
+func (MmapBackend) Remove(layout Layout) error {
+	return FileBackend{}.Remove(layout)
+}
@@ -0,0 +1,9 @@
+//go:build unix
+
+package storage
+
+import "testing"
+
+func TestMmapBackend(t *testing.T) {
+	testBackend(t, MmapBackend{})
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Mover is implemented by a Backend whose torrents live at paths, so
+// they can be moved elsewhere.
+type Mover interface {
+	// Move puts the stored data of a torrent laid out as from at the
+	// paths of to. The data may be read meanwhile, but not written.
+	// Whatever had to be copied stays at from as well, until Remove.
+	Move(from, to Layout) error
+	// Remove deletes what is left of a torrent's data at the paths of
+	// layout.
+	Remove(layout Layout) error
+}
+
+// Move renames the files of from to the paths of to, or copies them if
+// renaming fails, such as across filesystems. Copies keep the
+// modification time and are read back and compared before Move returns.
+// It refuses to overwrite files, and puts back what it moved if it fails
+// halfway.
+func (b FileBackend) Move(from, to Layout) error {
+	if err := to.CheckRoot(); err != nil {
+		return err
+	}
+	paths := b.movedPaths(from, to)
+	for _, p := range paths {
+		if _, err := os.Lstat(p.to); err == nil {
+			return fmt.Errorf("storage: %s already exists", p.to)
+		}
+	}
+
+	for i, p := range paths {
+		copied, err := moveFile(p.from, p.to)
+		if err != nil {
+			for _, done := range paths[:i] {
+				if done.copied {
+					os.Remove(done.to)
+				} else {
+					os.Rename(done.to, done.from)
+				}
+			}
+			return err
+		}
+		paths[i].copied = copied
+	}
+	return nil
+}
+
+// Remove deletes the files of layout and its part file.
+func (b FileBackend) Remove(layout Layout) error {
+	for _, p := range b.movedPaths(layout, layout) {
+		if err := os.Remove(p.from); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+type movedPath struct {
+	from, to string
+	copied   bool
+}
+
+// movedPaths pairs up the files of from that are on disk, under their
+// own name or an incomplete one, with where they go in to.
+func (b FileBackend) movedPaths(from, to Layout) []movedPath {
+	var paths []movedPath
+	add := func(src, dst string) {
+		if _, err := os.Lstat(src); err == nil {
+			paths = append(paths, movedPath{from: src, to: dst})
+		}
+	}
+	for i, f := range from.Files {
+		add(f.Path, to.Files[i].Path)
+		if b.PartSuffix {
+			add(f.Path+partSuffix, to.Files[i].Path+partSuffix)
+		}
+	}
+	if from.PartPath != "" && to.PartPath != "" {
+		add(from.PartPath, to.PartPath)
+	}
+	return paths
+}
+
+// moveFile renames src to dst, or copies it over if it can't be renamed.
+// It reports whether it copied.
+func moveFile(src, dst string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return false, err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return false, nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return true, err
+	}
+	return true, nil
+}
+
+// copyFile copies src to a new file dst, syncs it, and reads it back to
+// make sure it holds what src does.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	want := sha1.New()
+	if _, err := io.Copy(out, io.TeeReader(in, want)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	check, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+	got := sha1.New()
+	if _, err := io.Copy(got, check); err != nil {
+		return err
+	}
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		return fmt.Errorf("storage: copy of %s to %s doesn't match", src, dst)
+	}
+	// Resume data goes by modification times; keep them valid.
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, time.Time{}, fi.ModTime())
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileBackendMove(t *testing.T) {
+	dir := t.TempDir()
+	layoutAt := func(root string) Layout {
+		return Layout{
+			Files: []File{
+				{Path: filepath.Join(root, "a"), Length: 4},
+				{Path: filepath.Join(root, "sub", "b"), Length: 4},
+			},
+			PartPath: root + ".parts",
+		}
+	}
+	from, to := layoutAt(filepath.Join(dir, "old")), layoutAt(filepath.Join(dir, "new"))
+	b := FileBackend{PartSuffix: true}
+	s, err := b.Open(from)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.WriteAt([]byte("abcdefgh"), 0)
+	s.Close()
+
+	// Nothing is overwritten.
+	os.MkdirAll(filepath.Join(dir, "new"), 0777)
+	os.WriteFile(to.Files[0].Path+partSuffix, nil, 0666)
+	if err := b.Move(from, to); err == nil {
+		t.Fatal("Move() overwrote a file")
+	}
+	os.Remove(to.Files[0].Path + partSuffix)
+
+	if err := b.Move(from, to); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	for i, want := range []string{"abcd", "efgh"} {
+		if got, _ := os.ReadFile(to.Files[i].Path + partSuffix); string(got) != want {
+			t.Errorf("file %d = %q after the move, want %q", i, got, want)
+		}
+		if _, err := os.Stat(from.Files[i].Path + partSuffix); !os.IsNotExist(err) {
+			t.Errorf("file %d still at the old path", i)
+		}
+	}
+	if err := b.Remove(from); err != nil {
+		t.Errorf("Remove() of what's gone: %v", err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.WriteFile(src, []byte("some data"), 0666)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(src, mtime, mtime)
+
+	if err := copyFile(src, dst); err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "some data" {
+		t.Errorf("copy = %q", got)
+	}
+	if fi, err := os.Stat(dst); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("copy modified at %v, want %v", fi.ModTime(), mtime)
+	}
+	if err := copyFile(src, dst); err == nil {
+		t.Error("copyFile() overwrote a file")
+	}
+}
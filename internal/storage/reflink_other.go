@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "errors"
+
+// reflink isn't supported here; LinkFile copies instead.
+func reflink(src, dst string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Paths in torrents come from strangers, so they are sanitized before
+// they get anywhere near the filesystem. SanitizeName maps a name, one
+// element of a torrent path, to one that is safe to create on any
+// system:
+//
+//   - each run of invalid UTF-8 is replaced with U+FFFD
+//   - control characters and \ / : * ? " < > | become _
+//   - trailing dots and spaces, which Windows drops, are removed
+//   - reserved device names (CON, PRN, AUX, NUL, COM1-9 and LPT1-9, in
+//     any case, with or without extensions) get a leading _
+//   - names longer than MaxNameLength bytes are cut short, keeping their
+//     extension
+//
+// Names that are empty, "." or "..", or that map to nothing, are
+// rejected with ErrUnsafePath. Since separators are replaced, no name
+// can be absolute or climb out of the directory it's in. Symbolic links
+// are dealt with by the backends, see Layout.Root. SanitizePaths also
+// rejects files whose paths differ only in case, which are the same file
+// on Windows and macOS.
+
+// MaxNameLength is the longest file name, in bytes, most filesystems take.
+const MaxNameLength = 255
+
+// ErrUnsafePath is returned for paths that can't be made safe.
+var ErrUnsafePath = errors.New("storage: unsafe path")
+
+// SanitizeName returns name made safe to use as a file name.
+func SanitizeName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("%w: file name %q", ErrUnsafePath, name)
+	}
+
+	orig := name
+	name = strings.ToValidUTF8(name, "\uFFFD")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`\/:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+
+	if isReservedName(name) {
+		name = "_" + name
+	}
+	stem, ext := splitExt(name)
+	if len(stem)+len(ext) > MaxNameLength {
+		if len(ext) > MaxNameLength/2 {
+			stem, ext = stem+ext, ""
+		}
+		stem = truncateUTF8(stem, MaxNameLength-len(ext))
+		if ext == "" {
+			stem = strings.TrimRight(stem, ". ")
+		}
+	}
+	name = stem + ext
+
+	if name == "" {
+		return "", fmt.Errorf("%w: file name %q", ErrUnsafePath, orig)
+	}
+	return name, nil
+}
+
+// SanitizePath sanitizes every element of a torrent path and joins them
+// into a relative path for this system.
+func SanitizePath(elems []string) (string, error) {
+	if len(elems) == 0 {
+		return "", fmt.Errorf("%w: empty path", ErrUnsafePath)
+	}
+	names := make([]string, len(elems))
+	for i, elem := range elems {
+		name, err := SanitizeName(elem)
+		if err != nil {
+			return "", err
+		}
+		names[i] = name
+	}
+	return filepath.Join(names...), nil
+}
+
+// SanitizePaths sanitizes the paths of all files of a torrent, and makes
+// sure no two of them end up as the same file, or one inside the other,
+// even where file names are case-insensitive.
+func SanitizePaths(paths [][]string) ([]string, error) {
+	sanitized := make([]string, len(paths))
+	seen := make(map[string]bool) // files, case folded
+	dirs := make(map[string]bool) // directories they are in, case folded
+	for i, elems := range paths {
+		path, err := SanitizePath(elems)
+		if err != nil {
+			return nil, err
+		}
+		folded := foldCase(path)
+		if seen[folded] || dirs[folded] {
+			return nil, fmt.Errorf("%w: more than one file at %s", ErrUnsafePath, path)
+		}
+		seen[folded] = true
+		for dir := filepath.Dir(folded); dir != "."; dir = filepath.Dir(dir) {
+			if seen[dir] {
+				return nil, fmt.Errorf("%w: more than one file at %s", ErrUnsafePath, filepath.Dir(path))
+			}
+			dirs[dir] = true
+		}
+		sanitized[i] = path
+	}
+	return sanitized, nil
+}
+
+// splitExt splits name before its extension, if it has a proper one.
+func splitExt(name string) (stem, ext string) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return name, ""
+	}
+	return name[:i], name[i:]
+}
+
+// foldCase maps path to the same string as every path differing from it
+// only in case. Going through upper case first also folds characters
+// such as U+017F, a long s, whose upper case is a plain S.
+func foldCase(path string) string {
+	return strings.ToLower(strings.ToUpper(path))
+}
+
+// isReservedName reports whether Windows reserves name for a device. It
+// goes by the part before the first dot, so "nul.tar.gz" is reserved too,
+// ignoring the spaces Windows would drop at its end.
+func isReservedName(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.TrimRight(name, " ")
+	switch strings.ToUpper(name) {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(name) == 4 && name[3] >= '1' && name[3] <= '9' {
+		prefix := strings.ToUpper(name[:3])
+		return prefix == "COM" || prefix == "LPT"
+	}
+	return false
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	for len(s) > n {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// CheckRoot makes sure the files of layout stay inside its Root, without
+// going through symbolic links below it.
+func (l Layout) CheckRoot() error {
+	if l.Root == "" {
+		return nil
+	}
+	for _, f := range l.Files {
+		if err := checkInside(l.Root, f.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkInside makes sure path is below root, and that nothing on the way
+// from root to it is a symbolic link.
+func checkInside(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s is outside %s", ErrUnsafePath, path, root)
+	}
+	at := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		at = filepath.Join(at, elem)
+		fi, err := os.Lstat(at)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Nor is anything below it
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s is a symbolic link", ErrUnsafePath, at)
+		}
+	}
+	return nil
+}
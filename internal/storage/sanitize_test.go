@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	long := strings.Repeat("é", 200) // 400 bytes
+	tests := []struct {
+		name, want string
+	}{
+		{"movie.mkv", "movie.mkv"},
+		{"../etc/passwd", ".._etc_passwd"},
+		{"/etc/passwd", "_etc_passwd"},
+		{`..\..\windows`, ".._.._windows"},
+		{"C:", "C_"},
+		{`a<b>c:d"e|f?g*h`, "a_b_c_d_e_f_g_h"},
+		{"tab\there\x00", "tab_here_"},
+		{"bad\xff\xfeutf8", "bad\uFFFDutf8"},
+		{"name. . ", "name"},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"Lpt9.tar.gz", "_Lpt9.tar.gz"}, // Up to the first dot counts
+		{"NUL.tar.gz", "_NUL.tar.gz"},
+		{"aux .txt", "_aux .txt"},
+		{"lpt9.gz", "_lpt9.gz"},
+		{"x.con", "x.con"},
+		{"COM0", "COM0"},
+		{"CONSOLE", "CONSOLE"},
+		{".hidden", ".hidden"},
+		{long + ".txt", long[:250] + ".txt"},
+		{long, long[:254]}, // Not halfway through an é
+		{"x" + strings.Repeat(".", 300), "x"},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeName(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("SanitizeName(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+		if len(got) > MaxNameLength {
+			t.Errorf("SanitizeName(%q) is %d bytes long", tt.name, len(got))
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "...", " . "} {
+		if got, err := SanitizeName(name); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("SanitizeName(%q) = %q, %v; want ErrUnsafePath", name, got, err)
+		}
+	}
+}
+
+func TestSanitizePaths(t *testing.T) {
+	got, err := SanitizePaths([][]string{{"dir", "CON"}, {"dir", "a:b"}, {"top"}})
+	want := []string{filepath.Join("dir", "_CON"), filepath.Join("dir", "a_b"), "top"}
+	if err != nil || len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("SanitizePaths() = %q, %v; want %q", got, err, want)
+	}
+
+	for _, paths := range [][][]string{
+		{{"a"}, {"a."}},               // Same once sanitized
+		{{"a"}, {"a", "b"}},           // A file and a directory
+		{{"a", "b", "c"}, {"a", "b"}}, // The other way around
+		{{"A.txt"}, {"a.txt"}},        // Same where case doesn't matter
+		{{"Dir", "a"}, {"dir"}},
+		{{"ok"}, {"..", "escape"}},
+		{{}},
+	} {
+		if _, err := SanitizePaths(paths); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("SanitizePaths(%q) error = %v, want ErrUnsafePath", paths, err)
+		}
+	}
+}
+
+func TestOpenRefusesSymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "sub")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	layout := Layout{
+		Files: []File{{Path: filepath.Join(root, "sub", "f"), Length: 4}},
+		Root:  root,
+	}
+	if _, err := (FileBackend{}).Open(layout); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Open() through a symlink: error = %v, want ErrUnsafePath", err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Error("file created through a symlink")
+	}
+
+	layout.Files[0].Path = filepath.Join(root, "..", "f")
+	if _, err := (FileBackend{}).Open(layout); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Open() outside the root: error = %v, want ErrUnsafePath", err)
+	}
+}
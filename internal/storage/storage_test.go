@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -11,9 +12,9 @@ func TestStorage(t *testing.T) {
 	defer os.Remove(tmpFile)
 
 	length := int64(1000)
-	s, err := NewStorage(tmpFile, length)
+	s, err := OpenFiles([]File{{Path: tmpFile, Length: length}}, "", 0)
 	if err != nil {
-		t.Fatalf("NewStorage failed: %v", err)
+		t.Fatalf("OpenFiles failed: %v", err)
 	}
 	defer s.Close()
 
@@ -21,14 +22,14 @@ func TestStorage(t *testing.T) {
 	data := []byte("hello world")
 	offset := int64(42)
 
-	if err := s.Write(offset, data); err != nil {
-		t.Fatalf("Write failed: %v", err)
+	if _, err := s.WriteAt(data, offset); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
 	}
 
 	// Test Read
-	readBuf, err := s.Read(offset, len(data))
-	if err != nil {
-		t.Fatalf("Read failed: %v", err)
+	readBuf := make([]byte, len(data))
+	if _, err := s.ReadAt(readBuf, offset); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
 	}
 
 	if !bytes.Equal(readBuf, data) {
@@ -45,3 +46,79 @@ func TestStorage(t *testing.T) {
 		t.Errorf("File size = %d, want %d", fi.Size(), length)
 	}
 }
+
+func TestStorageMultiFileSkip(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	part := path("parts")
+
+	// Pieces of 10 bytes: piece 0 is a.bin, pieces 1 and 2 straddle
+	// sub/b.bin and the wanted files around it.
+	files := []File{
+		{Path: path("a.bin"), Length: 12},
+		{Path: path("sub/b.bin"), Length: 13, Skip: true},
+		{Path: path("c.bin"), Length: 5},
+	}
+	s, err := OpenFiles(files, part, 10)
+	if err != nil {
+		t.Fatalf("OpenFiles failed: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := os.Stat(path("sub/b.bin")); !os.IsNotExist(err) {
+		t.Fatalf("skipped file was created: %v", err)
+	}
+
+	data := []byte("0123456789abcdefghijklmnopqrstuv")[:30]
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, 30)
+	if _, err := s.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Read = %q, want %q", got, data)
+	}
+
+	a, _ := os.ReadFile(path("a.bin"))
+	if !bytes.Equal(a, data[:12]) {
+		t.Errorf("a.bin = %q, want %q", a, data[:12])
+	}
+
+	// Wanting the file again moves its bytes out of the part file, which
+	// is then no longer needed.
+	if err := s.SetSkip(1, false); err != nil {
+		t.Fatalf("SetSkip failed: %v", err)
+	}
+	b, err := os.ReadFile(path("sub/b.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data[12:25]) {
+		t.Errorf("sub/b.bin = %q, want %q", b, data[12:25])
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("part file still there: %v", err)
+	}
+}
+
+func TestStorageSkippedReadsZeros(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFiles([]File{
+		{Path: filepath.Join(dir, "a"), Length: 4, Skip: true},
+		{Path: filepath.Join(dir, "b"), Length: 4},
+	}, filepath.Join(dir, "parts"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got := []byte{1, 2, 3, 4}
+	if _, err := s.ReadAt(got, 2); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, make([]byte, 4)) {
+		t.Errorf("Read = %v, want zeros", got)
+	}
+}
@@ -3,18 +3,98 @@ package torrent
 import (
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"strings"
 
 	"github.com/Minesto23/peerwire/internal/bencode"
 )
 
 // InfoDictionary represents the static metadata of the torrent.
-// This is suitable for single-file torrents (as per requirements).
+// A single-file torrent has no Files; a multi-file torrent lists them,
+// and Name is the directory they go in. Length is the total either way.
 type InfoDictionary struct {
-	PieceLength int64  `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
-	Name        string `bencode:"name"`
-	Length      int64  `bencode:"length"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Name        string     `bencode:"name"`
+	Length      int64      `bencode:"length"`
+	Files       []FileInfo `bencode:"files"`
+}
+
+// FileInfo is one entry of a multi-file torrent's file list.
+type FileInfo struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"` // directories, then the file name
+}
+
+// File is one file of a torrent: a byte range of its content.
+type File struct {
+	// Path is the torrent's name for a single-file torrent, and relative
+	// to the torrent's directory otherwise. It is slash-separated.
+	Path   string
+	Offset int64 // where the file starts in the torrent's content
+	Length int64
+}
+
+// NumPieces is how many pieces the torrent's content is split into, going
+// by the hashes.
+func (info *InfoDictionary) NumPieces() int {
+	return len(info.Pieces) / 20
+}
+
+// Validate checks that the info dictionary is consistent: a positive
+// piece length, no negative lengths, and one hash for every piece of the
+// content. Metainfo comes from strangers, and everything else relies on
+// these.
+func (info *InfoDictionary) Validate() error {
+	if info.PieceLength <= 0 {
+		return fmt.Errorf("torrent: invalid piece length %d", info.PieceLength)
+	}
+	if info.Length < 0 {
+		return fmt.Errorf("torrent: invalid length %d", info.Length)
+	}
+	var total int64
+	for i, f := range info.Files {
+		if f.Length < 0 || f.Length > math.MaxInt64-total {
+			return fmt.Errorf("torrent: file %d: invalid length %d", i, f.Length)
+		}
+		total += f.Length
+	}
+	if info.IsMultiFile() && total != info.Length {
+		return errors.New("torrent: length doesn't match the files")
+	}
+	if len(info.Pieces)%20 != 0 {
+		return errors.New("torrent: pieces length not divisible by 20")
+	}
+	want := info.Length / info.PieceLength
+	if info.Length%info.PieceLength != 0 {
+		want++
+	}
+	if int64(info.NumPieces()) != want {
+		return fmt.Errorf("torrent: %d piece hashes for %d pieces", info.NumPieces(), want)
+	}
+	return nil
+}
+
+// IsMultiFile reports whether the torrent is a directory of files.
+func (info *InfoDictionary) IsMultiFile() bool {
+	return len(info.Files) > 0
+}
+
+// FileList returns the files of the torrent in content order. A
+// single-file torrent has one file, named after the torrent.
+func (info *InfoDictionary) FileList() []File {
+	if !info.IsMultiFile() {
+		return []File{{Path: info.Name, Length: info.Length}}
+	}
+	files := make([]File, len(info.Files))
+	var offset int64
+	for i, f := range info.Files {
+		files[i] = File{Path: strings.Join(f.Path, "/"), Offset: offset, Length: f.Length}
+		offset += f.Length
+	}
+	return files
 }
 
 // TorrentSpec represents the contents of a .torrent file.
@@ -86,11 +166,23 @@ func Parse(r io.Reader) (*TorrentSpec, error) {
 	// Map Info Dictionary
 	spec.Info.Name, _ = infoMap["name"].(string)
 
-	// 'length' is required for single-file mode
+	// Either 'length' (single-file mode) or 'files' (multi-file mode)
 	if length, ok := infoMap["length"].(int64); ok {
 		spec.Info.Length = length
+	} else if filesRaw, ok := infoMap["files"].([]interface{}); ok && len(filesRaw) > 0 {
+		for i, fileRaw := range filesRaw {
+			f, err := parseFileInfo(fileRaw)
+			if err != nil {
+				return nil, fmt.Errorf("torrent: file %d: %w", i, err)
+			}
+			if f.Length > math.MaxInt64-spec.Info.Length {
+				return nil, fmt.Errorf("torrent: file %d: length overflows", i)
+			}
+			spec.Info.Files = append(spec.Info.Files, f)
+			spec.Info.Length += f.Length
+		}
 	} else {
-		return nil, errors.New("torrent: single-file 'length' missing (multi-file not supported)")
+		return nil, errors.New("torrent: neither 'length' nor 'files' present")
 	}
 
 	if pl, ok := infoMap["piece length"].(int64); ok {
@@ -105,8 +197,8 @@ func Parse(r io.Reader) (*TorrentSpec, error) {
 		return nil, errors.New("torrent: pieces missing")
 	}
 
-	if len(spec.Info.Pieces)%20 != 0 {
-		return nil, errors.New("torrent: pieces length not divisible by 20")
+	if err := spec.Info.Validate(); err != nil {
+		return nil, err
 	}
 
 	// 2. Compute InfoHash
@@ -125,3 +217,27 @@ func Parse(r io.Reader) (*TorrentSpec, error) {
 
 	return spec, nil
 }
+
+// parseFileInfo maps one entry of a multi-file torrent's 'files' list.
+func parseFileInfo(raw interface{}) (FileInfo, error) {
+	var f FileInfo
+	fileMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return f, errors.New("not a dictionary")
+	}
+	if f.Length, ok = fileMap["length"].(int64); !ok || f.Length < 0 {
+		return f, errors.New("length missing or invalid")
+	}
+	pathRaw, ok := fileMap["path"].([]interface{})
+	if !ok || len(pathRaw) == 0 {
+		return f, errors.New("path missing")
+	}
+	for _, elemRaw := range pathRaw {
+		elem, ok := elemRaw.(string)
+		if !ok || elem == "" || elem == "." || elem == ".." || strings.Contains(elem, "/") {
+			return f, fmt.Errorf("invalid path element %q", elemRaw)
+		}
+		f.Path = append(f.Path, elem)
+	}
+	return f, nil
+}
@@ -3,6 +3,7 @@ package torrent
 import (
     "bytes"
     "crypto/sha1"
+    "strings"
     "testing"
 
     "github.com/Minesto23/peerwire/internal/bencode"
@@ -13,7 +14,7 @@ func TestParse(t *testing.T) {
 	infoDict := map[string]interface{}{
 		"name":         "testfile",
 		"length":       int64(12345),
-		"piece length": int64(256),
+		"piece length": int64(16384),
 		"pieces":       "12345678901234567890", // 20 bytes dummy hash
 	}
 	
@@ -51,3 +52,107 @@ func TestParse(t *testing.T) {
         t.Errorf("InfoHash length = %d, want 20", len(spec.InfoHash))
     }
 }
+
+func TestParseMultiFile(t *testing.T) {
+	file := func(length int64, path ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"length": length, "path": path}
+	}
+	infoDict := map[string]interface{}{
+		"name":         "album",
+		"piece length": int64(512),
+		"pieces":       "12345678901234567890",
+		"files": []interface{}{
+			file(100, "cover.jpg"),
+			file(0, "empty"),
+			file(300, "disc 1", "track.flac"),
+		},
+	}
+	data, err := bencode.Marshal(map[string]interface{}{
+		"announce": "http://tracker.example.com",
+		"info":     infoDict,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !spec.Info.IsMultiFile() || spec.Info.Length != 400 {
+		t.Fatalf("IsMultiFile = %v, Length = %d; want true, 400", spec.Info.IsMultiFile(), spec.Info.Length)
+	}
+
+	want := []File{
+		{Path: "cover.jpg", Offset: 0, Length: 100},
+		{Path: "empty", Offset: 100, Length: 0},
+		{Path: "disc 1/track.flac", Offset: 100, Length: 300},
+	}
+	got := spec.Info.FileList()
+	if len(got) != len(want) {
+		t.Fatalf("FileList() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("file %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseRejectsBadFiles(t *testing.T) {
+	for _, path := range [][]interface{}{
+		{},
+		{"a", ""},
+		{"..", "etc"},
+		{"a/b"},
+	} {
+		data, err := bencode.Marshal(map[string]interface{}{
+			"announce": "http://tracker.example.com",
+			"info": map[string]interface{}{
+				"name":         "bad",
+				"piece length": int64(256),
+				"pieces":       "12345678901234567890",
+				"files": []interface{}{
+					map[string]interface{}{"length": int64(1), "path": path},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(bytes.NewReader(data)); err == nil {
+			t.Errorf("path %q: Parse() succeeded", path)
+		}
+	}
+}
+
+func TestParseRejectsMalformedInfo(t *testing.T) {
+	hash := strings.Repeat("h", 20)
+	files := []interface{}{
+		map[string]interface{}{"length": int64(10), "path": []interface{}{"a"}},
+		map[string]interface{}{"length": int64(100), "path": []interface{}{"b"}},
+	}
+	for _, tt := range []struct {
+		name string
+		info map[string]interface{}
+	}{
+		{"too few hashes", map[string]interface{}{"piece length": int64(16), "pieces": hash, "files": files}},
+		{"too many hashes", map[string]interface{}{"piece length": int64(256), "pieces": hash + hash, "files": files}},
+		{"zero piece length", map[string]interface{}{"piece length": int64(0), "pieces": hash, "length": int64(10)}},
+		{"negative piece length", map[string]interface{}{"piece length": int64(-16), "pieces": hash, "length": int64(10)}},
+		{"negative length", map[string]interface{}{"piece length": int64(16), "pieces": hash, "length": int64(-10)}},
+		{"partial hash", map[string]interface{}{"piece length": int64(16), "pieces": hash[:19], "length": int64(10)}},
+	} {
+		tt.info["name"] = "bad"
+		data, err := bencode.Marshal(map[string]interface{}{
+			"announce": "http://tracker.example.com",
+			"info":     tt.info,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: Parse() succeeded", tt.name)
+		}
+	}
+}
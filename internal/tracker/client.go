@@ -1,6 +1,10 @@
 package tracker
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,11 +13,19 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Minesto23/peerwire/internal/bencode"
 )
 
+// DefaultUserAgent is sent to HTTP trackers unless Config.UserAgent overrides it.
+const DefaultUserAgent = "PeerWire/0.1"
+
+// maxResponseSize caps how much of a tracker response we are willing to read.
+// A compact response for thousands of peers is still only a few tens of KB.
+const maxResponseSize = 1 << 20
+
 // Peer represents a peer retrieved from the tracker.
 type Peer struct {
 	IP   net.IP
@@ -24,73 +36,365 @@ func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
+// Event is the optional announce event defined by BEP 3.
+type Event string
+
+const (
+	EventNone      Event = ""
+	EventStarted   Event = "started"
+	EventStopped   Event = "stopped"
+	EventCompleted Event = "completed"
+)
+
+// AnnounceRequest holds the parameters of a single announce (BEP 3 / BEP 23).
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+
+	// IP optionally tells the tracker our public address.
+	IP string
+	// Key identifies us across IP changes. Zero means use the client's key.
+	Key uint32
+	// NumWant is the number of peers we'd like. Zero or negative means the
+	// tracker's default.
+	NumWant int
+	// NoPeerID asks the tracker to omit peer IDs in non-compact responses.
+	NoPeerID bool
+}
+
+// AnnounceResponse is the decoded answer of a tracker.
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerID   string
+	Warning     string
+	Seeders     int
+	Leechers    int
+	Peers       []Peer
+}
+
+// Config configures a tracker Client; most of it concerns HTTP.
+// The zero value is usable and yields sensible defaults.
+type Config struct {
+	// Timeout bounds a whole announce round trip. Defaults to 15s.
+	// A UDP announce tries up to three times, each within Timeout.
+	Timeout time.Duration
+	// UserAgent is sent with every HTTP announce. Defaults to DefaultUserAgent.
+	UserAgent string
+	// Header holds extra headers added to every HTTP announce.
+	Header http.Header
+	// Proxy selects a proxy per request, see http.Transport.Proxy.
+	// Nil means http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLSConfig is used for https trackers.
+	TLSConfig *tls.Config
+	// MaxRedirects limits how many redirects are followed. Defaults to 5.
+	// A negative value disables redirects entirely.
+	MaxRedirects int
+	// Transport, when set, is used as is and Proxy/TLSConfig are ignored.
+	// This allows several clients to share one connection pool.
+	Transport http.RoundTripper
+}
+
+// Client announces to HTTP and UDP trackers.
+// It is safe for concurrent use and meant to be shared by many torrents.
+type Client struct {
+	cfg  Config
+	http *http.Client
+	key  uint32
+
+	mu         sync.Mutex
+	trackerIDs map[string]string // announce URL -> tracker id
+}
+
+// NewClient creates a tracker client from cfg.
+func NewClient(cfg Config) *Client {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent
+	}
+	if cfg.MaxRedirects == 0 {
+		cfg.MaxRedirects = 5
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		proxy := cfg.Proxy
+		if proxy == nil {
+			proxy = http.ProxyFromEnvironment
+		}
+		transport = &http.Transport{
+			Proxy:               proxy,
+			TLSClientConfig:     cfg.TLSConfig,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+
+	maxRedirects := cfg.MaxRedirects
+	hc := &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects < 0 || len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing redirect to %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+
+	var keyBuf [4]byte
+	rand.Read(keyBuf[:])
+
+	return &Client{
+		cfg:        cfg,
+		http:       hc,
+		key:        binary.BigEndian.Uint32(keyBuf[:]),
+		trackerIDs: make(map[string]string),
+	}
+}
+
+// DefaultClient is used by RequestPeers.
+var DefaultClient = NewClient(Config{})
+
 // RequestPeers connects to a tracker and returns a list of peers.
 func RequestPeers(announceURL string, infoHash [20]byte, peerID [20]byte, port int, length int64) ([]Peer, error) {
+	resp, err := DefaultClient.Announce(announceURL, AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   peerID,
+		Port:     port,
+		Left:     length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
+
+// Announce sends req to the tracker at announceURL.
+func (c *Client) Announce(announceURL string, req AnnounceRequest) (*AnnounceResponse, error) {
 	base, err := url.Parse(announceURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid announce URL: %v", err)
 	}
 
-	if base.Scheme == "udp" {
-		return requestPeersUDP(announceURL, infoHash, peerID, port, length)
+	if req.Key == 0 {
+		req.Key = c.key
 	}
 
+	switch base.Scheme {
+	case "udp":
+		return announceUDP(base, req, c.cfg.Timeout)
+	case "http", "https":
+		return c.announceHTTP(base, announceURL, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+	}
+}
+
+func (c *Client) announceHTTP(base *url.URL, announceURL string, req AnnounceRequest) (*AnnounceResponse, error) {
 	params := url.Values{
-		"info_hash":  []string{string(infoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(port)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"info_hash":  []string{string(req.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(req.Port)},
+		"uploaded":   []string{strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(req.Downloaded, 10)},
+		"left":       []string{strconv.FormatInt(req.Left, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.FormatInt(length, 10)},
+		"key":        []string{fmt.Sprintf("%08x", req.Key)},
+	}
+	if req.Event != EventNone {
+		params.Set("event", string(req.Event))
+	}
+	if req.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.NoPeerID {
+		params.Set("no_peer_id", "1")
+	}
+	if req.IP != "" {
+		params.Set("ip", req.IP)
+	}
+	if id := c.trackerID(announceURL); id != "" {
+		params.Set("trackerid", id)
 	}
 
-	base.RawQuery = params.Encode()
+	// Keep any query the announce URL already carries (private trackers put
+	// passkeys there).
+	for k, vs := range base.Query() {
+		if _, ok := params[k]; !ok {
+			params[k] = vs
+		}
+	}
+	u := *base
+	u.RawQuery = params.Encode()
 
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(base.String())
+	httpReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range c.cfg.Header {
+		for _, v := range vs {
+			httpReq.Header.Add(k, v)
+		}
+	}
+	httpReq.Header.Set("User-Agent", c.cfg.UserAgent)
+	// Asking for gzip explicitly disables the transport's transparent
+	// decompression, so decodeBody handles it for every response.
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := c.http.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// Many trackers send a bencoded failure reason with a 4xx/5xx status.
+		if _, perr := parseResponse(body); perr != nil && isFailure(perr) {
+			return nil, perr
+		}
 		return nil, fmt.Errorf("tracker returned error status: %d", resp.StatusCode)
 	}
 
-	// Parse Bencoded response
-	// Format: d8:intervali900e5:peers6:xxxxxx...e
+	r, err := parseResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	if r.TrackerID != "" {
+		c.setTrackerID(announceURL, r.TrackerID)
+	}
+	return r, nil
+}
 
-	// We need to read body first
-	var result map[string]interface{}
-	// Note: bencode.Unmarshal signature in my previous step was taking []byte.
-	// We didn't change it to io.Reader in signature, but internal decode took reader.
-	// Oh, in decoder.go: Unmarshal(data []byte, v interface{})
-	// So we must read body.
+func (c *Client) trackerID(announceURL string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trackerIDs[announceURL]
+}
 
-	// RE-READING my own code: decoder.go Unmarshal takes DATA []BYTE.
+func (c *Client) setTrackerID(announceURL, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trackerIDs[announceURL] = id
+}
 
-	bodyBytes, err := readAll(resp.Body) // Helper or standard io.ReadAll in Go 1.16+
+// decodeBody reads the (possibly gzip encoded) response body.
+func decodeBody(resp *http.Response) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
 	if err != nil {
 		return nil, err
 	}
+	if len(raw) > maxResponseSize {
+		return nil, errors.New("tracker response too large")
+	}
 
-	if err := bencode.Unmarshal(bodyBytes, &result); err != nil {
-		return nil, err
+	// Some trackers gzip without a Content-Encoding header, so sniff the magic too.
+	gzipped := resp.Header.Get("Content-Encoding") == "gzip" ||
+		(len(raw) > 2 && raw[0] == 0x1f && raw[1] == 0x8b)
+	if !gzipped {
+		return raw, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("tracker response: %v", err)
+	}
+	defer zr.Close()
+
+	body, err := io.ReadAll(io.LimitReader(zr, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("tracker response: %v", err)
+	}
+	if len(body) > maxResponseSize {
+		return nil, errors.New("tracker response too large")
+	}
+	return body, nil
+}
+
+// failureError is a tracker-reported "failure reason".
+type failureError string
+
+func (e failureError) Error() string { return "tracker failure: " + string(e) }
+
+func isFailure(err error) bool {
+	var f failureError
+	return errors.As(err, &f)
+}
+
+// parseResponse decodes a bencoded announce response.
+// Format: d8:intervali900e5:peers6:xxxxxx...e
+func parseResponse(body []byte) (*AnnounceResponse, error) {
+	var result map[string]interface{}
+	if err := bencode.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("tracker response: %v", err)
 	}
 
 	if fail, ok := result["failure reason"].(string); ok {
-		return nil, errors.New("tracker failure: " + fail)
+		return nil, failureError(fail)
+	}
+
+	r := &AnnounceResponse{}
+	if v, ok := result["interval"].(int64); ok {
+		r.Interval = time.Duration(v) * time.Second
 	}
+	if v, ok := result["min interval"].(int64); ok {
+		r.MinInterval = time.Duration(v) * time.Second
+	}
+	if v, ok := result["complete"].(int64); ok {
+		r.Seeders = int(v)
+	}
+	if v, ok := result["incomplete"].(int64); ok {
+		r.Leechers = int(v)
+	}
+	r.TrackerID, _ = result["tracker id"].(string)
+	r.Warning, _ = result["warning message"].(string)
 
-	peersRaw, ok := result["peers"].(string)
-	if !ok {
-		// It might be list of dicts (non-compact), but we requested compact=1
-		// For now fail if not string
-		return nil, errors.New("tracker peers list not a string (compact mode expected)")
+	switch peersRaw := result["peers"].(type) {
+	case string:
+		peers, err := parsePeers(peersRaw)
+		if err != nil {
+			return nil, err
+		}
+		r.Peers = peers
+	case []interface{}:
+		// Non-compact form: a list of {ip, port[, peer id]} dictionaries.
+		for _, p := range peersRaw {
+			d, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			host, _ := d["ip"].(string)
+			port, _ := d["port"].(int64)
+			ip := net.ParseIP(host)
+			if ip == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			r.Peers = append(r.Peers, Peer{IP: ip, Port: uint16(port)})
+		}
+	case nil:
+		// No peers at all is a valid (if unhelpful) answer.
+	default:
+		return nil, errors.New("tracker peers field has unexpected type")
 	}
 
-	return parsePeers(peersRaw)
+	return r, nil
 }
 
 func parsePeers(peersBin string) ([]Peer, error) {
@@ -113,10 +417,3 @@ func parsePeers(peersBin string) ([]Peer, error) {
 
 	return peers, nil
 }
-
-// io.ReadAll alias to avoid import confusion if using old go but here accessing standard lib
-func readAll(r io.Reader) ([]byte, error) {
-	// using io.ReadAll
-	// can just import "io"
-	return io.ReadAll(r)
-}
@@ -1,9 +1,16 @@
 package tracker
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"strings"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 	
 	"github.com/Minesto23/peerwire/internal/bencode"
 )
@@ -60,3 +67,178 @@ func TestRequestPeers(t *testing.T) {
         t.Errorf("Port = %d, want 8080", peers[0].Port)
     }
 }
+
+func TestAnnounceParameters(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		data, _ := bencode.Marshal(map[string]interface{}{
+			"interval":   1800,
+			"tracker id": "abc",
+			"complete":   3,
+			"incomplete": 7,
+			"peers":      "",
+		})
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{Header: http.Header{"X-Test": []string{"1"}}})
+	req := AnnounceRequest{
+		Port:       6881,
+		Uploaded:   10,
+		Downloaded: 20,
+		Left:       30,
+		Event:      EventStarted,
+		Key:        0xdeadbeef,
+		NumWant:    80,
+		NoPeerID:   true,
+	}
+
+	resp, err := c.Announce(server.URL+"/announce?passkey=secret", req)
+	if err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+
+	q := got.URL.Query()
+	want := map[string]string{
+		"port":       "6881",
+		"uploaded":   "10",
+		"downloaded": "20",
+		"left":       "30",
+		"event":      "started",
+		"key":        "deadbeef",
+		"numwant":    "80",
+		"no_peer_id": "1",
+		"compact":    "1",
+		"passkey":    "secret",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+	if got.UserAgent() != DefaultUserAgent {
+		t.Errorf("User-Agent = %q, want %q", got.UserAgent(), DefaultUserAgent)
+	}
+	if got.Header.Get("X-Test") != "1" {
+		t.Errorf("custom header not sent")
+	}
+
+	if resp.Interval.Seconds() != 1800 || resp.Seeders != 3 || resp.Leechers != 7 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	// The tracker id must be echoed on the next announce.
+	if _, err := c.Announce(server.URL+"/announce?passkey=secret", req); err != nil {
+		t.Fatalf("second Announce failed: %v", err)
+	}
+	if got.URL.Query().Get("trackerid") != "abc" {
+		t.Errorf("trackerid = %q, want abc", got.URL.Query().Get("trackerid"))
+	}
+}
+
+func TestAnnounceGzipAndFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("d14:failure reason12:unregisterede"))
+			return
+		}
+
+		data, _ := bencode.Marshal(map[string]interface{}{
+			"interval": 900,
+			"peers": []interface{}{
+				map[string]interface{}{"ip": "10.0.0.1", "port": 51413},
+			},
+		})
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{})
+
+	resp, err := c.Announce(server.URL+"/ok", AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:51413" {
+		t.Errorf("Peers = %v, want [10.0.0.1:51413]", resp.Peers)
+	}
+
+	_, err = c.Announce(server.URL+"/fail", AnnounceRequest{Port: 6881})
+	if err == nil || !strings.Contains(err.Error(), "unregistered") {
+		t.Errorf("expected failure reason in error, got %v", err)
+	}
+}
+
+// udpTracker answers BEP 15 requests with respond until the test ends.
+// It returns the announce URL and a count of the requests received.
+func udpTracker(t *testing.T, respond func(req []byte) []byte) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var requests atomic.Int32
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			requests.Add(1)
+			if resp := respond(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce", &requests
+}
+
+func TestUDPAnnounceError(t *testing.T) {
+	url, requests := udpTracker(t, func(req []byte) []byte {
+		resp := make([]byte, 8, 16)
+		tid := req[12:16]
+		if binary.BigEndian.Uint32(req[8:12]) == actionConnect {
+			binary.BigEndian.PutUint32(resp, actionConnect)
+			copy(resp[4:], tid)
+			return append(resp, 1, 2, 3, 4, 5, 6, 7, 8)
+		}
+		// Shorter than any announce response.
+		binary.BigEndian.PutUint32(resp, actionError)
+		copy(resp[4:], tid)
+		return append(resp, "go away"...)
+	})
+
+	_, err := NewClient(Config{}).Announce(url, AnnounceRequest{Port: 6881})
+	if !isFailure(err) || !strings.Contains(err.Error(), "go away") {
+		t.Errorf("Announce() error = %v, want the tracker's message", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("tracker got %d requests, want a connect and an announce", n)
+	}
+}
+
+func TestUDPAnnounceTimeout(t *testing.T) {
+	url, requests := udpTracker(t, func([]byte) []byte { return nil })
+
+	start := time.Now()
+	_, err := NewClient(Config{Timeout: 100 * time.Millisecond}).Announce(url, AnnounceRequest{Port: 6881})
+	if err == nil {
+		t.Fatal("Announce() succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Announce() took %v with a 100ms timeout", elapsed)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("tracker got %d connects, want 3 attempts", n)
+	}
+}
@@ -16,37 +16,75 @@ const (
 	protocolId     = 0x41727101980
 	actionConnect  = 0
 	actionAnnounce = 1
+	actionError    = 3
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func requestPeersUDP(announceURL string, infoHash [20]byte, peerID [20]byte, port int, length int64) ([]Peer, error) {
+// UDP announce events (BEP 15 encodes them as integers).
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// announceUDP announces over UDP, giving each attempt timeout to get
+// both answers. Only attempts that time out are retried, assuming packet
+// loss: an answer, even an error, is final.
+func announceUDP(announceURL *url.URL, req AnnounceRequest, timeout time.Duration) (*AnnounceResponse, error) {
 	var lastErr error
 	// Try up to 3 times
 	for i := 0; i < 3; i++ {
-		peers, err := doRequestPeersUDP(announceURL, infoHash, peerID, port, length)
+		resp, err := doAnnounceUDP(announceURL, req, timeout)
 		if err == nil {
-			return peers, nil
+			return resp, nil
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return nil, err
 		}
 		lastErr = err
-		// Exponential backoff or just short wait?
-		// BEP 15 suggests 15 * 2^n. But user might be impatient.
-		// Let's try 5s, 10s, 15s logic inside the attempt, or just close and retry.
-		// We'll just retry immediately with a fresh socket, assuming packet loss.
+		// BEP 15 waits 15 * 2^n seconds between attempts, up to an hour.
+		// Announces are periodic anyway, so we retry right away with a
+		// fresh socket and leave it to the next announce after three.
 		fmt.Printf("UDP Tracker Attempt %d/3 failed: %v. Retrying...\n", i+1, err)
-		time.Sleep(time.Second)
 	}
-	return nil, fmt.Errorf("udp tracker failed after 3 attempts: %v", lastErr)
+	return nil, fmt.Errorf("udp tracker failed after 3 attempts: %w", lastErr)
 }
 
-func doRequestPeersUDP(announceURL string, infoHash [20]byte, peerID [20]byte, port int, length int64) ([]Peer, error) {
-	parsed, err := url.Parse(announceURL)
+// readUDPResponse reads a response to transaction tid and checks its
+// header: action and transaction id. A tracker error is returned as a
+// failureError. The response is returned whole, header included, and
+// holds at least min bytes.
+func readUDPResponse(conn net.Conn, buf []byte, action, tid uint32, min int) ([]byte, error) {
+	n, err := conn.Read(buf)
 	if err != nil {
 		return nil, err
 	}
+	buf = buf[:n]
+	if n < 8 {
+		return nil, errors.New("udp tracker: response too short")
+	}
+	if binary.BigEndian.Uint32(buf[4:8]) != tid {
+		return nil, errors.New("udp tracker: transaction id mismatch")
+	}
+	switch got := binary.BigEndian.Uint32(buf[0:4]); got {
+	case action:
+	case actionError:
+		return nil, failureError(buf[8:])
+	default:
+		return nil, fmt.Errorf("udp tracker: action mismatch, got %d", got)
+	}
+	if n < min {
+		return nil, errors.New("udp tracker: response too short")
+	}
+	return buf, nil
+}
 
+func doAnnounceUDP(parsed *url.URL, req AnnounceRequest, timeout time.Duration) (*AnnounceResponse, error) {
 	serverAddr, err := net.ResolveUDPAddr("udp", parsed.Host)
 	if err != nil {
 		return nil, err
@@ -58,10 +96,7 @@ func doRequestPeersUDP(announceURL string, infoHash [20]byte, peerID [20]byte, p
 	}
 	defer conn.Close()
 
-	// Set a reasonable deadline for each attempt
-	// 5 seconds for connect + announce is tight but responsive.
-	// BEP 15 suggests 15s. Let's use 10s per attempt.
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.SetDeadline(time.Now().Add(timeout))
 
 	// 1. Connection Request
 	transactionID := rand.Uint32()
@@ -75,26 +110,12 @@ func doRequestPeersUDP(announceURL string, infoHash [20]byte, peerID [20]byte, p
 		return nil, err
 	}
 
-	// Connection Response (16 bytes)
-	connRespBuf := make([]byte, 16)
-	n, err := conn.Read(connRespBuf)
+	// Connection Response (16 bytes, or an error)
+	connResp, err := readUDPResponse(conn, make([]byte, 1024), actionConnect, transactionID, 16)
 	if err != nil {
 		return nil, err
 	}
-	if n < 16 {
-		return nil, errors.New("udp tracker: connection response too short")
-	}
-
-	action := binary.BigEndian.Uint32(connRespBuf[0:4])
-	tid := binary.BigEndian.Uint32(connRespBuf[4:8])
-	connID := binary.BigEndian.Uint64(connRespBuf[8:16])
-
-	if action != actionConnect {
-		return nil, fmt.Errorf("udp tracker: connect action mismatch, got %d", action)
-	}
-	if tid != transactionID {
-		return nil, fmt.Errorf("udp tracker: connect transaction id mismatch")
-	}
+	connID := binary.BigEndian.Uint64(connResp[8:16])
 
 	// 2. Announce Request
 	// Offset  Size    Name
@@ -114,20 +135,25 @@ func doRequestPeersUDP(announceURL string, infoHash [20]byte, peerID [20]byte, p
 
 	transactionID = rand.Uint32()
 
+	numWant := int32(req.NumWant)
+	if numWant <= 0 {
+		numWant = -1 // tracker default
+	}
+
 	announceReq := new(bytes.Buffer)
 	binary.Write(announceReq, binary.BigEndian, uint64(connID))
 	binary.Write(announceReq, binary.BigEndian, uint32(actionAnnounce))
 	binary.Write(announceReq, binary.BigEndian, uint32(transactionID))
-	announceReq.Write(infoHash[:])
-	announceReq.Write(peerID[:])
-	binary.Write(announceReq, binary.BigEndian, uint64(0))             // downloaded
-	binary.Write(announceReq, binary.BigEndian, uint64(length))        // left
-	binary.Write(announceReq, binary.BigEndian, uint64(0))             // uploaded
-	binary.Write(announceReq, binary.BigEndian, uint32(0))             // event: none
-	binary.Write(announceReq, binary.BigEndian, uint32(0))             // ip: default
-	binary.Write(announceReq, binary.BigEndian, uint32(rand.Uint32())) // key
-	binary.Write(announceReq, binary.BigEndian, int32(-1))             // num_want: default
-	binary.Write(announceReq, binary.BigEndian, uint16(port))
+	announceReq.Write(req.InfoHash[:])
+	announceReq.Write(req.PeerID[:])
+	binary.Write(announceReq, binary.BigEndian, uint64(req.Downloaded))
+	binary.Write(announceReq, binary.BigEndian, uint64(req.Left))
+	binary.Write(announceReq, binary.BigEndian, uint64(req.Uploaded))
+	binary.Write(announceReq, binary.BigEndian, udpEvents[req.Event])
+	binary.Write(announceReq, binary.BigEndian, uint32(0)) // ip: default
+	binary.Write(announceReq, binary.BigEndian, req.Key)
+	binary.Write(announceReq, binary.BigEndian, numWant)
+	binary.Write(announceReq, binary.BigEndian, uint16(req.Port))
 
 	if _, err := conn.Write(announceReq.Bytes()); err != nil {
 		return nil, err
@@ -135,32 +161,27 @@ func doRequestPeersUDP(announceURL string, infoHash [20]byte, peerID [20]byte, p
 
 	// Announce Response
 	// action (4), trans_id (4), interval (4), leechers (4), seeders (4), peers...
-	respBuf := make([]byte, 4096)
-	n, err = conn.Read(respBuf)
+	respBuf, err := readUDPResponse(conn, make([]byte, 4096), actionAnnounce, transactionID, 20)
 	if err != nil {
 		return nil, err
 	}
 
-	if n < 20 {
-		return nil, errors.New("udp tracker: announce response too short")
-	}
-
-	action = binary.BigEndian.Uint32(respBuf[0:4])
-	if action != actionAnnounce {
-		return nil, fmt.Errorf("udp tracker: announce action mismatch, got %d", action)
+	resp := &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(respBuf[8:12])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(respBuf[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(respBuf[16:20])),
 	}
 
 	// Parses peers from remaining bytes
 	// Each peer is 6 bytes (IP 4, Port 2)
-	peersBin := respBuf[20:n]
+	peersBin := respBuf[20:]
 
-	var peers []Peer
 	for i := 0; i < len(peersBin)/6; i++ {
 		offset := i * 6
 		ip := net.IP(peersBin[offset : offset+4])
 		port := binary.BigEndian.Uint16(peersBin[offset+4 : offset+6])
-		peers = append(peers, Peer{IP: ip, Port: port})
+		resp.Peers = append(resp.Peers, Peer{IP: ip, Port: port})
 	}
 
-	return peers, nil
+	return resp, nil
 }